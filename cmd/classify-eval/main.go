@@ -0,0 +1,325 @@
+// Command classify-eval measures the classifier against a labeled corpus and
+// can compare two keyword rule configurations side by side.
+//
+// Usage:
+//
+//	go run ./cmd/classify-eval -transactional corpus/receipts -marketing corpus/promos.mbox
+//	go run ./cmd/classify-eval -db /data/postal.db -rules mine.json -compare builtin
+//
+// A corpus path is either a directory of .eml files or an mbox file. With
+// -db, emails stored by the service are used: corrected ones with the label
+// the user gave and filtered marketing emails as marketing.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"postal-inspection-service/internal/classifier"
+	"postal-inspection-service/internal/db"
+	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/mbox"
+)
+
+// sample is one labeled email of the corpus
+type sample struct {
+	source        string
+	email         *imap.FetchedEmail
+	transactional bool
+}
+
+// result is how one configuration did on the corpus
+type result struct {
+	name     string
+	verdicts []classifier.Classification
+	// confusion[actual][predicted], index 0 = transactional, 1 = marketing
+	confusion [2][2]int
+}
+
+// pathList collects a repeatable flag
+type pathList []string
+
+func (p *pathList) String() string     { return strings.Join(*p, ",") }
+func (p *pathList) Set(v string) error { *p = append(*p, v); return nil }
+
+func main() {
+	var transactionalPaths, marketingPaths pathList
+	flag.Var(&transactionalPaths, "transactional", "directory of .eml files or mbox of transactional emails (repeatable)")
+	flag.Var(&marketingPaths, "marketing", "directory of .eml files or mbox of marketing emails (repeatable)")
+	dbPath := flag.String("db", "", "use emails labeled in the service database at this path")
+	rulesPath := flag.String("rules", "builtin", `classifier rules file to evaluate, or "builtin"`)
+	comparePath := flag.String("compare", "", `second rules file (or "builtin") to compare against`)
+	show := flag.Int("show", 50, "maximum misclassified messages to list per configuration")
+	flag.Parse()
+
+	var corpus []sample
+	for _, path := range transactionalPaths {
+		corpus = append(corpus, mustLoad(path, true)...)
+	}
+	for _, path := range marketingPaths {
+		corpus = append(corpus, mustLoad(path, false)...)
+	}
+	if *dbPath != "" {
+		samples, err := loadDatabase(*dbPath)
+		if err != nil {
+			log.Fatalf("Failed to load labeled emails from %s: %v", *dbPath, err)
+		}
+		corpus = append(corpus, samples...)
+	}
+	if len(corpus) == 0 {
+		fmt.Fprintln(os.Stderr, "No labeled emails; pass -transactional, -marketing and/or -db")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var transactionalCount int
+	for _, s := range corpus {
+		if s.transactional {
+			transactionalCount++
+		}
+	}
+	fmt.Printf("Corpus: %d transactional, %d marketing (%d total)\n",
+		transactionalCount, len(corpus)-transactionalCount, len(corpus))
+
+	a := evaluate(*rulesPath, mustLoadRules(*rulesPath), corpus)
+	report(a, corpus, *show)
+
+	if *comparePath != "" {
+		b := evaluate(*comparePath, mustLoadRules(*comparePath), corpus)
+		report(b, corpus, *show)
+		compare(a, b, corpus)
+	}
+}
+
+func mustLoadRules(path string) classifier.Classifier {
+	if path == "builtin" {
+		return classifier.Default()
+	}
+	engine, err := classifier.LoadRules(path)
+	if err != nil {
+		log.Fatalf("Failed to load rules: %v", err)
+	}
+	return classifier.Heuristic{Rules: engine}
+}
+
+func mustLoad(path string, transactional bool) []sample {
+	samples, err := loadPath(path, transactional)
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", path, err)
+	}
+	return samples
+}
+
+// loadPath reads a directory of .eml files or an mbox file
+func loadPath(path string, transactional bool) ([]sample, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []sample
+	add := func(source string, raw []byte) {
+		email, err := imap.ParseMessage(raw)
+		if err != nil {
+			log.Printf("Skipping %s: %v", source, err)
+			return
+		}
+		samples = append(samples, sample{source: source, email: email, transactional: transactional})
+	}
+
+	if info.IsDir() {
+		err := filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".eml") {
+				return err
+			}
+			raw, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			add(p, raw)
+			return nil
+		})
+		return samples, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := mbox.NewReader(f)
+	for i := 1; ; i++ {
+		raw, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		add(fmt.Sprintf("%s#%d", path, i), raw)
+	}
+	return samples, nil
+}
+
+func loadDatabase(path string) ([]sample, error) {
+	database, err := db.New(path)
+	if err != nil {
+		return nil, err
+	}
+	defer database.Close()
+
+	labeled, err := database.GetLabeledEmails()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]sample, len(labeled))
+	for i, l := range labeled {
+		samples[i] = sample{
+			source: fmt.Sprintf("email_details#%d", l.Email.ID),
+			email: &imap.FetchedEmail{
+				MessageID:      l.Email.MessageID,
+				From:           l.Email.Sender,
+				FromName:       l.Email.SenderName,
+				To:             l.Email.Recipients,
+				Subject:        l.Email.Subject,
+				Date:           l.Email.Date,
+				Headers:        l.Email.Headers,
+				BodyText:       l.Email.BodyText,
+				BodyHTML:       l.Email.BodyHTML,
+				HasAttachments: l.Email.HasAttachments,
+			},
+			transactional: l.IsTransactional,
+		}
+	}
+	return samples, nil
+}
+
+func evaluate(name string, c classifier.Classifier, corpus []sample) *result {
+	r := &result{name: name, verdicts: make([]classifier.Classification, len(corpus))}
+	for i, s := range corpus {
+		v := c.Classify(s.email)
+		r.verdicts[i] = v
+		r.confusion[label(s.transactional)][label(v.IsTransactional)]++
+	}
+	return r
+}
+
+func label(transactional bool) int {
+	if transactional {
+		return 0
+	}
+	return 1
+}
+
+var labelNames = [2]string{"transactional", "marketing"}
+
+// precision and recall of one label
+func (r *result) precision(l int) float64 {
+	return ratio(r.confusion[l][l], r.confusion[0][l]+r.confusion[1][l])
+}
+
+func (r *result) recall(l int) float64 {
+	return ratio(r.confusion[l][l], r.confusion[l][0]+r.confusion[l][1])
+}
+
+func (r *result) accuracy() float64 {
+	return ratio(r.confusion[0][0]+r.confusion[1][1],
+		r.confusion[0][0]+r.confusion[0][1]+r.confusion[1][0]+r.confusion[1][1])
+}
+
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
+
+func report(r *result, corpus []sample, show int) {
+	fmt.Printf("\n== %s ==\n\n", r.name)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "actual \\ predicted\ttransactional\tmarketing\t")
+	for l, name := range labelNames {
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", name, r.confusion[l][0], r.confusion[l][1])
+	}
+	fmt.Fprintln(w, "\t\t\t")
+	fmt.Fprintln(w, "\tprecision\trecall\t")
+	for l, name := range labelNames {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", name, percent(r.precision(l)), percent(r.recall(l)))
+	}
+	fmt.Fprintf(w, "accuracy\t%s\t\t\n", percent(r.accuracy()))
+	w.Flush()
+
+	var wrong []int
+	for i, s := range corpus {
+		if r.verdicts[i].IsTransactional != s.transactional {
+			wrong = append(wrong, i)
+		}
+	}
+	fmt.Printf("\nMisclassified: %d\n", len(wrong))
+	for n, i := range wrong {
+		if n == show {
+			fmt.Printf("  ... and %d more\n", len(wrong)-show)
+			break
+		}
+		printSample(corpus[i], r.verdicts[i])
+	}
+}
+
+func printSample(s sample, v classifier.Classification) {
+	fmt.Printf("  [%s -> %s] %s\n", labelNames[label(s.transactional)], labelNames[label(v.IsTransactional)], s.source)
+	fmt.Printf("      from %s: %q\n", s.email.From, s.email.Subject)
+	fmt.Printf("      %s; %s\n", v.Reason, v.Explanation())
+}
+
+func compare(a, b *result, corpus []sample) {
+	fmt.Printf("\n== %s vs %s ==\n\n", a.name, b.name)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\t%s\t%s\tchange\t\n", a.name, b.name)
+	metric := func(name string, x, y float64) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%+.1f\t\n", name, percent(x), percent(y), (y-x)*100)
+	}
+	for l, name := range labelNames {
+		metric(name+" precision", a.precision(l), b.precision(l))
+		metric(name+" recall", a.recall(l), b.recall(l))
+	}
+	metric("accuracy", a.accuracy(), b.accuracy())
+	w.Flush()
+
+	var fixed, broken []int
+	for i, s := range corpus {
+		aRight := a.verdicts[i].IsTransactional == s.transactional
+		bRight := b.verdicts[i].IsTransactional == s.transactional
+		switch {
+		case !aRight && bRight:
+			fixed = append(fixed, i)
+		case aRight && !bRight:
+			broken = append(broken, i)
+		}
+	}
+	sort.Ints(fixed)
+	sort.Ints(broken)
+
+	fmt.Printf("\nFixed by %s: %d\n", b.name, len(fixed))
+	for _, i := range fixed {
+		printSample(corpus[i], b.verdicts[i])
+	}
+	fmt.Printf("\nBroken by %s: %d\n", b.name, len(broken))
+	for _, i := range broken {
+		printSample(corpus[i], b.verdicts[i])
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"strings"
 
-	"crypto/tls"
+	"crypto/x509"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
 	"postal-inspection-service/internal/config"
+	"postal-inspection-service/internal/db"
+	uspisimap "postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/oauth"
 )
 
 func main() {
+	accountName := flag.String("account", "", "name from ACCOUNTS or address of the account to check (default the first)")
+	flag.Parse()
+
 	fmt.Println("=== USPIS - Postal Inspection Service Diagnostics ===")
 	fmt.Println()
 
@@ -20,19 +27,72 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	account := cfg.Accounts[0]
+	if *accountName != "" {
+		found := false
+		for _, a := range cfg.Accounts {
+			if strings.EqualFold(a.Name, *accountName) || strings.EqualFold(a.Email, *accountName) {
+				account, found = a, true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("No account %q configured", *accountName)
+		}
+	}
 
-	fmt.Printf("Connecting to %s:%d as %s...\n", cfg.IMAPServer, cfg.IMAPPort, cfg.Email)
+	fmt.Printf("Connecting to %s:%d (%s) as %s...\n", account.IMAPServer, account.IMAPPort, account.IMAPTLS, account.Username)
 
-	addr := fmt.Sprintf("%s:%d", cfg.IMAPServer, cfg.IMAPPort)
-	client, err := imapclient.DialTLS(addr, &imapclient.Options{
-		TLSConfig: &tls.Config{ServerName: cfg.IMAPServer},
-	})
+	tlsMode, err := uspisimap.ParseTLSMode(account.IMAPTLS)
+	if err != nil {
+		log.Fatalf("Invalid IMAP_TLS: %v", err)
+	}
+	var rootCAs *x509.CertPool
+	if account.IMAPCAFile != "" {
+		rootCAs, err = uspisimap.LoadCertPool(account.IMAPCAFile)
+		if err != nil {
+			log.Fatalf("Failed to load IMAP_CA_FILE: %v", err)
+		}
+	}
+
+	client, err := uspisimap.Dial(account.IMAPServer, account.IMAPPort, tlsMode, rootCAs, &imapclient.Options{})
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
 	defer client.Close()
 
-	if err := client.Login(cfg.Email, cfg.AppPassword).Wait(); err != nil {
+	authMode, err := uspisimap.ParseAuthMode(account.IMAPAuth)
+	if err != nil {
+		log.Fatalf("Invalid IMAP_AUTH: %v", err)
+	}
+	creds := uspisimap.Credentials{
+		Mode:     authMode,
+		Username: account.Username,
+		Password: account.Password,
+		Server:   account.IMAPServer,
+		Port:     account.IMAPPort,
+	}
+	// OAuth2 tokens are read from the service's database, so the account
+	// must have been authorized on the dashboard first
+	if authMode.IsOAuth() {
+		endpoint, err := oauth.ResolveEndpoint(account.IMAPProvider, account.OAuthAuthURL, account.OAuthTokenURL, account.OAuthScopes)
+		if err != nil {
+			log.Fatalf("Invalid OAuth2 configuration: %v", err)
+		}
+		database, err := db.New(cfg.DBPath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer database.Close()
+		creds.Tokens = oauth.NewSource(oauth.Config{
+			ClientID:     account.OAuthClientID,
+			ClientSecret: account.OAuthSecret,
+			RedirectURL:  cfg.OAuthRedirect,
+			Endpoint:     endpoint,
+		}, database, account.Email)
+	}
+
+	if err := uspisimap.Authenticate(client, creds); err != nil {
 		log.Fatalf("Failed to login: %v", err)
 	}
 
@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"postal-inspection-service/internal/archive"
+	"postal-inspection-service/internal/blobstore"
+	"postal-inspection-service/internal/classifier"
 	"postal-inspection-service/internal/config"
 	"postal-inspection-service/internal/db"
 	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/oauth"
 	"postal-inspection-service/internal/poller"
 	"postal-inspection-service/internal/web"
 )
@@ -29,8 +34,12 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	log.Printf("Configuration loaded: IMAP=%s:%d, Poll=%v, Web=:%d",
-		cfg.IMAPServer, cfg.IMAPPort, cfg.PollInterval, cfg.WebPort)
+	log.Printf("Configuration loaded: Accounts=%d, Poll=%v, IDLE=%v, DryRun=%v, ScanJunk=%v, Web=:%d",
+		len(cfg.Accounts), cfg.PollInterval, cfg.IdleEnabled, cfg.DryRun, cfg.ScanJunk, cfg.WebPort)
+	for _, account := range cfg.Accounts {
+		log.Printf("Account %s: IMAP=%s:%d (%s), User=%s, Auth=%s",
+			account.ID(), account.IMAPServer, account.IMAPPort, account.IMAPTLS, account.Username, account.IMAPAuth)
+	}
 
 	// Initialize database
 	database, err := db.New(cfg.DBPath)
@@ -40,15 +49,83 @@ func main() {
 	defer database.Close()
 	log.Printf("Database initialized at %s", cfg.DBPath)
 
-	// Create IMAP client
-	imapClient := imap.NewClient(cfg.IMAPServer, cfg.IMAPPort, cfg.Email, cfg.AppPassword)
+	deleteMode, err := imap.ParseDeleteMode(cfg.DeleteMode)
+	if err != nil {
+		log.Fatalf("Invalid DELETE_MODE: %v", err)
+	}
+
+	// Create an IMAP client for every account
+	clients := make([]*imap.Client, len(cfg.Accounts))
+	tokens := make([]*oauth.Source, len(cfg.Accounts))
+	for i, account := range cfg.Accounts {
+		clients[i], tokens[i] = newClient(cfg, account, deleteMode, database)
+		defer clients[i].Close()
+	}
+
+	// Classifier keyword rules come from a file when one is configured
+	var emailClassifier classifier.Classifier
+	if cfg.RulesFile != "" {
+		ruleFile, err := classifier.NewRuleFile(cfg.RulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load CLASSIFIER_RULES_FILE: %v", err)
+		}
+		emailClassifier = classifier.Heuristic{Rules: ruleFile}
+		log.Printf("Classifier rules loaded from %s", cfg.RulesFile)
+	}
+
+	// Attachment contents are kept on the data volume when a cap is set
+	var blobs *blobstore.Store
+	if cfg.AttachmentMB > 0 {
+		blobs, err = blobstore.New(cfg.AttachmentDir, cfg.AttachmentMB<<20)
+		if err != nil {
+			log.Fatalf("Failed to open attachment store: %v", err)
+		}
+		used, _ := blobs.Size()
+		log.Printf("Attachment store at %s (%d of %d MB used)", cfg.AttachmentDir, used>>20, cfg.AttachmentMB)
+	}
 
-	// Create poller
-	emailPoller := poller.New(imapClient, database, cfg.PollInterval)
+	// Deleted emails are archived on the data volume unless retention is 0
+	var archived *archive.Store
+	if cfg.ArchiveDays > 0 {
+		archived, err = archive.New(cfg.ArchiveDir)
+		if err != nil {
+			log.Fatalf("Failed to open archive: %v", err)
+		}
+		log.Printf("Archiving deleted emails to %s for %d days", cfg.ArchiveDir, cfg.ArchiveDays)
+	}
+
+	// Create a poller for every account; the first also does the shared
+	// housekeeping
+	model := classifier.NewBayes(database)
+	pollers := make([]*poller.Poller, len(cfg.Accounts))
+	webAccounts := make([]web.Account, len(cfg.Accounts))
+	for i, account := range cfg.Accounts {
+		pollers[i] = poller.New(clients[i], database, poller.Options{
+			Interval:       cfg.PollInterval,
+			Idle:           cfg.IdleEnabled,
+			QuarantineDays: cfg.QuarantineDays,
+			DryRun:         cfg.DryRun,
+			ScanJunk:       cfg.ScanJunk,
+			Classifier:     emailClassifier,
+			Model:          model,
+			Blobs:          blobs,
+			Archive:        archived,
+			ArchiveDays:    cfg.ArchiveDays,
+			Account:        account.ID(),
+			Primary:        i == 0,
+		})
+		webAccounts[i] = web.Account{
+			ID:       account.ID(),
+			Mailbox:  clients[i],
+			Applier:  pollers[i],
+			Tokens:   tokens[i],
+			ScanJunk: cfg.ScanJunk,
+		}
+	}
 
 	// Create web server
 	repoURL := "https://github.com/BrandonKowalski/postal-inspection-service"
-	webServer, err := web.NewServer(database, cfg.WebPort, CommitSHA, repoURL)
+	webServer, err := web.NewServer(database, webAccounts, blobs, archived, cfg.WebPort, CommitSHA, repoURL)
 	if err != nil {
 		log.Fatalf("Failed to create web server: %v", err)
 	}
@@ -60,8 +137,10 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start poller in background
-	go emailPoller.Start(ctx)
+	// Start pollers in background
+	for _, p := range pollers {
+		go p.Start(ctx)
+	}
 
 	// Start web server in background
 	go func() {
@@ -79,3 +158,60 @@ func main() {
 	cancel()
 	log.Println("Goodbye!")
 }
+
+// newClient creates the IMAP client of an account, and the token source it
+// signs in with if it uses OAuth2
+func newClient(cfg *config.Config, account config.Account, deleteMode imap.DeleteMode, database *db.DB) (*imap.Client, *oauth.Source) {
+	tlsMode, err := imap.ParseTLSMode(account.IMAPTLS)
+	if err != nil {
+		log.Fatalf("Invalid IMAP_TLS for %s: %v", account.ID(), err)
+	}
+	if tlsMode == imap.TLSModePlain {
+		log.Printf("Warning: IMAP_TLS=plain sends the password of %s unencrypted", account.ID())
+	}
+
+	var rootCAs *x509.CertPool
+	if account.IMAPCAFile != "" {
+		rootCAs, err = imap.LoadCertPool(account.IMAPCAFile)
+		if err != nil {
+			log.Fatalf("Failed to load IMAP_CA_FILE for %s: %v", account.ID(), err)
+		}
+	}
+
+	authMode, err := imap.ParseAuthMode(account.IMAPAuth)
+	if err != nil {
+		log.Fatalf("Invalid IMAP_AUTH for %s: %v", account.ID(), err)
+	}
+
+	// OAuth2 accounts get their tokens from the database once authorized
+	// on the dashboard
+	var tokens *oauth.Source
+	if authMode.IsOAuth() {
+		endpoint, err := oauth.ResolveEndpoint(account.IMAPProvider, account.OAuthAuthURL, account.OAuthTokenURL, account.OAuthScopes)
+		if err != nil {
+			log.Fatalf("Invalid OAuth2 configuration for %s: %v", account.ID(), err)
+		}
+		tokens = oauth.NewSource(oauth.Config{
+			ClientID:     account.OAuthClientID,
+			ClientSecret: account.OAuthSecret,
+			RedirectURL:  cfg.OAuthRedirect,
+			Endpoint:     endpoint,
+		}, database, account.Email)
+		if token, err := tokens.Status(); err == nil && token == nil {
+			log.Printf("%s is not authorized yet; sign in at /oauth on the dashboard", account.Email)
+		}
+	}
+
+	imapOptions := imap.Options{
+		MaxConnections: cfg.IMAPMaxConns,
+		ServerSearch:   cfg.ServerSearch,
+		DeleteMode:     deleteMode,
+		TLS:            tlsMode,
+		RootCAs:        rootCAs,
+		Auth:           authMode,
+	}
+	if tokens != nil {
+		imapOptions.Tokens = tokens
+	}
+	return imap.NewClient(account.IMAPServer, account.IMAPPort, account.Username, account.Password, imapOptions), tokens
+}
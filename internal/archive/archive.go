@@ -0,0 +1,154 @@
+// Package archive keeps the original source of deleted emails on disk,
+// gzip-compressed and named by the SHA-256 of the uncompressed message, so an
+// email deleted twice is stored once.
+package archive
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ext is appended to the hash to name each file
+const ext = ".eml.gz"
+
+// Store is a directory of compressed, content-addressed messages
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// New opens the archive in dir, creating it if needed
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Hash returns the key raw is archived under
+func Hash(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put archives raw and returns its hash and the compressed size on disk
+func (s *Store) Put(raw []byte) (hash string, size int64, err error) {
+	hash = Hash(raw)
+	path := s.path(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info, err := os.Stat(path); err == nil {
+		return hash, info.Size(), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return hash, 0, err
+	}
+	// Write to a temporary file first so a crash never leaves a partial
+	// message under its final name
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return hash, 0, err
+	}
+	zw := gzip.NewWriter(tmp)
+	if _, err := zw.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return hash, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return hash, 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return hash, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return hash, 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return hash, 0, err
+	}
+	return hash, info.Size(), nil
+}
+
+// Open returns the uncompressed message archived under hash
+func (s *Store) Open(hash string) (io.ReadCloser, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	f, err := os.Open(s.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", hash, err)
+	}
+	return &reader{Reader: zr, file: f}, nil
+}
+
+// Prune removes every message whose hash keep doesn't contain and returns
+// how many were removed and the bytes freed
+func (s *Store) Prune(keep map[string]bool) (removed int, freed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || keep[strings.TrimSuffix(d.Name(), ext)] {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// path spreads files over subdirectories by the first byte of their hash
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash+ext)
+}
+
+// reader closes the underlying file along with the decompressor
+type reader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *reader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
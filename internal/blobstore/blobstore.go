@@ -0,0 +1,148 @@
+// Package blobstore keeps file contents on disk named by their SHA-256, so
+// the same file attached to many emails is stored once. The total size of the
+// store is capped; files that would go over the cap are not kept.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store is a directory of content-addressed files
+type Store struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// New opens the store in dir, creating it if needed, with a cap of maxBytes
+func New(dir string, maxBytes int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, maxBytes: maxBytes}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		s.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+	}
+	return s, nil
+}
+
+// Hash returns the key data is stored under
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores data and returns its hash. stored is false when the store is
+// full; the data is then dropped.
+func (s *Store) Put(data []byte) (hash string, stored bool, err error) {
+	hash = Hash(data)
+	path := s.path(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return hash, true, nil
+	}
+	if s.size+int64(len(data)) > s.maxBytes {
+		return hash, false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return hash, false, err
+	}
+	// Write to a temporary file first so a crash never leaves a partial blob
+	// under its final name
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return hash, false, err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return hash, false, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return hash, false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return hash, false, err
+	}
+
+	s.size += int64(len(data))
+	return hash, true, nil
+}
+
+// Open returns the file stored under hash
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	return os.Open(s.path(hash))
+}
+
+// Prune removes every file whose hash keep doesn't contain and returns how
+// many were removed and the bytes freed
+func (s *Store) Prune(keep map[string]bool) (removed int, freed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || keep[d.Name()] {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	s.size -= freed
+	return removed, freed, err
+}
+
+// Size returns the bytes in use and the cap
+func (s *Store) Size() (used, max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, s.maxBytes
+}
+
+// path spreads files over subdirectories by the first byte of their hash
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
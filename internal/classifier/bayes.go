@@ -0,0 +1,259 @@
+package classifier
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"postal-inspection-service/internal/db"
+	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/rules"
+)
+
+const (
+	// MinTrainedPerLabel is how many emails of each label the model needs
+	// before its opinion counts. Transactional examples only come from user
+	// corrections, so it stays off until the user has made this many.
+	MinTrainedPerLabel = 5
+	// interestingTokens is how many of the most telling tokens are combined
+	// into a prediction, which keeps long emails from looking certain
+	interestingTokens = 20
+	// learnBatch caps how many stored emails are added to the model per call
+	learnBatch = 200
+	// weightModel is the signal weight of a model that is completely sure
+	weightModel = 4
+	// maxBodyTokens bounds the body words taken from each email
+	maxBodyTokens = 500
+)
+
+// Bayes is a naive Bayes model of transactional vs marketing mail, stored in
+// the database and trained from filtered emails and user corrections
+type Bayes struct {
+	db *db.DB
+}
+
+// NewBayes returns the model stored in database
+func NewBayes(database *db.DB) *Bayes {
+	return &Bayes{db: database}
+}
+
+// Train adds an email to the model under a label. Emails are identified by
+// Message-ID; ones without it are skipped.
+func (b *Bayes) Train(email *imap.FetchedEmail, transactional bool) error {
+	if email.MessageID == "" {
+		return nil
+	}
+	return b.db.TrainModel(email.MessageID, Tokenize(email), transactional)
+}
+
+// Learn trains the model on filtered marketing emails and user corrections it
+// hasn't seen yet and returns how many emails were added. Kept mail isn't
+// learned from, since its label is only the classifier's own guess, so
+// corrections are the only transactional examples.
+func (b *Bayes) Learn() (int, error) {
+	var trained int
+
+	details, err := b.db.GetUntrainedMarketingEmails(learnBatch)
+	if err != nil {
+		return trained, fmt.Errorf("failed to load stored emails: %w", err)
+	}
+	for i := range details {
+		if err := b.Train(emailFromDetail(&details[i]), false); err != nil {
+			return trained, fmt.Errorf("failed to train on %s: %w", details[i].MessageID, err)
+		}
+		trained++
+	}
+
+	// Corrections go last so they override the label of the stored email
+	corrections, err := b.db.GetUntrainedCorrections()
+	if err != nil {
+		return trained, fmt.Errorf("failed to load corrections: %w", err)
+	}
+	for _, c := range corrections {
+		email := &imap.FetchedEmail{
+			MessageID: c.MessageID,
+			From:      c.Sender,
+			Subject:   c.Subject,
+		}
+		if c.EmailDetailID != nil {
+			detail, err := b.db.GetEmailDetail(*c.EmailDetailID)
+			if err != nil {
+				log.Printf("Error loading email for correction %d, training on subject only: %v", c.ID, err)
+			} else if detail != nil {
+				email = emailFromDetail(detail)
+			}
+		}
+		if err := b.Train(email, c.IsTransactional); err != nil {
+			return trained, fmt.Errorf("failed to train on correction %d: %w", c.ID, err)
+		}
+		trained++
+	}
+
+	return trained, nil
+}
+
+// Predict returns the probability that the email is transactional. ok is
+// false while the model hasn't seen enough emails of both labels.
+func (b *Bayes) Predict(email *imap.FetchedEmail) (probability float64, ok bool, err error) {
+	totals, err := b.db.GetModelTotals()
+	if err != nil {
+		return 0, false, err
+	}
+	if totals.Transactional < MinTrainedPerLabel || totals.Marketing < MinTrainedPerLabel {
+		return 0, false, nil
+	}
+
+	tokens := Tokenize(email)
+	counts, err := b.db.GetTokenCounts(tokens)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Per-token probabilities are computed from label frequencies rather than
+	// raw counts, so there being far more marketing than transactional
+	// examples doesn't skew the result. Rarely seen tokens are pulled
+	// towards 0.5.
+	var probs []float64
+	for _, token := range tokens {
+		c, ok := counts[token]
+		if !ok {
+			continue
+		}
+		n := float64(c.Transactional + c.Marketing)
+		if n == 0 {
+			continue
+		}
+		t := float64(c.Transactional) / float64(totals.Transactional)
+		m := float64(c.Marketing) / float64(totals.Marketing)
+		p := t / (t + m)
+		p = (0.5 + n*p) / (1 + n)
+		probs = append(probs, math.Min(math.Max(p, 0.01), 0.99))
+	}
+	if len(probs) == 0 {
+		return 0, false, nil
+	}
+
+	// Stable so that ties are broken by token order and the result repeats
+	sort.SliceStable(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > interestingTokens {
+		probs = probs[:interestingTokens]
+	}
+
+	var logOdds float64
+	for _, p := range probs {
+		logOdds += math.Log(p / (1 - p))
+	}
+	return 1 / (1 + math.Exp(-logOdds)), true, nil
+}
+
+// Tokenize turns an email into the set of features the model learns from:
+// the sender's domain, header names, subject words and body words
+func Tokenize(email *imap.FetchedEmail) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	if email.From != "" {
+		add("from:" + rules.BaseDomain(rules.Domain(strings.ToLower(email.From))))
+	}
+	for key := range parseHeaders(email.Headers) {
+		add("header:" + key)
+	}
+	for _, word := range words(email.Subject, 0) {
+		add("subject:" + word)
+	}
+
+	body := email.BodyText
+	if body == "" {
+		body = stripTags(email.BodyHTML)
+	}
+	for _, word := range words(body, maxBodyTokens) {
+		add(word)
+	}
+
+	sort.Strings(tokens)
+	return tokens
+}
+
+// words splits text into lowercase words of 3 to 24 letters, skipping
+// anything with digits since order numbers and prices never repeat. limit
+// caps the number of words returned; 0 means no limit.
+func words(text string, limit int) []string {
+	var result []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	}) {
+		word = strings.Trim(word, "'")
+		n := len([]rune(word))
+		if n < 3 || n > 24 || strings.ContainsFunc(word, unicode.IsDigit) {
+			continue
+		}
+		result = append(result, word)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+func emailFromDetail(d *db.EmailDetail) *imap.FetchedEmail {
+	return &imap.FetchedEmail{
+		MessageID:      d.MessageID,
+		From:           d.Sender,
+		FromName:       d.SenderName,
+		To:             d.Recipients,
+		Subject:        d.Subject,
+		Date:           d.Date,
+		Headers:        d.Headers,
+		BodyText:       d.BodyText,
+		BodyHTML:       d.BodyHTML,
+		HasAttachments: d.HasAttachments,
+	}
+}
+
+// learning adds a learned model's opinion to another classifier's signals
+type learning struct {
+	rules Classifier
+	model *Bayes
+}
+
+// WithModel combines a classifier with a learned model. The model's
+// confidence becomes one more signal, worth up to ±4 when it is certain.
+func WithModel(rules Classifier, model *Bayes) Classifier {
+	return learning{rules: rules, model: model}
+}
+
+func (l learning) Classify(email *imap.FetchedEmail) Classification {
+	result := l.rules.Classify(email)
+
+	p, ok, err := l.model.Predict(email)
+	if err != nil {
+		log.Printf("Error consulting learned model: %v", err)
+	}
+	if !ok {
+		return result
+	}
+
+	signals := result.Signals
+	if weight := int(math.Round((p - 0.5) * 2 * weightModel)); weight != 0 {
+		signals = append(signals[:len(signals):len(signals)], Signal{
+			Name:   fmt.Sprintf("learned model (%.0f%% transactional)", p*100),
+			Weight: weight,
+		})
+	}
+	match := result.Match
+	result = verdict(signals)
+	result.Match = match
+	result.ModelScore = &p
+	return result
+}
@@ -0,0 +1,126 @@
+package classifier
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"postal-inspection-service/internal/db"
+	"postal-inspection-service/internal/imap"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		email imap.FetchedEmail
+		want  []string
+	}{
+		{
+			name: "all parts",
+			email: imap.FetchedEmail{
+				From:     "Orders@Mail.Shop.example.com",
+				Headers:  "List-Unsubscribe: <https://shop.example.com/u>\nPrecedence: bulk",
+				Subject:  "Your Order",
+				BodyText: "Thanks for your order",
+			},
+			want: []string{"for", "from:example.com", "header:list-unsubscribe", "header:precedence", "order", "subject:order", "subject:your", "thanks", "your"},
+		},
+		{
+			name:  "numbers and short words dropped",
+			email: imap.FetchedEmail{Subject: "Order 4021 is on its way", BodyText: "Total: $84.12, order A1B2"},
+			want:  []string{"order", "subject:its", "subject:order", "subject:way", "total"},
+		},
+		{
+			name:  "html body",
+			email: imap.FetchedEmail{BodyHTML: "<p>Shop <b>now</b></p>"},
+			want:  []string{"now", "shop"},
+		},
+		{
+			name:  "apostrophes kept inside words",
+			email: imap.FetchedEmail{Subject: "Don't 'miss' it"},
+			want:  []string{"subject:don't", "subject:miss"},
+		},
+		{
+			name:  "repeated words once",
+			email: imap.FetchedEmail{BodyText: "sale sale SALE"},
+			want:  []string{"sale"},
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Tokenize(&tt.email)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Tokenize = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredict(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New: %v", err)
+	}
+	defer database.Close()
+	model := NewBayes(database)
+
+	receipt := &imap.FetchedEmail{Subject: "Your receipt", BodyText: "Payment received, thanks for your purchase"}
+	promo := &imap.FetchedEmail{Subject: "Huge sale", BodyText: "Shop now and save on everything"}
+
+	trained := 0
+	train := func(n int, transactional bool, email *imap.FetchedEmail) {
+		for range n {
+			trained++
+			e := *email
+			e.MessageID = fmt.Sprintf("<%d@example.com>", trained)
+			if err := model.Train(&e, transactional); err != nil {
+				t.Fatalf("Train: %v", err)
+			}
+		}
+	}
+
+	// Plenty of marketing but too few corrections keeps the model off
+	train(20, false, promo)
+	train(MinTrainedPerLabel-1, true, receipt)
+	if _, ok, err := model.Predict(receipt); err != nil || ok {
+		t.Fatalf("Predict with %d transactional examples = ok %v, err %v; want not ok", MinTrainedPerLabel-1, ok, err)
+	}
+
+	train(1, true, &imap.FetchedEmail{Subject: "Your receipt", BodyText: "Payment received"})
+	p, ok, err := model.Predict(receipt)
+	if err != nil || !ok {
+		t.Fatalf("Predict = ok %v, err %v; want ok", ok, err)
+	}
+	if p <= 0.9 {
+		t.Errorf("Predict(receipt) = %.2f, want above 0.9", p)
+	}
+
+	p, ok, err = model.Predict(promo)
+	if err != nil || !ok {
+		t.Fatalf("Predict = ok %v, err %v; want ok", ok, err)
+	}
+	if p >= 0.1 {
+		t.Errorf("Predict(promo) = %.2f, want below 0.1", p)
+	}
+
+	// Emails without a Message-ID aren't stored
+	if err := model.Train(&imap.FetchedEmail{Subject: "Anonymous"}, true); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	if _, ok, _ := model.Predict(&imap.FetchedEmail{Subject: "Anonymous"}); ok {
+		t.Error("Predict with only unseen words is ok, want not ok")
+	}
+
+	// The same prediction every time
+	first, _, _ := model.Predict(receipt)
+	for range 5 {
+		if again, _, _ := model.Predict(receipt); again != first {
+			t.Fatalf("Predict = %v then %v, want the same", first, again)
+		}
+	}
+}
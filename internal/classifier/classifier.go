@@ -1,198 +1,306 @@
 package classifier
 
 import (
+	"fmt"
 	"strings"
+
+	"postal-inspection-service/internal/rules"
 )
 
-// IsTransactional checks if an email subject indicates a transactional email
-// (order confirmations, shipping updates, receipts, etc.) vs marketing
-func IsTransactional(subject string) bool {
-	lower := strings.ToLower(subject)
-
-	// Transactional indicators - things you want to receive
-	transactionalKeywords := []string{
-		// Order related
-		"order confirm",
-		"your order",
-		"order #",
-		"order number",
-		"order placed",
-		"order received",
-		"order status",
-		"order update",
-
-		// Shipping related
-		"shipped",
-		"shipping confirm",
-		"shipping update",
-		"delivery confirm",
-		"delivery update",
-		"out for delivery",
-		"delivered",
-		"tracking",
-		"in transit",
-		"package",
-		"shipment",
-
-		// Receipt/Invoice related
-		"receipt",
-		"invoice",
-		"payment confirm",
-		"payment received",
-		"transaction",
-		"purchase confirm",
-
-		// Account related (important notifications)
-		"password reset",
-		"verify your",
-		"verification",
-		"security alert",
-		"login attempt",
-		"account confirm",
-		"subscription confirm",
-
-		// Booking/Reservation related
-		"booking confirm",
-		"reservation confirm",
-		"itinerary",
-		"appointment",
-		"ticket",
-
-		// Refund/Return related
-		"refund",
-		"return confirm",
-		"return label",
-		"exchange",
-	}
+// defaultReason is given when nothing identifies the email either way
+const defaultReason = "Unknown/Default to marketing"
 
-	for _, keyword := range transactionalKeywords {
-		if strings.Contains(lower, keyword) {
-			return true
-		}
+// Category is what a keyword rule says an email is
+type Category string
+
+const (
+	CategoryTransactional Category = "transactional"
+	CategoryMarketing     Category = "marketing"
+)
+
+// KeywordRule matches a phrase in the subject line
+type KeywordRule struct {
+	Keyword  string   `json:"keyword"`
+	Category Category `json:"category"`
+	Reason   string   `json:"reason"`
+}
+
+// SenderOverride holds rules that are checked before the global list for
+// mail from matching senders, e.g. to treat "deal" as transactional for one shop
+type SenderOverride struct {
+	Sender rules.Rule
+	Rules  []KeywordRule
+}
+
+// RuleMatch is the rule that decided a subject and its position in the
+// rule list; earlier rules win
+type RuleMatch struct {
+	Rule     KeywordRule
+	Position int      // 1-based
+	Sender   string   // Override the rule came from, empty for the global list
+	Language Language // Keyword pack the rule came from, empty for the global list
+}
+
+func (m RuleMatch) String() string {
+	switch {
+	case m.Sender != "":
+		return fmt.Sprintf("%s rule #%d %q (%s)", m.Sender, m.Position, m.Rule.Keyword, m.Rule.Category)
+	case m.Language != LanguageUnknown:
+		return fmt.Sprintf("%s rule #%d %q (%s)", m.Language, m.Position, m.Rule.Keyword, m.Rule.Category)
 	}
+	return fmt.Sprintf("rule #%d %q (%s)", m.Position, m.Rule.Keyword, m.Rule.Category)
+}
+
+// DefaultRules is the built-in rule list, in priority order. Transactional
+// rules come first so that an order confirmation mentioning a sale is still
+// delivered.
+var DefaultRules = []KeywordRule{
+	// Order related
+	{"order confirm", CategoryTransactional, "Order confirmation"},
+	{"your order", CategoryTransactional, "Order notification"},
+	{"order #", CategoryTransactional, "Order notification"},
+	{"order number", CategoryTransactional, "Order notification"},
+	{"order placed", CategoryTransactional, "Order confirmation"},
+	{"order received", CategoryTransactional, "Order confirmation"},
+	{"order status", CategoryTransactional, "Order notification"},
+	{"order update", CategoryTransactional, "Order notification"},
+
+	// Shipping related
+	{"shipped", CategoryTransactional, "Shipping notification"},
+	{"shipping confirm", CategoryTransactional, "Shipping notification"},
+	{"shipping update", CategoryTransactional, "Shipping notification"},
+	{"delivery confirm", CategoryTransactional, "Delivery update"},
+	{"delivery update", CategoryTransactional, "Delivery update"},
+	{"out for delivery", CategoryTransactional, "Delivery update"},
+	{"delivered", CategoryTransactional, "Delivery update"},
+	{"tracking", CategoryTransactional, "Tracking update"},
+	{"in transit", CategoryTransactional, "Tracking update"},
+	{"package", CategoryTransactional, "Shipping notification"},
+	{"shipment", CategoryTransactional, "Shipping notification"},
+
+	// Receipt/Invoice related
+	{"receipt", CategoryTransactional, "Receipt"},
+	{"invoice", CategoryTransactional, "Invoice"},
+	{"payment confirm", CategoryTransactional, "Payment notification"},
+	{"payment received", CategoryTransactional, "Payment notification"},
+	{"transaction", CategoryTransactional, "Payment notification"},
+	{"purchase confirm", CategoryTransactional, "Order confirmation"},
+
+	// Account related (important notifications)
+	{"password reset", CategoryTransactional, "Security/Account"},
+	{"verify your", CategoryTransactional, "Account verification"},
+	{"verification", CategoryTransactional, "Account verification"},
+	{"security alert", CategoryTransactional, "Security/Account"},
+	{"login attempt", CategoryTransactional, "Security/Account"},
+	{"account confirm", CategoryTransactional, "Account verification"},
+	{"subscription confirm", CategoryTransactional, "Subscription confirmation"},
+
+	// Booking/Reservation related
+	{"booking confirm", CategoryTransactional, "Booking confirmation"},
+	{"reservation", CategoryTransactional, "Reservation"},
+	{"itinerary", CategoryTransactional, "Travel itinerary"},
+	{"appointment", CategoryTransactional, "Appointment"},
+	{"ticket", CategoryTransactional, "Ticket"},
+
+	// Refund/Return related
+	{"refund", CategoryTransactional, "Refund notification"},
+	{"return confirm", CategoryTransactional, "Return notification"},
+	{"return label", CategoryTransactional, "Return notification"},
+	{"exchange", CategoryTransactional, "Return notification"},
+
+	// Sales/Promotions
+	{"% off", CategoryMarketing, "Discount promotion"},
+	{"flash sale", CategoryMarketing, "Sale promotion"},
+	{"sale", CategoryMarketing, "Sale promotion"},
+	{"deal", CategoryMarketing, "Deal promotion"},
+	{"discount", CategoryMarketing, "Discount promotion"},
+	{"save $", CategoryMarketing, "Discount promotion"},
+	{"save up to", CategoryMarketing, "Discount promotion"},
+	{"limited time", CategoryMarketing, "Marketing urgency"},
+	{"clearance", CategoryMarketing, "Sale promotion"},
+	{"black friday", CategoryMarketing, "Seasonal promotion"},
+	{"cyber monday", CategoryMarketing, "Seasonal promotion"},
+	{"holiday", CategoryMarketing, "Seasonal promotion"},
+	{"special offer", CategoryMarketing, "Special offer"},
+	{"exclusive offer", CategoryMarketing, "Special offer"},
+	{"promo", CategoryMarketing, "Discount promotion"},
+	{"coupon", CategoryMarketing, "Discount promotion"},
+
+	// Newsletter/Marketing
+	{"newsletter", CategoryMarketing, "Newsletter"},
+	{"weekly", CategoryMarketing, "Newsletter"},
+	{"monthly", CategoryMarketing, "Newsletter"},
+	{"digest", CategoryMarketing, "Newsletter"},
+	{"roundup", CategoryMarketing, "Newsletter"},
+	{"what's new", CategoryMarketing, "Product marketing"},
+	{"new arrivals", CategoryMarketing, "Product marketing"},
+	{"just dropped", CategoryMarketing, "Product marketing"},
+	{"trending", CategoryMarketing, "Product marketing"},
+	{"top picks", CategoryMarketing, "Recommendation marketing"},
+	{"recommended", CategoryMarketing, "Recommendation marketing"},
+	{"you might like", CategoryMarketing, "Recommendation marketing"},
+	{"based on your", CategoryMarketing, "Recommendation marketing"},
+
+	// Engagement bait
+	{"don't miss", CategoryMarketing, "Marketing urgency"},
+	{"last chance", CategoryMarketing, "Marketing urgency"},
+	{"ending soon", CategoryMarketing, "Marketing urgency"},
+	{"act now", CategoryMarketing, "Marketing urgency"},
+	{"hurry", CategoryMarketing, "Marketing urgency"},
+	{"only hours left", CategoryMarketing, "Marketing urgency"},
+	{"reminder:", CategoryMarketing, "Marketing urgency"},
+	{"we miss you", CategoryMarketing, "Re-engagement"},
+	{"come back", CategoryMarketing, "Re-engagement"},
+
+	// Generic marketing
+	{"shop now", CategoryMarketing, "Marketing CTA"},
+	{"buy now", CategoryMarketing, "Marketing CTA"},
+	{"free shipping", CategoryMarketing, "Marketing CTA"},
+	{"new collection", CategoryMarketing, "Product marketing"},
+	{"introducing", CategoryMarketing, "Product marketing"},
+	{"check out", CategoryMarketing, "Marketing CTA"},
+	{"discover", CategoryMarketing, "Marketing CTA"},
+	{"explore", CategoryMarketing, "Marketing CTA"},
+}
+
+// Engine checks subjects against an ordered rule list; the first matching
+// rule decides, so the same subject always gets the same verdict
+type Engine struct {
+	rules     []KeywordRule
+	locales   map[Language][]KeywordRule
+	overrides []SenderOverride
+	senders   *rules.Matcher
+}
+
+// EngineSource supplies the current rule engine, which may change over time
+type EngineSource interface {
+	Engine() *Engine
+}
+
+// NewEngine returns an engine for rules in priority order, with the built-in
+// keyword packs for other languages. For senders matching an override, its
+// rules are checked first. An exact address override beats domain
+// overrides; otherwise the first matching one applies.
+func NewEngine(keywordRules []KeywordRule, overrides ...SenderOverride) *Engine {
+	return NewLocalizedEngine(keywordRules, DefaultLocaleRules, overrides...)
+}
 
-	// Marketing indicators - things you don't want
-	marketingKeywords := []string{
-		// Sales/Promotions
-		"% off",
-		"sale",
-		"deal",
-		"discount",
-		"save $",
-		"save up to",
-		"limited time",
-		"flash sale",
-		"clearance",
-		"black friday",
-		"cyber monday",
-		"holiday",
-		"special offer",
-		"exclusive offer",
-		"promo",
-		"coupon",
-
-		// Newsletter/Marketing
-		"newsletter",
-		"weekly",
-		"monthly",
-		"digest",
-		"roundup",
-		"what's new",
-		"new arrivals",
-		"just dropped",
-		"trending",
-		"top picks",
-		"recommended for you",
-		"you might like",
-		"based on your",
-
-		// Engagement bait
-		"don't miss",
-		"last chance",
-		"ending soon",
-		"act now",
-		"hurry",
-		"only hours left",
-		"reminder:",
-		"we miss you",
-		"come back",
-
-		// Generic marketing
-		"shop now",
-		"buy now",
-		"free shipping",
-		"new collection",
-		"introducing",
-		"check out",
-		"discover",
-		"explore",
+// NewLocalizedEngine is like NewEngine with the given keyword packs in place
+// of DefaultLocaleRules
+func NewLocalizedEngine(keywordRules []KeywordRule, locales map[Language][]KeywordRule, overrides ...SenderOverride) *Engine {
+	e := &Engine{
+		rules:   foldKeywords(keywordRules),
+		locales: make(map[Language][]KeywordRule, len(locales)),
+	}
+	for lang, pack := range locales {
+		e.locales[lang] = foldKeywords(pack)
 	}
+	senderRules := make([]rules.Rule, len(overrides))
+	for i, o := range overrides {
+		e.overrides = append(e.overrides, SenderOverride{Sender: o.Sender, Rules: foldKeywords(o.Rules)})
+		senderRules[i] = o.Sender
+	}
+	e.senders = rules.NewMatcher(senderRules)
+	return e
+}
 
-	for _, keyword := range marketingKeywords {
-		if strings.Contains(lower, keyword) {
-			return false // Explicitly marketing
-		}
+func foldKeywords(keywordRules []KeywordRule) []KeywordRule {
+	folded := make([]KeywordRule, len(keywordRules))
+	for i, r := range keywordRules {
+		r.Keyword = Fold(r.Keyword)
+		folded[i] = r
 	}
+	return folded
+}
 
-	// Default: if we can't classify, assume marketing (safer to delete)
-	return false
+var defaultEngine = NewEngine(DefaultRules)
+
+// Engine returns e itself, so a fixed engine can be used as an EngineSource
+func (e *Engine) Engine() *Engine {
+	return e
 }
 
-// ClassifyEmail returns a classification result with reasoning
-type Classification struct {
-	IsTransactional bool
-	Reason          string
+// Match returns the first rule whose keyword appears in the subject,
+// detecting the language from the subject alone
+func (e *Engine) Match(sender, subject string) (RuleMatch, bool) {
+	return e.MatchLanguage(DetectLanguage(subject), sender, subject)
 }
 
-func Classify(subject string) Classification {
-	lower := strings.ToLower(subject)
-
-	// Check transactional first
-	transactionalPatterns := map[string]string{
-		"order confirm":        "Order confirmation",
-		"your order":           "Order notification",
-		"shipped":              "Shipping notification",
-		"delivery":             "Delivery update",
-		"tracking":             "Tracking update",
-		"receipt":              "Receipt",
-		"invoice":              "Invoice",
-		"payment":              "Payment notification",
-		"password reset":       "Security/Account",
-		"verification":         "Account verification",
-		"booking confirm":      "Booking confirmation",
-		"reservation":          "Reservation",
-		"refund":               "Refund notification",
-		"return":               "Return notification",
-		"appointment":          "Appointment",
-		"itinerary":            "Travel itinerary",
-		"subscription confirm": "Subscription confirmation",
+// MatchLanguage returns the first rule whose keyword appears in the subject
+// of a message in lang. The sender's override rules are checked first, then
+// lang's keyword pack and the global list. When the language is unknown,
+// every pack is tried after the global list.
+func (e *Engine) MatchLanguage(lang Language, sender, subject string) (RuleMatch, bool) {
+	folded := Fold(subject)
+	if i := e.senders.Match(sender); i >= 0 {
+		o := e.overrides[i]
+		if m, ok := firstMatch(o.Rules, folded); ok {
+			m.Sender = o.Sender.String()
+			return m, true
+		}
 	}
-
-	for pattern, reason := range transactionalPatterns {
-		if strings.Contains(lower, pattern) {
-			return Classification{IsTransactional: true, Reason: reason}
+	if m, ok := firstMatch(e.locales[lang], folded); ok {
+		m.Language = lang
+		return m, true
+	}
+	if m, ok := firstMatch(e.rules, folded); ok {
+		return m, true
+	}
+	if lang == LanguageUnknown {
+		for _, l := range languages {
+			if m, ok := firstMatch(e.locales[l], folded); ok {
+				m.Language = l
+				return m, true
+			}
 		}
 	}
+	return RuleMatch{}, false
+}
 
-	// Check marketing
-	marketingPatterns := map[string]string{
-		"% off":        "Discount promotion",
-		"sale":         "Sale promotion",
-		"deal":         "Deal promotion",
-		"newsletter":   "Newsletter",
-		"don't miss":   "Marketing urgency",
-		"last chance":  "Marketing urgency",
-		"shop now":     "Marketing CTA",
-		"new arrivals": "Product marketing",
-		"we miss you":  "Re-engagement",
-		"recommended":  "Recommendation marketing",
+func firstMatch(keywordRules []KeywordRule, folded string) (RuleMatch, bool) {
+	for i, r := range keywordRules {
+		if strings.Contains(folded, r.Keyword) {
+			return RuleMatch{Rule: r, Position: i + 1}, true
+		}
 	}
+	return RuleMatch{}, false
+}
 
-	for pattern, reason := range marketingPatterns {
-		if strings.Contains(lower, pattern) {
-			return Classification{IsTransactional: false, Reason: reason}
-		}
+// Classify classifies a subject line by the first matching rule. Subjects no
+// rule matches are assumed to be marketing.
+func (e *Engine) Classify(sender, subject string) Classification {
+	m, ok := e.Match(sender, subject)
+	if !ok {
+		return Classification{IsTransactional: false, Reason: defaultReason}
+	}
+	return Classification{
+		IsTransactional: m.Rule.Category == CategoryTransactional,
+		Reason:          m.Rule.Reason,
+		Match:           &m,
 	}
+}
+
+// Classification is a verdict with reasoning. Score and Signals are only
+// filled in by classifiers that look at more than the subject.
+type Classification struct {
+	IsTransactional bool
+	Reason          string
+	// Match is the subject rule that applied, nil if none did
+	Match   *RuleMatch
+	Score   int
+	Signals []Signal
+	// ModelScore is the learned model's probability that the email is
+	// transactional, nil when no model was consulted
+	ModelScore *float64
+}
+
+// IsTransactional checks if an email subject indicates a transactional email
+// (order confirmations, shipping updates, receipts, etc.) vs marketing
+func IsTransactional(subject string) bool {
+	return defaultEngine.Classify("", subject).IsTransactional
+}
 
-	return Classification{IsTransactional: false, Reason: "Unknown/Default to marketing"}
+// Classify classifies an email by its subject line alone using DefaultRules
+func Classify(subject string) Classification {
+	return defaultEngine.Classify("", subject)
 }
@@ -0,0 +1,167 @@
+package classifier
+
+import (
+	"testing"
+
+	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/rules"
+)
+
+func TestEngineClassify(t *testing.T) {
+	engine := NewEngine(DefaultRules, SenderOverride{
+		Sender: rules.Rule{Pattern: "shop.example.com", Type: rules.MatchDomain},
+		Rules:  []KeywordRule{{"deal", CategoryTransactional, "Deal you ordered"}},
+	})
+
+	tests := []struct {
+		name            string
+		sender, subject string
+		transactional   bool
+		reason          string
+		noMatch         bool
+	}{
+		{"order", "", "Your order #4021 has shipped", true, "Order notification", false},
+		{"case and accents", "", "YOUR ÖRDER has shipped", true, "Order notification", false},
+		{"transactional rule first", "", "Order confirmation - plus 20% off your next visit", true, "Order confirmation", false},
+		{"earliest marketing rule", "", "Flash sale: 50% off everything", false, "Discount promotion", false},
+		{"nothing matches", "", "Hello there", false, defaultReason, true},
+		{"empty subject", "", "", false, defaultReason, true},
+		{"sender override", "orders@shop.example.com", "Your deal is confirmed", true, "Deal you ordered", false},
+		{"other sender", "news@other.example.com", "Your deal is confirmed", false, "Deal promotion", false},
+		{"french pack", "", "Votre commande a été expédiée", true, "Order notification", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := engine.Classify(tt.sender, tt.subject)
+			if c.IsTransactional != tt.transactional {
+				t.Errorf("IsTransactional = %v, want %v", c.IsTransactional, tt.transactional)
+			}
+			if c.Reason != tt.reason {
+				t.Errorf("Reason = %q, want %q", c.Reason, tt.reason)
+			}
+			if (c.Match == nil) != tt.noMatch {
+				t.Errorf("Match = %v, want a match: %v", c.Match, !tt.noMatch)
+			}
+		})
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	tests := []struct {
+		name          string
+		signals       []Signal
+		score         int
+		transactional bool
+		reason        string
+	}{
+		{"no signals", nil, 0, false, defaultReason},
+		{"one point", []Signal{{Name: "amount", Weight: 1}}, 1, true, "amount"},
+		{"one point against", []Signal{{Name: "link", Weight: -1}}, -1, false, "link"},
+		// A tie is not enough to keep an email
+		{"tie", []Signal{{Name: "subject", Weight: 3, Reason: "Receipt"}, {Name: "unsubscribe", Weight: -2}, {Name: "link", Weight: -1}}, 0, false, "unsubscribe"},
+		{"strongest agreeing signal", []Signal{{Name: "amount", Weight: 1}, {Name: "subject", Weight: 3, Reason: "Receipt"}, {Name: "unsubscribe", Weight: -2}}, 2, true, "Receipt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := verdict(tt.signals)
+			if c.Score != tt.score {
+				t.Errorf("Score = %d, want %d", c.Score, tt.score)
+			}
+			if c.IsTransactional != tt.transactional {
+				t.Errorf("IsTransactional = %v, want %v", c.IsTransactional, tt.transactional)
+			}
+			if c.Reason != tt.reason {
+				t.Errorf("Reason = %q, want %q", c.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestHeuristicClassify(t *testing.T) {
+	tests := []struct {
+		name          string
+		email         imap.FetchedEmail
+		score         int
+		transactional bool
+	}{
+		{
+			name: "shipping notice",
+			email: imap.FetchedEmail{
+				Subject:  "Your order has shipped",
+				BodyText: "Order number: 112-5849\nTracking number: 1Z999AA10123456784",
+			},
+			score:         7,
+			transactional: true,
+		},
+		{
+			name: "newsletter",
+			email: imap.FetchedEmail{
+				Subject:  "Our weekly newsletter",
+				Headers:  "List-Unsubscribe: <https://news.example.com/u/1>\nPrecedence: bulk",
+				BodyHTML: `<p><a href="https://news.example.com/v/1">View this email in your browser</a></p>`,
+			},
+			score:         -8,
+			transactional: false,
+		},
+		{
+			name: "receipt sent as a campaign",
+			email: imap.FetchedEmail{
+				Subject: "Your receipt",
+				Headers: "List-Unsubscribe: <https://shop.example.com/u/1>",
+			},
+			score:         1,
+			transactional: true,
+		},
+		{
+			name: "score of zero",
+			email: imap.FetchedEmail{
+				Subject:  "Your receipt",
+				Headers:  "List-Unsubscribe: <https://shop.example.com/u/1>",
+				BodyText: "View this email in your browser",
+			},
+			score:         0,
+			transactional: false,
+		},
+		{
+			name: "no signals",
+			email: imap.FetchedEmail{
+				Subject:  "Hello",
+				BodyText: "Just checking in.",
+			},
+			score:         0,
+			transactional: false,
+		},
+		{
+			name: "automated notice",
+			email: imap.FetchedEmail{
+				Subject: "Your statement is ready",
+				Headers: "Auto-Submitted: auto-generated",
+			},
+			score:         2,
+			transactional: true,
+		},
+		{
+			name: "german shipping notice",
+			email: imap.FetchedEmail{
+				Subject:  "Versandbestätigung",
+				BodyText: "Ihre Bestellung wurde versandt und ist auf dem Weg zu Ihnen.",
+			},
+			score:         3,
+			transactional: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Heuristic{}.Classify(&tt.email)
+			if c.Score != tt.score {
+				t.Errorf("Score = %d, want %d (%s)", c.Score, tt.score, c.Explanation())
+			}
+			if c.IsTransactional != tt.transactional {
+				t.Errorf("IsTransactional = %v, want %v (%s)", c.IsTransactional, tt.transactional, c.Explanation())
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package classifier
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Language is the language of a message, as an ISO 639-1 code
+type Language string
+
+const (
+	// LanguageUnknown is returned when a message gives too little to go on
+	LanguageUnknown Language = ""
+	LanguageEnglish Language = "en"
+	LanguageFrench  Language = "fr"
+	LanguageGerman  Language = "de"
+	LanguageSpanish Language = "es"
+)
+
+// languages is the detection order; ties between languages are unknown
+var languages = []Language{LanguageEnglish, LanguageFrench, LanguageGerman, LanguageSpanish}
+
+// stopwords are short words common in each language's email, already folded
+var stopwords = map[Language][]string{
+	LanguageEnglish: {"the", "and", "your", "you", "for", "with", "our", "this", "has", "have", "been", "from", "is", "are", "to", "of", "was", "will", "now", "we"},
+	LanguageFrench:  {"le", "les", "des", "du", "et", "votre", "vos", "pour", "avec", "nous", "est", "une", "sur", "dans", "ete", "au", "aux", "vous", "notre", "ce", "cette"},
+	LanguageGerman:  {"der", "die", "das", "und", "ihre", "ihr", "ist", "wurde", "sie", "mit", "fur", "den", "dem", "ein", "eine", "nicht", "auf", "wir", "zu", "von", "auch", "bei", "noch"},
+	LanguageSpanish: {"el", "los", "las", "del", "y", "su", "tu", "para", "con", "por", "ha", "sido", "que", "una", "nuestro", "sus", "tus", "ya", "esta", "le"},
+}
+
+// letterHints are letters that only turn up in one of the languages
+var letterHints = map[rune]Language{
+	'ß': LanguageGerman, 'ä': LanguageGerman, 'ö': LanguageGerman, 'ü': LanguageGerman,
+	'ñ': LanguageSpanish, '¿': LanguageSpanish, '¡': LanguageSpanish,
+	'ç': LanguageFrench, 'è': LanguageFrench, 'ê': LanguageFrench, 'à': LanguageFrench, 'œ': LanguageFrench,
+}
+
+// detectLimit bounds how much of a message is looked at
+const detectLimit = 2000
+
+var stopwordLanguages = func() map[string][]Language {
+	m := make(map[string][]Language)
+	for lang, words := range stopwords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// DetectLanguage guesses the language of text from its common words and
+// telltale letters. It returns LanguageUnknown when no language stands out,
+// which is typical for a short subject.
+func DetectLanguage(text string) Language {
+	if len(text) > detectLimit {
+		text = text[:detectLimit]
+	}
+
+	scores := make(map[Language]int)
+	for _, r := range strings.ToLower(text) {
+		if lang, ok := letterHints[r]; ok {
+			scores[lang]++
+		}
+	}
+	for _, word := range strings.FieldsFunc(Fold(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		for _, lang := range stopwordLanguages[word] {
+			scores[lang]++
+		}
+	}
+
+	best, bestScore, tied := LanguageUnknown, 0, false
+	for _, lang := range languages {
+		switch s := scores[lang]; {
+		case s > bestScore:
+			best, bestScore, tied = lang, s, false
+		case s == bestScore && s > 0:
+			tied = true
+		}
+	}
+	if tied {
+		return LanguageUnknown
+	}
+	return best
+}
+
+// foldSpecial are letters that don't decompose into a base letter and an
+// accent, and apostrophes that should compare equal
+var foldSpecial = map[rune]string{
+	'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ħ': "h",
+	'ı': "i", 'ł': "l", 'ŀ': "l",
+	'’': "'", '‘': "'", 'ʼ': "'",
+}
+
+// accents are the combining marks Latin and Greek letters decompose into.
+// Other nonspacing marks, such as the Japanese voicing marks, are part of the
+// letter and stay.
+var accents = &unicode.RangeTable{
+	R16: []unicode.Range16{{Lo: 0x0300, Hi: 0x036f, Stride: 1}},
+}
+
+// Fold case-folds text and strips accents, so "Versandbestätigung",
+// "VERSANDBESTATIGUNG" and "versandbestätigung" all compare equal. Curly
+// apostrophes become straight ones.
+func Fold(text string) string {
+	// Casers and the normalizing chain keep state, so each call gets its own
+	t := transform.Chain(cases.Fold(), norm.NFD, runes.Remove(runes.In(accents)), norm.NFC)
+	folded, _, err := transform.String(t, text)
+	if err != nil {
+		folded = strings.ToLower(text)
+	}
+
+	var b strings.Builder
+	b.Grow(len(folded))
+	for _, r := range folded {
+		if s, ok := foldSpecial[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,60 @@
+package classifier
+
+import "testing"
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Versandbestätigung", "versandbestatigung"},
+		{"VERSANDBESTATIGUNG", "versandbestatigung"},
+		{"Votre commande a été expédiée", "votre commande a ete expediee"},
+		{"Envío ¡GRATIS!", "envio ¡gratis!"},
+		{"Straße", "strasse"},
+		{"STRASSE", "strasse"},
+		{"ẞ", "ss"},
+		{"Œuvre", "oeuvre"},
+		{"Łódź", "lodz"},
+		{"Ærø", "aero"},
+		{"ΣΟΦΟΣ", "σοφοσ"},
+		// Accents sent as separate combining marks
+		{"Besta\u0308tigung", "bestatigung"},
+		{"Don’t ‘miss’", "don't 'miss'"},
+		{"order #123", "order #123"},
+		{"ご注文の確認", "ご注文の確認"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Fold(tt.in); got != tt.want {
+			t.Errorf("Fold(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Language
+	}{
+		{"english", "Your order has been shipped and will arrive with the courier", LanguageEnglish},
+		{"french", "Votre commande a été expédiée et sera livrée dans les prochains jours", LanguageFrench},
+		{"german", "Ihre Bestellung wurde versandt und ist auf dem Weg zu Ihnen", LanguageGerman},
+		{"spanish", "Su pedido ha sido enviado y llegará en los próximos días", LanguageSpanish},
+		{"german letters only", "Größenübersicht", LanguageGerman},
+		{"spanish letters only", "¿Mañana?", LanguageSpanish},
+		{"short subject", "Invoice 4021", LanguageUnknown},
+		{"empty", "", LanguageUnknown},
+		// "le" is a stopword in both French and Spanish
+		{"tie", "le", LanguageUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectLanguage(tt.text); got != tt.want {
+				t.Errorf("DetectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
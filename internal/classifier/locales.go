@@ -0,0 +1,206 @@
+package classifier
+
+// DefaultLocaleRules are the built-in keyword packs for mail that isn't in
+// English, each in priority order like DefaultRules. A pack is checked before
+// the English list for messages detected as its language, and after it for
+// messages whose language is unknown. Keywords are matched accent- and
+// case-insensitively.
+var DefaultLocaleRules = map[Language][]KeywordRule{
+	LanguageFrench: {
+		// Commandes
+		{"votre commande", CategoryTransactional, "Order notification"},
+		{"confirmation de commande", CategoryTransactional, "Order confirmation"},
+		{"commande n°", CategoryTransactional, "Order notification"},
+		{"numéro de commande", CategoryTransactional, "Order notification"},
+		{"commande confirmée", CategoryTransactional, "Order confirmation"},
+
+		// Expédition et livraison
+		{"expédié", CategoryTransactional, "Shipping notification"},
+		{"expédition", CategoryTransactional, "Shipping notification"},
+		{"avis de livraison", CategoryTransactional, "Delivery update"},
+		{"votre livraison", CategoryTransactional, "Delivery update"},
+		{"livraison prévue", CategoryTransactional, "Delivery update"},
+		{"en cours de livraison", CategoryTransactional, "Delivery update"},
+		{"a été livré", CategoryTransactional, "Delivery update"},
+		{"colis", CategoryTransactional, "Shipping notification"},
+		{"suivi de", CategoryTransactional, "Tracking update"},
+
+		// Factures et paiements
+		{"facture", CategoryTransactional, "Invoice"},
+		{"votre reçu", CategoryTransactional, "Receipt"},
+		{"confirmation de paiement", CategoryTransactional, "Payment notification"},
+		{"paiement reçu", CategoryTransactional, "Payment notification"},
+
+		// Compte
+		{"mot de passe", CategoryTransactional, "Security/Account"},
+		{"vérifiez votre", CategoryTransactional, "Account verification"},
+		{"code de vérification", CategoryTransactional, "Account verification"},
+		{"alerte de sécurité", CategoryTransactional, "Security/Account"},
+		{"tentative de connexion", CategoryTransactional, "Security/Account"},
+
+		// Réservations
+		{"réservation", CategoryTransactional, "Reservation"},
+		{"itinéraire", CategoryTransactional, "Travel itinerary"},
+		{"rendez-vous", CategoryTransactional, "Appointment"},
+		{"billet", CategoryTransactional, "Ticket"},
+		{"carte d'embarquement", CategoryTransactional, "Ticket"},
+
+		// Remboursements et retours
+		{"remboursement", CategoryTransactional, "Refund notification"},
+		{"étiquette de retour", CategoryTransactional, "Return notification"},
+		{"votre retour", CategoryTransactional, "Return notification"},
+
+		// Promotions
+		{"soldes", CategoryMarketing, "Sale promotion"},
+		{"vente flash", CategoryMarketing, "Sale promotion"},
+		{"% de réduction", CategoryMarketing, "Discount promotion"},
+		{"réduction", CategoryMarketing, "Discount promotion"},
+		{"code promo", CategoryMarketing, "Discount promotion"},
+		{"bon plan", CategoryMarketing, "Deal promotion"},
+		{"offre spéciale", CategoryMarketing, "Special offer"},
+		{"offre exclusive", CategoryMarketing, "Special offer"},
+		{"livraison gratuite", CategoryMarketing, "Marketing CTA"},
+		{"livraison offerte", CategoryMarketing, "Marketing CTA"},
+
+		// Lettres d'information et relances
+		{"lettre d'information", CategoryMarketing, "Newsletter"},
+		{"nouveautés", CategoryMarketing, "Product marketing"},
+		{"nouvelle collection", CategoryMarketing, "Product marketing"},
+		{"dernière chance", CategoryMarketing, "Marketing urgency"},
+		{"derniers jours", CategoryMarketing, "Marketing urgency"},
+		{"ne manquez pas", CategoryMarketing, "Marketing urgency"},
+		{"vous nous manquez", CategoryMarketing, "Re-engagement"},
+		{"découvrez", CategoryMarketing, "Marketing CTA"},
+		{"profitez", CategoryMarketing, "Marketing CTA"},
+	},
+
+	LanguageGerman: {
+		// Bestellungen
+		{"bestellbestätigung", CategoryTransactional, "Order confirmation"},
+		{"ihre bestellung", CategoryTransactional, "Order notification"},
+		{"deine bestellung", CategoryTransactional, "Order notification"},
+		{"bestellnummer", CategoryTransactional, "Order notification"},
+		{"auftragsbestätigung", CategoryTransactional, "Order confirmation"},
+
+		// Versand und Zustellung
+		{"versandbestätigung", CategoryTransactional, "Shipping notification"},
+		{"versendet", CategoryTransactional, "Shipping notification"},
+		{"verschickt", CategoryTransactional, "Shipping notification"},
+		{"sendungsverfolgung", CategoryTransactional, "Tracking update"},
+		{"ihre sendung", CategoryTransactional, "Shipping notification"},
+		{"deine sendung", CategoryTransactional, "Shipping notification"},
+		{"zugestellt", CategoryTransactional, "Delivery update"},
+		{"zustellung", CategoryTransactional, "Delivery update"},
+		{"ihre lieferung", CategoryTransactional, "Delivery update"},
+		{"paket", CategoryTransactional, "Shipping notification"},
+
+		// Rechnungen und Zahlungen
+		{"rechnung", CategoryTransactional, "Invoice"},
+		{"quittung", CategoryTransactional, "Receipt"},
+		{"zahlungsbestätigung", CategoryTransactional, "Payment notification"},
+		{"zahlung erhalten", CategoryTransactional, "Payment notification"},
+
+		// Konto
+		{"passwort", CategoryTransactional, "Security/Account"},
+		{"bestätigen sie ihre", CategoryTransactional, "Account verification"},
+		{"bestätige deine", CategoryTransactional, "Account verification"},
+		{"verifizierung", CategoryTransactional, "Account verification"},
+		{"sicherheitshinweis", CategoryTransactional, "Security/Account"},
+		{"anmeldeversuch", CategoryTransactional, "Security/Account"},
+
+		// Buchungen
+		{"buchungsbestätigung", CategoryTransactional, "Booking confirmation"},
+		{"reservierung", CategoryTransactional, "Reservation"},
+		{"reiseplan", CategoryTransactional, "Travel itinerary"},
+		{"ihr termin", CategoryTransactional, "Appointment"},
+		{"terminbestätigung", CategoryTransactional, "Appointment"},
+		{"bordkarte", CategoryTransactional, "Ticket"},
+
+		// Erstattungen und Rücksendungen
+		{"erstattung", CategoryTransactional, "Refund notification"},
+		{"rücksendung", CategoryTransactional, "Return notification"},
+		{"retourenschein", CategoryTransactional, "Return notification"},
+
+		// Angebote
+		{"% rabatt", CategoryMarketing, "Discount promotion"},
+		{"rabatt", CategoryMarketing, "Discount promotion"},
+		{"reduziert", CategoryMarketing, "Discount promotion"},
+		{"gutschein", CategoryMarketing, "Discount promotion"},
+		{"angebot", CategoryMarketing, "Special offer"},
+		{"schnäppchen", CategoryMarketing, "Deal promotion"},
+		{"kostenloser versand", CategoryMarketing, "Marketing CTA"},
+		{"versandkostenfrei", CategoryMarketing, "Marketing CTA"},
+
+		// Newsletter und Erinnerungen
+		{"neuheiten", CategoryMarketing, "Product marketing"},
+		{"neu eingetroffen", CategoryMarketing, "Product marketing"},
+		{"nur heute", CategoryMarketing, "Marketing urgency"},
+		{"letzte chance", CategoryMarketing, "Marketing urgency"},
+		{"endet bald", CategoryMarketing, "Marketing urgency"},
+		{"wir vermissen dich", CategoryMarketing, "Re-engagement"},
+		{"jetzt kaufen", CategoryMarketing, "Marketing CTA"},
+		{"jetzt shoppen", CategoryMarketing, "Marketing CTA"},
+		{"entdecken", CategoryMarketing, "Marketing CTA"},
+	},
+
+	LanguageSpanish: {
+		// Pedidos
+		{"tu pedido", CategoryTransactional, "Order notification"},
+		{"su pedido", CategoryTransactional, "Order notification"},
+		{"confirmación de pedido", CategoryTransactional, "Order confirmation"},
+		{"número de pedido", CategoryTransactional, "Order notification"},
+		{"pedido n", CategoryTransactional, "Order notification"},
+
+		// Envíos y entregas
+		{"ha sido enviado", CategoryTransactional, "Shipping notification"},
+		{"tu envío", CategoryTransactional, "Shipping notification"},
+		{"su envío", CategoryTransactional, "Shipping notification"},
+		{"en camino", CategoryTransactional, "Shipping notification"},
+		{"entregado", CategoryTransactional, "Delivery update"},
+		{"seguimiento", CategoryTransactional, "Tracking update"},
+		{"paquete", CategoryTransactional, "Shipping notification"},
+
+		// Facturas y pagos
+		{"factura", CategoryTransactional, "Invoice"},
+		{"recibo", CategoryTransactional, "Receipt"},
+		{"confirmación de pago", CategoryTransactional, "Payment notification"},
+		{"pago recibido", CategoryTransactional, "Payment notification"},
+
+		// Cuenta
+		{"contraseña", CategoryTransactional, "Security/Account"},
+		{"verifica tu", CategoryTransactional, "Account verification"},
+		{"código de verificación", CategoryTransactional, "Account verification"},
+		{"alerta de seguridad", CategoryTransactional, "Security/Account"},
+		{"intento de inicio de sesión", CategoryTransactional, "Security/Account"},
+
+		// Reservas
+		{"reserva", CategoryTransactional, "Reservation"},
+		{"itinerario", CategoryTransactional, "Travel itinerary"},
+		{"tu cita", CategoryTransactional, "Appointment"},
+		{"su cita", CategoryTransactional, "Appointment"},
+		{"billete", CategoryTransactional, "Ticket"},
+		{"tarjeta de embarque", CategoryTransactional, "Ticket"},
+
+		// Reembolsos y devoluciones
+		{"reembolso", CategoryTransactional, "Refund notification"},
+		{"devolución", CategoryTransactional, "Return notification"},
+
+		// Promociones
+		{"rebajas", CategoryMarketing, "Sale promotion"},
+		{"% de descuento", CategoryMarketing, "Discount promotion"},
+		{"descuento", CategoryMarketing, "Discount promotion"},
+		{"cupón", CategoryMarketing, "Discount promotion"},
+		{"oferta", CategoryMarketing, "Special offer"},
+		{"envío gratis", CategoryMarketing, "Marketing CTA"},
+
+		// Boletines y recordatorios
+		{"boletín", CategoryMarketing, "Newsletter"},
+		{"novedades", CategoryMarketing, "Product marketing"},
+		{"nueva colección", CategoryMarketing, "Product marketing"},
+		{"última oportunidad", CategoryMarketing, "Marketing urgency"},
+		{"solo hoy", CategoryMarketing, "Marketing urgency"},
+		{"te echamos de menos", CategoryMarketing, "Re-engagement"},
+		{"compra ya", CategoryMarketing, "Marketing CTA"},
+		{"descubre", CategoryMarketing, "Marketing CTA"},
+	},
+}
@@ -0,0 +1,191 @@
+package classifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"postal-inspection-service/internal/rules"
+)
+
+// ruleFileFormat is the JSON layout of a rules file:
+//
+//	{
+//	  "rules": [
+//	    {"keyword": "your order", "category": "transactional", "reason": "Order notification"},
+//	    {"keyword": "% off", "category": "marketing", "reason": "Discount promotion"}
+//	  ],
+//	  "senders": [
+//	    {"sender": "amazon.com", "rules": [
+//	      {"keyword": "deal", "category": "transactional", "reason": "Lightning deal you watched"}
+//	    ]}
+//	  ],
+//	  "locales": {
+//	    "fr": [
+//	      {"keyword": "votre commande", "category": "transactional", "reason": "Order notification"}
+//	    ]
+//	  }
+//	}
+//
+// Leaving out "rules" keeps the built-in list, so a file can hold just
+// per-sender overrides. Likewise each language in "locales" replaces that
+// built-in keyword pack and the others are kept; an empty list turns a pack
+// off.
+type ruleFileFormat struct {
+	Rules   *[]KeywordRule             `json:"rules"`
+	Locales map[Language][]KeywordRule `json:"locales"`
+	Senders []struct {
+		Sender string          `json:"sender"`
+		Match  rules.MatchType `json:"match"` // Defaults to address for addresses, subdomains otherwise
+		Rules  []KeywordRule   `json:"rules"`
+	} `json:"senders"`
+}
+
+// ParseRules builds an engine from the contents of a rules file
+func ParseRules(data []byte) (*Engine, error) {
+	var f ruleFileFormat
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	keywordRules := DefaultRules
+	if f.Rules != nil {
+		keywordRules = *f.Rules
+	}
+	if err := validateRules(keywordRules); err != nil {
+		return nil, err
+	}
+
+	locales := make(map[Language][]KeywordRule, len(DefaultLocaleRules))
+	for lang, pack := range DefaultLocaleRules {
+		locales[lang] = pack
+	}
+	for lang, pack := range f.Locales {
+		if _, ok := DefaultLocaleRules[lang]; !ok {
+			return nil, fmt.Errorf("locale %q: unsupported language, use one of fr, de, es", lang)
+		}
+		if err := validateRules(pack); err != nil {
+			return nil, fmt.Errorf("locale %q: %w", lang, err)
+		}
+		locales[lang] = pack
+	}
+
+	var overrides []SenderOverride
+	for _, s := range f.Senders {
+		matchType := s.Match
+		if matchType == "" {
+			matchType = rules.MatchSubdomains
+			if rules.Domain(s.Sender) != s.Sender {
+				matchType = rules.MatchAddress
+			}
+		}
+		matchType, err := rules.ParseMatchType(string(matchType))
+		if err != nil {
+			return nil, fmt.Errorf("sender %q: %w", s.Sender, err)
+		}
+		pattern, err := rules.Normalize(matchType, s.Sender)
+		if err != nil {
+			return nil, fmt.Errorf("sender %q: %w", s.Sender, err)
+		}
+		if err := validateRules(s.Rules); err != nil {
+			return nil, fmt.Errorf("sender %q: %w", s.Sender, err)
+		}
+		overrides = append(overrides, SenderOverride{
+			Sender: rules.Rule{Pattern: pattern, Type: matchType},
+			Rules:  s.Rules,
+		})
+	}
+
+	return NewLocalizedEngine(keywordRules, locales, overrides...), nil
+}
+
+func validateRules(keywordRules []KeywordRule) error {
+	for i, r := range keywordRules {
+		if r.Keyword == "" {
+			return fmt.Errorf("rule %d has no keyword", i+1)
+		}
+		if r.Category != CategoryTransactional && r.Category != CategoryMarketing {
+			return fmt.Errorf("rule %d (%q): category must be %q or %q", i+1, r.Keyword, CategoryTransactional, CategoryMarketing)
+		}
+	}
+	return nil
+}
+
+// LoadRules reads a rules file
+func LoadRules(path string) (*Engine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+	return engine, nil
+}
+
+// ruleFileCheckInterval limits how often the file is checked for changes
+const ruleFileCheckInterval = 5 * time.Second
+
+// RuleFile is a rules file that is reloaded when it changes. If a changed
+// file is invalid, the last good rules stay in effect.
+type RuleFile struct {
+	path string
+
+	mu        sync.Mutex
+	engine    *Engine
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewRuleFile loads a rules file and watches it for changes
+func NewRuleFile(path string) (*RuleFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RuleFile{
+		path:      path,
+		engine:    engine,
+		modTime:   info.ModTime(),
+		checkedAt: time.Now(),
+	}, nil
+}
+
+// Engine returns the current rules, reloading the file if it was modified
+func (f *RuleFile) Engine() *Engine {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checkedAt) < ruleFileCheckInterval {
+		return f.engine
+	}
+	f.checkedAt = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.Printf("Error checking classifier rules file, keeping current rules: %v", err)
+		return f.engine
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.engine
+	}
+
+	engine, err := LoadRules(f.path)
+	if err != nil {
+		log.Printf("Error reloading classifier rules, keeping current rules: %v", err)
+	} else {
+		f.engine = engine
+		log.Printf("Reloaded classifier rules from %s", f.path)
+	}
+	// Don't retry a broken file until it changes again
+	f.modTime = info.ModTime()
+	return f.engine
+}
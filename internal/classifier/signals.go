@@ -0,0 +1,231 @@
+package classifier
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"postal-inspection-service/internal/imap"
+)
+
+// Classifier decides whether an email is transactional or marketing
+type Classifier interface {
+	Classify(email *imap.FetchedEmail) Classification
+}
+
+// Signal is one piece of evidence behind a verdict. A positive weight points
+// to a transactional email, a negative one to marketing.
+type Signal struct {
+	Name   string
+	Weight int
+	// Reason is how the signal reads as a verdict; Name is used when empty
+	Reason string
+}
+
+func (s Signal) String() string {
+	return fmt.Sprintf("%s %+d", s.Name, s.Weight)
+}
+
+// Explanation lists the score and every signal that contributed to it
+func (c Classification) Explanation() string {
+	if len(c.Signals) == 0 {
+		return fmt.Sprintf("score %+d", c.Score)
+	}
+	parts := make([]string, len(c.Signals))
+	for i, s := range c.Signals {
+		parts[i] = s.String()
+	}
+	return fmt.Sprintf("score %+d: %s", c.Score, strings.Join(parts, ", "))
+}
+
+// Signal weights. Subject keywords are the strongest single cue; headers and
+// body cues can outvote them when several agree.
+const (
+	weightSubject       = 3
+	weightListHeader    = 2
+	weightBulk          = 2
+	weightCampaign      = 2
+	weightESP           = 1
+	weightAutoSubmitted = 2
+	weightOrderNumber   = 2
+	weightAmount        = 1
+	weightTracking      = 2
+	weightBrowserLink   = 1
+)
+
+// espHeaders are headers added by bulk email providers, keyed by lowercase
+// prefix. Transactional mail is sent through them too, so they count less
+// than an explicit campaign header.
+var espHeaders = []struct {
+	prefix string
+	name   string
+	weight int
+}{
+	{"x-campaign", "Campaign header", weightCampaign},
+	{"x-mc-user", "Mailchimp header", weightCampaign},
+	{"x-mailgun", "Mailgun header", weightESP},
+	{"x-sg-eid", "SendGrid header", weightESP},
+}
+
+var (
+	orderNumberPattern = regexp.MustCompile(`(?i)\border\s*(?:#|no\.?|number|id)[\s:#]*([a-z0-9-]+)`)
+	amountPattern      = regexp.MustCompile(`(?i)\b(?:total|subtotal|amount|charged|paid)\b[^\n]{0,40}?(?:[$€£¥]\s?\d[\d,]*(?:\.\d{2})?|\d[\d,]*\.\d{2}\s?(?:usd|eur|gbp))`)
+	trackingPattern    = regexp.MustCompile(`(?i)\btracking\s*(?:#|no\.?|number|id)?[\s:#]*([a-z0-9]+)`)
+	browserLinkPattern = regexp.MustCompile(`(?i)view (?:this email )?in (?:your |a )?(?:web )?browser`)
+)
+
+// Heuristic combines subject keywords with header and body signals
+type Heuristic struct {
+	// Rules supplies the subject rules; nil uses DefaultRules
+	Rules EngineSource
+}
+
+// Default returns the classifier used when none is configured
+func Default() Classifier {
+	return Heuristic{}
+}
+
+// Classify scores the email; a score above zero means transactional
+func (h Heuristic) Classify(email *imap.FetchedEmail) Classification {
+	var signals []Signal
+	add := func(name string, weight int) {
+		signals = append(signals, Signal{Name: name, Weight: weight})
+	}
+
+	body := email.BodyText
+	if body == "" {
+		body = stripTags(email.BodyHTML)
+	}
+
+	// Subject keywords, using the rules for the language of the whole message
+	engine := defaultEngine
+	if h.Rules != nil {
+		engine = h.Rules.Engine()
+	}
+	lang := DetectLanguage(email.Subject + "\n" + body)
+	match, matched := engine.MatchLanguage(lang, email.From, email.Subject)
+	if matched {
+		weight := weightSubject
+		if match.Rule.Category != CategoryTransactional {
+			weight = -weightSubject
+		}
+		signals = append(signals, Signal{Name: "subject " + match.String(), Weight: weight, Reason: match.Rule.Reason})
+	}
+
+	// Headers
+	headers := parseHeaders(email.Headers)
+	if _, ok := headers["list-unsubscribe"]; ok {
+		add("List-Unsubscribe header", -weightListHeader)
+	}
+	switch strings.ToLower(first(headers["precedence"])) {
+	case "bulk", "list", "junk":
+		add("Precedence: "+strings.ToLower(first(headers["precedence"])), -weightBulk)
+	}
+	for _, esp := range espHeaders {
+		for key := range headers {
+			if strings.HasPrefix(key, esp.prefix) {
+				add(esp.name, -esp.weight)
+				break
+			}
+		}
+	}
+	if auto := strings.ToLower(first(headers["auto-submitted"])); auto != "" && auto != "no" {
+		add("Auto-Submitted: "+auto, weightAutoSubmitted)
+	}
+
+	// Body cues
+	if hasCode(orderNumberPattern, body, 4) {
+		add("order number in body", weightOrderNumber)
+	}
+	if amountPattern.MatchString(body) {
+		add("amount charged in body", weightAmount)
+	}
+	if hasCode(trackingPattern, body, 8) {
+		add("tracking number in body", weightTracking)
+	}
+	if browserLinkPattern.MatchString(body) || browserLinkPattern.MatchString(email.BodyHTML) {
+		add("view-in-browser link", -weightBrowserLink)
+	}
+
+	result := verdict(signals)
+	if matched {
+		result.Match = &match
+	}
+	return result
+}
+
+// verdict adds up signals; a score above zero means transactional and the
+// reason is the strongest signal that agrees with the verdict
+func verdict(signals []Signal) Classification {
+	score := 0
+	for _, s := range signals {
+		score += s.Weight
+	}
+
+	result := Classification{
+		IsTransactional: score > 0,
+		Reason:          defaultReason,
+		Score:           score,
+		Signals:         signals,
+	}
+
+	best := 0
+	for _, s := range signals {
+		if (s.Weight > 0) == result.IsTransactional && abs(s.Weight) > best {
+			best = abs(s.Weight)
+			result.Reason = s.Name
+			if s.Reason != "" {
+				result.Reason = s.Reason
+			}
+		}
+	}
+	return result
+}
+
+// parseHeaders splits the "Key: value" lines stored in FetchedEmail.Headers
+// into a map keyed by lowercase header name
+func parseHeaders(raw string) map[string][]string {
+	headers := make(map[string][]string)
+	for _, line := range strings.Split(raw, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		headers[key] = append(headers[key], strings.TrimSpace(value))
+	}
+	return headers
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// hasCode reports whether pattern captures an identifier of at least minLen
+// characters containing a digit, so "order number: 112-5849" counts but
+// "tracking information" doesn't
+func hasCode(pattern *regexp.Regexp, body string, minLen int) bool {
+	for _, m := range pattern.FindAllStringSubmatch(body, -1) {
+		if len(m[1]) >= minLen && strings.ContainsAny(m[1], "0123456789") {
+			return true
+		}
+	}
+	return false
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// stripTags reduces HTML to roughly its text so body patterns can match
+func stripTags(html string) string {
+	return tagPattern.ReplaceAllString(html, " ")
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -3,31 +3,130 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	IMAPServer   string
-	IMAPPort     int
-	Email        string
-	AppPassword  string
-	PollInterval time.Duration
-	WebPort      int
-	DBPath       string
+	Accounts       []Account
+	IMAPMaxConns   int
+	ServerSearch   bool
+	DeleteMode     string
+	QuarantineDays int
+	DryRun         bool
+	ScanJunk       bool
+	RulesFile      string
+	OAuthRedirect  string
+	PollInterval   time.Duration
+	IdleEnabled    bool
+	WebPort        int
+	DBPath         string
+	AttachmentDir  string
+	AttachmentMB   int64
+	ArchiveDir     string
+	ArchiveDays    int
+}
+
+// Account is a mailbox to watch and how to sign in to it. Each account is
+// polled on its own, and rules can be scoped to it.
+type Account struct {
+	Name          string // From ACCOUNTS; empty for a single unnamed account
+	IMAPProvider  string
+	IMAPServer    string
+	IMAPPort      int
+	IMAPTLS       string
+	IMAPCAFile    string
+	Email         string
+	Username      string
+	Password      string
+	IMAPAuth      string
+	OAuthClientID string
+	OAuthSecret   string
+	OAuthAuthURL  string
+	OAuthTokenURL string
+	OAuthScopes   []string
+}
+
+// ID identifies the account in the database: its lowercased address
+func (a Account) ID() string {
+	return strings.ToLower(a.Email)
 }
 
 func Load() (*Config, error) {
-	email := os.Getenv("ICLOUD_EMAIL")
-	if email == "" {
-		return nil, fmt.Errorf("ICLOUD_EMAIL environment variable is required")
+	// ACCOUNTS names several mailboxes whose settings are read from variables
+	// prefixed with the upper-cased name, such as WORK_IMAP_EMAIL. Without it
+	// a single account is read from the unprefixed variables.
+	var names []string
+	for _, name := range strings.Split(os.Getenv("ACCOUNTS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{""}
 	}
 
-	appPassword := os.Getenv("ICLOUD_APP_PASSWORD")
-	if appPassword == "" {
-		return nil, fmt.Errorf("ICLOUD_APP_PASSWORD environment variable is required")
+	var accounts []Account
+	seen := make(map[string]string)
+	for _, name := range names {
+		account, err := loadAccount(name)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[account.ID()]; ok {
+			return nil, fmt.Errorf("accounts %s and %s have the same address %s", other, name, account.Email)
+		}
+		seen[account.ID()] = name
+		accounts = append(accounts, account)
 	}
 
+	maxConns := 2
+	if connsStr := os.Getenv("IMAP_MAX_CONNECTIONS"); connsStr != "" {
+		if parsed, err := strconv.Atoi(connsStr); err == nil && parsed > 0 {
+			maxConns = parsed
+		}
+	}
+
+	serverSearch := true
+	if searchStr := os.Getenv("IMAP_SERVER_SEARCH"); searchStr != "" {
+		if parsed, err := strconv.ParseBool(searchStr); err == nil {
+			serverSearch = parsed
+		}
+	}
+
+	deleteMode := "auto"
+	if mode := os.Getenv("DELETE_MODE"); mode != "" {
+		deleteMode = mode
+	}
+
+	// Marketing emails are deleted right away unless a grace period is set
+	quarantineDays := 0
+	if daysStr := os.Getenv("QUARANTINE_DAYS"); daysStr != "" {
+		if parsed, err := strconv.Atoi(daysStr); err == nil && parsed >= 0 {
+			quarantineDays = parsed
+		}
+	}
+
+	dryRun := false
+	if dryRunStr := os.Getenv("DRY_RUN"); dryRunStr != "" {
+		if parsed, err := strconv.ParseBool(dryRunStr); err == nil {
+			dryRun = parsed
+		}
+	}
+
+	// Junk and spam folders are only checked by rules scoped to include them
+	// unless this is set
+	scanJunk := false
+	if scanJunkStr := os.Getenv("SCAN_JUNK"); scanJunkStr != "" {
+		if parsed, err := strconv.ParseBool(scanJunkStr); err == nil {
+			scanJunk = parsed
+		}
+	}
+
+	rulesFile := os.Getenv("CLASSIFIER_RULES_FILE")
+
 	pollInterval := 1 * time.Minute
 	if intervalStr := os.Getenv("POLL_INTERVAL"); intervalStr != "" {
 		if parsed, err := time.ParseDuration(intervalStr); err == nil {
@@ -35,6 +134,15 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// Each watched folder holds its own connection outside the pool, so
+	// IDLE has to be asked for
+	idleEnabled := false
+	if idleStr := os.Getenv("IMAP_IDLE"); idleStr != "" {
+		if parsed, err := strconv.ParseBool(idleStr); err == nil {
+			idleEnabled = parsed
+		}
+	}
+
 	webPort := 8080
 	if portStr := os.Getenv("WEB_PORT"); portStr != "" {
 		if parsed, err := strconv.Atoi(portStr); err == nil {
@@ -47,13 +155,189 @@ func Load() (*Config, error) {
 		dbPath = path
 	}
 
+	// Attachment contents are only kept when a size cap is set
+	attachmentDir := filepath.Join(filepath.Dir(dbPath), "attachments")
+	if dir := os.Getenv("ATTACHMENT_DIR"); dir != "" {
+		attachmentDir = dir
+	}
+
+	var attachmentMB int64
+	if mbStr := os.Getenv("ATTACHMENT_STORE_MB"); mbStr != "" {
+		if parsed, err := strconv.ParseInt(mbStr, 10, 64); err == nil && parsed >= 0 {
+			attachmentMB = parsed
+		}
+	}
+
+	// The original source of every deleted email is archived, compressed, for
+	// this many days; 0 turns the archive off
+	archiveDir := filepath.Join(filepath.Dir(dbPath), "archive")
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		archiveDir = dir
+	}
+
+	archiveDays := 365
+	if daysStr := os.Getenv("ARCHIVE_RETENTION_DAYS"); daysStr != "" {
+		if parsed, err := strconv.Atoi(daysStr); err == nil && parsed >= 0 {
+			archiveDays = parsed
+		}
+	}
+
+	// The provider sends the browser back here after authorization, so it has
+	// to be the address the dashboard is reached at
+	oauthRedirect := fmt.Sprintf("http://localhost:%d/oauth/callback", webPort)
+	if redirect := os.Getenv("OAUTH_REDIRECT_URL"); redirect != "" {
+		oauthRedirect = redirect
+	}
+
 	return &Config{
-		IMAPServer:   "imap.mail.me.com",
-		IMAPPort:     993,
-		Email:        email,
-		AppPassword:  appPassword,
-		PollInterval: pollInterval,
-		WebPort:      webPort,
-		DBPath:       dbPath,
+		Accounts:       accounts,
+		IMAPMaxConns:   maxConns,
+		ServerSearch:   serverSearch,
+		DeleteMode:     deleteMode,
+		QuarantineDays: quarantineDays,
+		DryRun:         dryRun,
+		ScanJunk:       scanJunk,
+		RulesFile:      rulesFile,
+		OAuthRedirect:  oauthRedirect,
+		PollInterval:   pollInterval,
+		IdleEnabled:    idleEnabled,
+		WebPort:        webPort,
+		DBPath:         dbPath,
+		AttachmentDir:  attachmentDir,
+		AttachmentMB:   attachmentMB,
+		ArchiveDir:     archiveDir,
+		ArchiveDays:    archiveDays,
+	}, nil
+}
+
+// loadAccount reads the settings of the account called name. Its variables
+// are prefixed with the name; unprefixed ones apply to every account that
+// doesn't set its own.
+func loadAccount(name string) (Account, error) {
+	prefix := ""
+	label := ""
+	if name != "" {
+		prefix = envPrefix(name)
+		label = " for account " + name
+	}
+	env := func(names ...string) string {
+		for _, n := range names {
+			if value := getenv(prefix + n); value != "" {
+				return value
+			}
+		}
+		return getenv(names...)
+	}
+
+	// The ICLOUD_* names from before other providers were supported still work
+	email := env("IMAP_EMAIL", "ICLOUD_EMAIL")
+	if email == "" {
+		return Account{}, fmt.Errorf("%sIMAP_EMAIL environment variable is required", prefix)
+	}
+
+	// OAuth2 accounts sign in with a token authorized from the dashboard
+	// instead of a password
+	auth := "password"
+	if mode := strings.ToLower(env("IMAP_AUTH")); mode != "" {
+		auth = mode
+	}
+	oauth := auth == "xoauth2" || auth == "oauthbearer"
+
+	password := env("IMAP_PASSWORD", "ICLOUD_APP_PASSWORD")
+	if password == "" && !oauth {
+		return Account{}, fmt.Errorf("%sIMAP_PASSWORD environment variable is required", prefix)
+	}
+
+	oauthClientID := env("OAUTH_CLIENT_ID")
+	if oauthClientID == "" && oauth {
+		return Account{}, fmt.Errorf("%sOAUTH_CLIENT_ID environment variable is required for IMAP_AUTH %s", prefix, auth)
+	}
+
+	var oauthScopes []string
+	if scopes := env("OAUTH_SCOPES"); scopes != "" {
+		oauthScopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+
+	username := email
+	if user := env("IMAP_USERNAME"); user != "" {
+		username = user
+	}
+
+	// A provider preset fills in the server; any setting can be overridden.
+	// Without a preset or host, iCloud is assumed as before.
+	providerName := strings.ToLower(env("IMAP_PROVIDER"))
+	host := env("IMAP_HOST")
+	if providerName == "" && host == "" {
+		providerName = "icloud"
+	}
+	provider := Provider{Port: 993, TLS: "tls"}
+	if providerName != "" {
+		preset, ok := providers[providerName]
+		if !ok {
+			return Account{}, fmt.Errorf("unknown IMAP_PROVIDER %q%s (want icloud, gmail, fastmail, outlook or dovecot)", providerName, label)
+		}
+		provider = preset
+	}
+	if host == "" {
+		host = provider.Host
+	}
+	if host == "" {
+		return Account{}, fmt.Errorf("%sIMAP_HOST environment variable is required for IMAP_PROVIDER %s", prefix, providerName)
+	}
+
+	tlsMode := provider.TLS
+	if mode := strings.ToLower(env("IMAP_TLS")); mode != "" {
+		tlsMode = mode
+	}
+
+	port := provider.Port
+	if tlsMode != provider.TLS {
+		port = defaultPort(tlsMode)
+	}
+	if portStr := env("IMAP_PORT"); portStr != "" {
+		parsed, err := strconv.Atoi(portStr)
+		if err != nil || parsed <= 0 {
+			return Account{}, fmt.Errorf("invalid IMAP_PORT %q%s", portStr, label)
+		}
+		port = parsed
+	}
+
+	return Account{
+		Name:          name,
+		IMAPProvider:  providerName,
+		IMAPServer:    host,
+		IMAPPort:      port,
+		IMAPTLS:       tlsMode,
+		IMAPCAFile:    env("IMAP_CA_FILE"),
+		Email:         email,
+		Username:      username,
+		Password:      password,
+		IMAPAuth:      auth,
+		OAuthClientID: oauthClientID,
+		OAuthSecret:   env("OAUTH_CLIENT_SECRET"),
+		OAuthAuthURL:  env("OAUTH_AUTH_URL"),
+		OAuthTokenURL: env("OAUTH_TOKEN_URL"),
+		OAuthScopes:   oauthScopes,
 	}, nil
 }
+
+// envPrefix turns an account name into its variable prefix, e.g. "work-2"
+// into "WORK_2_"
+func envPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name)) + "_"
+}
+
+// getenv returns the first of the named environment variables that is set
+func getenv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
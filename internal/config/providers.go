@@ -0,0 +1,26 @@
+package config
+
+// Provider holds the connection settings of a well-known mail provider
+type Provider struct {
+	Host string
+	Port int
+	TLS  string
+}
+
+// providers are the presets selectable with IMAP_PROVIDER. Dovecot has no
+// host since every installation has its own; IMAP_HOST must be set with it.
+var providers = map[string]Provider{
+	"icloud":   {Host: "imap.mail.me.com", Port: 993, TLS: "tls"},
+	"gmail":    {Host: "imap.gmail.com", Port: 993, TLS: "tls"},
+	"fastmail": {Host: "imap.fastmail.com", Port: 993, TLS: "tls"},
+	"outlook":  {Host: "outlook.office365.com", Port: 993, TLS: "tls"},
+	"dovecot":  {Port: 993, TLS: "tls"},
+}
+
+// defaultPort is the usual port for a TLS mode
+func defaultPort(tlsMode string) int {
+	if tlsMode == "tls" {
+		return 993
+	}
+	return 143
+}
@@ -2,12 +2,21 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"postal-inspection-service/internal/rules"
 )
 
+// ErrRuleExists is returned when a rule is added for a pattern the account
+// already has a rule of another match type for
+var ErrRuleExists = errors.New("a rule for this pattern already exists")
+
 type DB struct {
 	conn *sql.DB
 }
@@ -31,19 +40,82 @@ func New(dbPath string) (*DB, error) {
 }
 
 func (db *DB) migrate() error {
+	// Folder state gained an account in its key. It only records how far
+	// folders were scanned, so older tables are dropped and rebuilt by a
+	// full rescan rather than converted.
+	if exists, err := db.hasTable("folder_state"); err != nil {
+		return err
+	} else if exists {
+		hasAccount, err := db.hasColumn("folder_state", "account")
+		if err != nil {
+			return err
+		}
+		if !hasAccount {
+			if _, err := db.conn.Exec("DROP TABLE folder_state"); err != nil {
+				return fmt.Errorf("failed to drop old folder state: %w", err)
+			}
+		}
+	}
+
+	// Rules were unique by pattern, so one pattern couldn't be added for
+	// two accounts. Such tables are set aside and copied into the new ones
+	// once those have all their columns.
+	var rekeyed []string
+	for _, table := range ruleTables {
+		old, err := db.uniqueByPattern(table)
+		if err != nil {
+			return err
+		}
+		if !old {
+			continue
+		}
+		if _, err := db.conn.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", table, table)); err != nil {
+			return fmt.Errorf("failed to set aside %s: %w", table, err)
+		}
+		if _, err := db.conn.Exec(fmt.Sprintf("DROP INDEX IF EXISTS idx_%s_email", table)); err != nil {
+			return err
+		}
+		rekeyed = append(rekeyed, table)
+	}
+
+	// Before folders could be excluded on the dashboard, Orders was always
+	// skipped by name. Existing databases keep that as an exclusion.
+	hadOverrides, err := db.hasTable("folder_overrides")
+	if err != nil {
+		return err
+	}
+	hadLog, err := db.hasTable("action_log")
+	if err != nil {
+		return err
+	}
+
 	schema := `
 	CREATE TABLE IF NOT EXISTS blocked_senders (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		email TEXT UNIQUE NOT NULL,
+		email TEXT NOT NULL,
 		reason TEXT NOT NULL,
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		account TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (email, account)
 	);
 
 	CREATE TABLE IF NOT EXISTS transactional_only_senders (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		email TEXT UNIQUE NOT NULL,
+		email TEXT NOT NULL,
 		reason TEXT NOT NULL,
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		account TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (email, account)
+	);
+
+	CREATE TABLE IF NOT EXISTS allowed_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		match_type TEXT NOT NULL DEFAULT 'address',
+		reason TEXT NOT NULL,
+		account TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (email, account)
 	);
 
 	CREATE TABLE IF NOT EXISTS email_details (
@@ -72,12 +144,241 @@ func (db *DB) migrate() error {
 		FOREIGN KEY (email_detail_id) REFERENCES email_details(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS folder_state (
+		account TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL,
+		folder TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		last_uid INTEGER NOT NULL,
+		highest_modseq INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (account, scope, folder)
+	);
+
+	CREATE TABLE IF NOT EXISTS scan_generations (
+		scope TEXT PRIMARY KEY,
+		generation INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS quarantine (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action_log_id INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'quarantined',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME,
+		FOREIGN KEY (action_log_id) REFERENCES action_log(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS classifier_corrections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		subject TEXT,
+		message_id TEXT,
+		email_detail_id INTEGER,
+		is_transactional INTEGER NOT NULL,
+		source TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS model_documents (
+		message_id TEXT PRIMARY KEY,
+		is_transactional INTEGER NOT NULL,
+		tokens TEXT NOT NULL,
+		trained_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS model_tokens (
+		token TEXT PRIMARY KEY,
+		transactional INTEGER NOT NULL DEFAULT 0,
+		marketing INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_detail_id INTEGER NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		stored INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email_detail_id) REFERENCES email_details(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS archived_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action_log_id INTEGER,
+		message_id TEXT NOT NULL DEFAULT '',
+		sender TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL DEFAULT '',
+		date TEXT NOT NULL DEFAULT '',
+		folder TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		archived_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (action_log_id) REFERENCES action_log(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS oauth_tokens (
+		account TEXT PRIMARY KEY,
+		access_token TEXT NOT NULL DEFAULT '',
+		refresh_token TEXT NOT NULL DEFAULT '',
+		expiry DATETIME,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS folder_overrides (
+		account TEXT NOT NULL DEFAULT '',
+		folder TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (account, folder)
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_blocked_senders_email ON blocked_senders(email);
 	CREATE INDEX IF NOT EXISTS idx_transactional_only_senders_email ON transactional_only_senders(email);
+	CREATE INDEX IF NOT EXISTS idx_allowed_senders_email ON allowed_senders(email);
 	CREATE INDEX IF NOT EXISTS idx_action_log_created_at ON action_log(created_at DESC);
 	CREATE INDEX IF NOT EXISTS idx_email_details_message_id ON email_details(message_id);
+	CREATE INDEX IF NOT EXISTS idx_quarantine_status ON quarantine(status, created_at);
+	CREATE INDEX IF NOT EXISTS idx_attachments_email_detail_id ON attachments(email_detail_id);
+	CREATE INDEX IF NOT EXISTS idx_archived_messages_archived_at ON archived_messages(archived_at);
+	CREATE INDEX IF NOT EXISTS idx_archived_messages_action_log_id ON archived_messages(action_log_id);
 	`
-	_, err := db.conn.Exec(schema)
+	if _, err := db.conn.Exec(schema); err != nil {
+		return err
+	}
+
+	if hadLog && !hadOverrides {
+		if _, err := db.conn.Exec(
+			"INSERT OR IGNORE INTO folder_overrides (account, folder, mode) VALUES ('', 'Orders', ?)", FolderExclude,
+		); err != nil {
+			return fmt.Errorf("failed to keep Orders excluded: %w", err)
+		}
+	}
+
+	// Columns added after the initial release
+	columns := []struct{ table, column, definition string }{
+		{"action_log", "folder", "TEXT"},
+		{"email_details", "raw_source", "BLOB"},
+		{"blocked_senders", "simulate", "INTEGER NOT NULL DEFAULT 0"},
+		{"transactional_only_senders", "simulate", "INTEGER NOT NULL DEFAULT 0"},
+		{"blocked_senders", "match_type", "TEXT NOT NULL DEFAULT 'address'"},
+		{"transactional_only_senders", "match_type", "TEXT NOT NULL DEFAULT 'address'"},
+		{"action_log", "applied_at", "DATETIME"},
+		{"action_log", "model_score", "REAL"},
+		{"email_details", "sender_name", "TEXT"},
+		{"blocked_senders", "account", "TEXT NOT NULL DEFAULT ''"},
+		{"transactional_only_senders", "account", "TEXT NOT NULL DEFAULT ''"},
+		{"allowed_senders", "account", "TEXT NOT NULL DEFAULT ''"},
+		{"action_log", "account", "TEXT NOT NULL DEFAULT ''"},
+		{"blocked_senders", "folder_scope", "TEXT NOT NULL DEFAULT 'all'"},
+		{"transactional_only_senders", "folder_scope", "TEXT NOT NULL DEFAULT 'all'"},
+		{"blocked_senders", "except_folders", "TEXT NOT NULL DEFAULT ''"},
+		{"transactional_only_senders", "except_folders", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := db.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	if _, err := db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_action_log_account ON action_log(account, created_at DESC)"); err != nil {
+		return err
+	}
+
+	for _, table := range rekeyed {
+		if err := db.copyOldTable(table); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// hasTable reports whether a table exists
+func (db *DB) hasTable(table string) (bool, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// hasColumn reports whether a table has a column
+func (db *DB) hasColumn(table, column string) (bool, error) {
+	columns, err := db.columns(table)
+	return slices.Contains(columns, column), err
+}
+
+// ruleTables hold the sender rules, which are unique by pattern and account
+var ruleTables = []string{"blocked_senders", "transactional_only_senders", "allowed_senders"}
+
+// uniqueByPattern reports whether a rule table was created when rules were
+// unique by pattern alone
+func (db *DB) uniqueByPattern(table string) (bool, error) {
+	var schema string
+	err := db.conn.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return strings.Contains(schema, "email TEXT UNIQUE"), err
+}
+
+// columns returns the column names of a table
+func (db *DB) columns(table string) ([]string, error) {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// copyOldTable moves the rows of a table set aside as <table>_old into its
+// replacement and drops it
+func (db *DB) copyOldTable(table string) error {
+	oldColumns, err := db.columns(table + "_old")
+	if err != nil {
+		return err
+	}
+	newColumns, err := db.columns(table)
+	if err != nil {
+		return err
+	}
+	var shared []string
+	for _, c := range oldColumns {
+		if slices.Contains(newColumns, c) {
+			shared = append(shared, c)
+		}
+	}
+
+	list := strings.Join(shared, ", ")
+	if _, err := db.conn.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s_old", table, list, list, table)); err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(fmt.Sprintf("DROP TABLE %s_old", table))
+	return err
+}
+
+// addColumnIfMissing adds a column to a table created by an older version;
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	exists, err := db.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
@@ -85,14 +386,50 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
+// forAccount restricts a query to what concerns account: its own rows and
+// those with no account, which are rules for every account and log entries
+// from before accounts were recorded. An empty account matches everything.
+func forAccount(column, account string) (string, []any) {
+	if account == "" {
+		return "1 = 1", nil
+	}
+	return "(" + column + " = ? OR " + column + " = '')", []any{account}
+}
+
+// joinFolders stores a list of folder names in one column. Folder names can
+// hold commas and spaces, but not line breaks.
+func joinFolders(folders []string) string {
+	return strings.Join(folders, "\n")
+}
+
+// splitFolders reverses joinFolders
+func splitFolders(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
 // BlockedSender operations
 
-func (db *DB) AddBlockedSender(email, reason string) error {
-	_, err := db.conn.Exec(
-		"INSERT OR IGNORE INTO blocked_senders (email, reason, created_at) VALUES (?, ?, ?)",
-		email, reason, time.Now(),
+// AddBlockedSender adds a sender rule to the blocked list and reports whether it
+// was new, which invalidates the incremental scan state so existing mail is
+// checked against it
+func (db *DB) AddBlockedSender(sender *BlockedSender) (bool, error) {
+	if sender.MatchType == "" {
+		sender.MatchType = rules.MatchAddress
+	}
+	if sender.FolderScope == "" {
+		sender.FolderScope = rules.ScopeAll
+	}
+	result, err := db.conn.Exec(
+		"INSERT OR IGNORE INTO blocked_senders (email, match_type, reason, simulate, account, folder_scope, except_folders, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		sender.Email, sender.MatchType, sender.Reason, sender.Simulate, sender.Account, sender.FolderScope, joinFolders(sender.ExceptFolders), time.Now(),
 	)
-	return err
+	if err != nil {
+		return false, err
+	}
+	return db.resetFolderStatesIfAdded(result, "blocked_senders", sender.Rule(), sender.Account, ScanScopeBlocked)
 }
 
 func (db *DB) RemoveBlockedSender(id int64) error {
@@ -100,14 +437,24 @@ func (db *DB) RemoveBlockedSender(id int64) error {
 	return err
 }
 
-func (db *DB) IsBlocked(email string) (bool, error) {
-	var count int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM blocked_senders WHERE email = ?", email).Scan(&count)
-	return count > 0, err
+// IsBlocked reports whether any blocked rule for account matches the address
+func (db *DB) IsBlocked(account, email string) (bool, error) {
+	senders, err := db.GetBlockedSenders(account)
+	if err != nil {
+		return false, err
+	}
+	ruleList := make([]rules.Rule, len(senders))
+	for i, s := range senders {
+		ruleList[i] = s.Rule()
+	}
+	return rules.NewMatcher(ruleList).Match(email) >= 0, nil
 }
 
-func (db *DB) GetBlockedSenders() ([]BlockedSender, error) {
-	rows, err := db.conn.Query("SELECT id, email, reason, created_at FROM blocked_senders ORDER BY created_at DESC")
+// GetBlockedSenders returns the blocked rules that apply to account, or all
+// of them if account is empty
+func (db *DB) GetBlockedSenders(account string) ([]BlockedSender, error) {
+	where, args := forAccount("account", account)
+	rows, err := db.conn.Query("SELECT id, email, match_type, reason, simulate, account, folder_scope, except_folders, created_at FROM blocked_senders WHERE "+where+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -116,36 +463,66 @@ func (db *DB) GetBlockedSenders() ([]BlockedSender, error) {
 	var senders []BlockedSender
 	for rows.Next() {
 		var s BlockedSender
-		if err := rows.Scan(&s.ID, &s.Email, &s.Reason, &s.CreatedAt); err != nil {
+		var except string
+		if err := rows.Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Simulate, &s.Account, &s.FolderScope, &except, &s.CreatedAt); err != nil {
 			return nil, err
 		}
+		s.ExceptFolders = splitFolders(except)
 		senders = append(senders, s)
 	}
 	return senders, rows.Err()
 }
 
+// SetBlockedSenderSimulate switches a rule between simulating and deleting.
+// Turning simulation off invalidates the incremental scan state so mail seen
+// while simulating is deleted too.
+func (db *DB) SetBlockedSenderSimulate(id int64, simulate bool) error {
+	return db.setRuleSimulate("blocked_senders", ScanScopeBlocked, id, simulate)
+}
+
+// SetBlockedSenderScope changes the folders an account's rule for pattern
+// applies to and reports whether they changed, which invalidates the
+// incremental scan state so mail in the new folders is checked against it
+func (db *DB) SetBlockedSenderScope(pattern, account string, scope rules.FolderScope, except []string) (bool, error) {
+	return db.setRuleScope("blocked_senders", ScanScopeBlocked, pattern, account, scope, except)
+}
+
 func (db *DB) GetBlockedSenderByID(id int64) (*BlockedSender, error) {
 	var s BlockedSender
+	var except string
 	err := db.conn.QueryRow(
-		"SELECT id, email, reason, created_at FROM blocked_senders WHERE id = ?", id,
-	).Scan(&s.ID, &s.Email, &s.Reason, &s.CreatedAt)
+		"SELECT id, email, match_type, reason, simulate, account, folder_scope, except_folders, created_at FROM blocked_senders WHERE id = ?", id,
+	).Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Simulate, &s.Account, &s.FolderScope, &except, &s.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	s.ExceptFolders = splitFolders(except)
 	return &s, nil
 }
 
 // TransactionalOnlySender operations
 
-func (db *DB) AddTransactionalOnlySender(email, reason string) error {
-	_, err := db.conn.Exec(
-		"INSERT OR IGNORE INTO transactional_only_senders (email, reason, created_at) VALUES (?, ?, ?)",
-		email, reason, time.Now(),
+// AddTransactionalOnlySender adds a sender rule to the transactional-only list and
+// reports whether it was new, which invalidates the incremental scan state so
+// existing mail is checked against it
+func (db *DB) AddTransactionalOnlySender(sender *TransactionalOnlySender) (bool, error) {
+	if sender.MatchType == "" {
+		sender.MatchType = rules.MatchAddress
+	}
+	if sender.FolderScope == "" {
+		sender.FolderScope = rules.ScopeAll
+	}
+	result, err := db.conn.Exec(
+		"INSERT OR IGNORE INTO transactional_only_senders (email, match_type, reason, simulate, account, folder_scope, except_folders, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		sender.Email, sender.MatchType, sender.Reason, sender.Simulate, sender.Account, sender.FolderScope, joinFolders(sender.ExceptFolders), time.Now(),
 	)
-	return err
+	if err != nil {
+		return false, err
+	}
+	return db.resetFolderStatesIfAdded(result, "transactional_only_senders", sender.Rule(), sender.Account, ScanScopeTransactionalOnly)
 }
 
 func (db *DB) RemoveTransactionalOnlySender(id int64) error {
@@ -153,14 +530,24 @@ func (db *DB) RemoveTransactionalOnlySender(id int64) error {
 	return err
 }
 
-func (db *DB) IsTransactionalOnly(email string) (bool, error) {
-	var count int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM transactional_only_senders WHERE email = ?", email).Scan(&count)
-	return count > 0, err
+// IsTransactionalOnly reports whether any transactional-only rule for account matches the address
+func (db *DB) IsTransactionalOnly(account, email string) (bool, error) {
+	senders, err := db.GetTransactionalOnlySenders(account)
+	if err != nil {
+		return false, err
+	}
+	ruleList := make([]rules.Rule, len(senders))
+	for i, s := range senders {
+		ruleList[i] = s.Rule()
+	}
+	return rules.NewMatcher(ruleList).Match(email) >= 0, nil
 }
 
-func (db *DB) GetTransactionalOnlySenders() ([]TransactionalOnlySender, error) {
-	rows, err := db.conn.Query("SELECT id, email, reason, created_at FROM transactional_only_senders ORDER BY created_at DESC")
+// GetTransactionalOnlySenders returns the transactional-only rules that apply
+// to account, or all of them if account is empty
+func (db *DB) GetTransactionalOnlySenders(account string) ([]TransactionalOnlySender, error) {
+	where, args := forAccount("account", account)
+	rows, err := db.conn.Query("SELECT id, email, match_type, reason, simulate, account, folder_scope, except_folders, created_at FROM transactional_only_senders WHERE "+where+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -169,188 +556,1246 @@ func (db *DB) GetTransactionalOnlySenders() ([]TransactionalOnlySender, error) {
 	var senders []TransactionalOnlySender
 	for rows.Next() {
 		var s TransactionalOnlySender
-		if err := rows.Scan(&s.ID, &s.Email, &s.Reason, &s.CreatedAt); err != nil {
+		var except string
+		if err := rows.Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Simulate, &s.Account, &s.FolderScope, &except, &s.CreatedAt); err != nil {
 			return nil, err
 		}
+		s.ExceptFolders = splitFolders(except)
 		senders = append(senders, s)
 	}
 	return senders, rows.Err()
 }
 
+// SetTransactionalOnlySenderSimulate switches a rule between simulating and
+// deleting. Turning simulation off invalidates the incremental scan state so
+// mail seen while simulating is deleted too.
+func (db *DB) SetTransactionalOnlySenderSimulate(id int64, simulate bool) error {
+	return db.setRuleSimulate("transactional_only_senders", ScanScopeTransactionalOnly, id, simulate)
+}
+
+// SetTransactionalOnlySenderScope changes the folders an account's rule for
+// pattern applies to and reports whether they changed, which invalidates the
+// incremental scan state so mail in the new folders is checked against it
+func (db *DB) SetTransactionalOnlySenderScope(pattern, account string, scope rules.FolderScope, except []string) (bool, error) {
+	return db.setRuleScope("transactional_only_senders", ScanScopeTransactionalOnly, pattern, account, scope, except)
+}
+
 func (db *DB) GetTransactionalOnlySenderByID(id int64) (*TransactionalOnlySender, error) {
 	var s TransactionalOnlySender
+	var except string
 	err := db.conn.QueryRow(
-		"SELECT id, email, reason, created_at FROM transactional_only_senders WHERE id = ?", id,
-	).Scan(&s.ID, &s.Email, &s.Reason, &s.CreatedAt)
+		"SELECT id, email, match_type, reason, simulate, account, folder_scope, except_folders, created_at FROM transactional_only_senders WHERE id = ?", id,
+	).Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Simulate, &s.Account, &s.FolderScope, &except, &s.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	s.ExceptFolders = splitFolders(except)
 	return &s, nil
 }
 
-// EmailDetail operations
+// AllowedSender operations
 
-func (db *DB) SaveEmailDetail(detail *EmailDetail) (int64, error) {
+// AddAllowedSender adds a sender rule to the allowlist and reports whether it
+// was new
+func (db *DB) AddAllowedSender(sender *AllowedSender) (bool, error) {
+	if sender.MatchType == "" {
+		sender.MatchType = rules.MatchAddress
+	}
 	result, err := db.conn.Exec(
-		`INSERT INTO email_details (message_id, sender, recipients, subject, date, headers, body_text, body_html, has_attachments, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		detail.MessageID, detail.Sender, detail.Recipients, detail.Subject, detail.Date,
-		detail.Headers, detail.BodyText, detail.BodyHTML, detail.HasAttachments, time.Now(),
+		"INSERT OR IGNORE INTO allowed_senders (email, match_type, reason, account, created_at) VALUES (?, ?, ?, ?, ?)",
+		sender.Email, sender.MatchType, sender.Reason, sender.Account, time.Now(),
 	)
 	if err != nil {
-		return 0, err
-	}
-	return result.LastInsertId()
-}
-
-func (db *DB) GetEmailDetail(id int64) (*EmailDetail, error) {
-	var detail EmailDetail
-	var hasAttachments int
-	err := db.conn.QueryRow(
-		`SELECT id, message_id, sender, recipients, subject, date, headers, body_text, body_html, has_attachments, created_at
-		 FROM email_details WHERE id = ?`, id,
-	).Scan(&detail.ID, &detail.MessageID, &detail.Sender, &detail.Recipients, &detail.Subject, &detail.Date,
-		&detail.Headers, &detail.BodyText, &detail.BodyHTML, &hasAttachments, &detail.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+		return false, err
 	}
-	if err != nil {
-		return nil, err
+	added, err := result.RowsAffected()
+	if err != nil || added > 0 {
+		return added > 0, err
 	}
-	detail.HasAttachments = hasAttachments == 1
-	return &detail, nil
-}
-
-// ActionLog operations
-
-func (db *DB) LogAction(action, sender, subject, messageID, details string) error {
-	_, err := db.conn.Exec(
-		"INSERT INTO action_log (action, sender, subject, message_id, details, created_at) VALUES (?, ?, ?, ?, ?, ?)",
-		action, sender, subject, messageID, details, time.Now(),
-	)
-	return err
+	return false, db.ruleConflict("allowed_senders", sender.Rule(), sender.Account)
 }
 
-func (db *DB) LogActionWithEmail(action, sender, subject, messageID, details string, emailDetailID int64) error {
-	_, err := db.conn.Exec(
-		"INSERT INTO action_log (action, sender, subject, message_id, details, email_detail_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		action, sender, subject, messageID, details, emailDetailID, time.Now(),
-	)
+func (db *DB) RemoveAllowedSender(id int64) error {
+	_, err := db.conn.Exec("DELETE FROM allowed_senders WHERE id = ?", id)
 	return err
 }
 
-func (db *DB) GetActionLogs(limit, offset int) ([]ActionLog, error) {
-	rows, err := db.conn.Query(
-		"SELECT id, action, sender, subject, message_id, details, email_detail_id, created_at FROM action_log ORDER BY created_at DESC LIMIT ? OFFSET ?",
-		limit, offset,
-	)
+// GetAllowedSenders returns the allowlist rules that apply to account, or all
+// of them if account is empty
+func (db *DB) GetAllowedSenders(account string) ([]AllowedSender, error) {
+	where, args := forAccount("account", account)
+	rows, err := db.conn.Query("SELECT id, email, match_type, reason, account, created_at FROM allowed_senders WHERE "+where+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var logs []ActionLog
+	var senders []AllowedSender
 	for rows.Next() {
-		var l ActionLog
-		var subject, messageID, details sql.NullString
-		var emailDetailID sql.NullInt64
-		if err := rows.Scan(&l.ID, &l.Action, &l.Sender, &subject, &messageID, &details, &emailDetailID, &l.CreatedAt); err != nil {
+		var s AllowedSender
+		if err := rows.Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Account, &s.CreatedAt); err != nil {
 			return nil, err
 		}
-		l.Subject = subject.String
-		l.MessageID = messageID.String
-		l.Details = details.String
-		if emailDetailID.Valid {
-			l.EmailDetailID = &emailDetailID.Int64
-		}
-		logs = append(logs, l)
+		senders = append(senders, s)
 	}
-	return logs, rows.Err()
+	return senders, rows.Err()
 }
 
-func (db *DB) GetActionLogByID(id int64) (*ActionLog, error) {
-	var l ActionLog
-	var subject, messageID, details sql.NullString
-	var emailDetailID sql.NullInt64
+func (db *DB) GetAllowedSenderByID(id int64) (*AllowedSender, error) {
+	var s AllowedSender
 	err := db.conn.QueryRow(
-		"SELECT id, action, sender, subject, message_id, details, email_detail_id, created_at FROM action_log WHERE id = ?", id,
-	).Scan(&l.ID, &l.Action, &l.Sender, &subject, &messageID, &details, &emailDetailID, &l.CreatedAt)
+		"SELECT id, email, match_type, reason, account, created_at FROM allowed_senders WHERE id = ?", id,
+	).Scan(&s.ID, &s.Email, &s.MatchType, &s.Reason, &s.Account, &s.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	l.Subject = subject.String
-	l.MessageID = messageID.String
-	l.Details = details.String
-	if emailDetailID.Valid {
-		l.EmailDetailID = &emailDetailID.Int64
-	}
-	return &l, nil
+	return &s, nil
 }
 
-func (db *DB) GetActionLogCount() (int, error) {
-	var count int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM action_log").Scan(&count)
-	return count, err
+// GetAllowlist returns a matcher over the allowlist rules for account
+func (db *DB) GetAllowlist(account string) (*rules.Matcher, error) {
+	senders, err := db.GetAllowedSenders(account)
+	if err != nil {
+		return nil, err
+	}
+	ruleList := make([]rules.Rule, len(senders))
+	for i, s := range senders {
+		ruleList[i] = s.Rule()
+	}
+	return rules.NewMatcher(ruleList), nil
 }
 
-// PurgeOldEmailDetails deletes email details older than the specified number of days
-// and removes references from action_log entries
-func (db *DB) PurgeOldEmailDetails(olderThanDays int) (int64, error) {
-	cutoff := time.Now().AddDate(0, 0, -olderThanDays)
+// FolderState operations
 
-	// First, clear references in action_log
-	_, err := db.conn.Exec(
-		`UPDATE action_log SET email_detail_id = NULL
-		 WHERE email_detail_id IN (SELECT id FROM email_details WHERE created_at < ?)`,
-		cutoff,
-	)
+// GetFolderStates returns the incremental scan state of every folder of an
+// account for a scope, keyed by folder, and the generation of the scope's
+// state to pass to SaveFolderStates
+func (db *DB) GetFolderStates(account, scope string) (map[string]FolderState, int64, error) {
+	tx, err := db.conn.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("failed to clear email references: %w", err)
+		return nil, 0, err
 	}
+	defer tx.Rollback()
 
-	// Then delete old email details
-	result, err := db.conn.Exec(
-		"DELETE FROM email_details WHERE created_at < ?",
-		cutoff,
+	generation, err := scanGeneration(tx, scope)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(
+		"SELECT account, scope, folder, uid_validity, last_uid, highest_modseq, updated_at FROM folder_state WHERE account = ? AND scope = ?",
+		account, scope,
 	)
 	if err != nil {
-		return 0, fmt.Errorf("failed to delete old email details: %w", err)
+		return nil, 0, err
 	}
+	defer rows.Close()
 
-	return result.RowsAffected()
+	states := make(map[string]FolderState)
+	for rows.Next() {
+		var s FolderState
+		if err := rows.Scan(&s.Account, &s.Scope, &s.Folder, &s.UIDValidity, &s.LastUID, &s.HighestModSeq, &s.UpdatedAt); err != nil {
+			return nil, 0, err
+		}
+		states[s.Folder] = s
+	}
+	return states, generation, rows.Err()
 }
 
-// Stats
+// SaveFolderStates records the scan state of folders of an account for a
+// scope. Nothing is saved if the scope's state was reset since generation
+// was loaded, as the scan it came from missed the rules that caused the
+// reset; it reports whether the states were saved.
+func (db *DB) SaveFolderStates(account, scope string, generation int64, states []FolderState) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
 
-type Stats struct {
-	BlockedSendersCount           int
-	TransactionalOnlySendersCount int
-	TotalActionsCount             int
-	RecentActions                 []ActionLog
+	current, err := scanGeneration(tx, scope)
+	if err != nil || current != generation {
+		return false, err
+	}
+
+	for _, state := range states {
+		_, err := tx.Exec(
+			`INSERT INTO folder_state (account, scope, folder, uid_validity, last_uid, highest_modseq, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?)
+			 ON CONFLICT(account, scope, folder) DO UPDATE SET
+			   uid_validity = excluded.uid_validity,
+			   last_uid = excluded.last_uid,
+			   highest_modseq = excluded.highest_modseq,
+			   updated_at = excluded.updated_at`,
+			account, scope, state.Folder, state.UIDValidity, state.LastUID, state.HighestModSeq, time.Now(),
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to save state of %s: %w", state.Folder, err)
+		}
+	}
+	return true, tx.Commit()
 }
 
-func (db *DB) GetStats() (*Stats, error) {
-	stats := &Stats{}
+// ResetFolderStates forgets the scan state of an account for a scope, or of
+// every account if it is empty, so the next poll does a full rescan. Scans
+// already running won't save the state they started from.
+func (db *DB) ResetFolderStates(account, scope string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	if err := db.conn.QueryRow("SELECT COUNT(*) FROM blocked_senders").Scan(&stats.BlockedSendersCount); err != nil {
-		return nil, err
+	where, args := forAccount("account", account)
+	if _, err := tx.Exec("DELETE FROM folder_state WHERE scope = ? AND "+where, append([]any{scope}, args...)...); err != nil {
+		return err
 	}
+	if _, err := tx.Exec(
+		"INSERT INTO scan_generations (scope, generation) VALUES (?, 1) ON CONFLICT(scope) DO UPDATE SET generation = generation + 1",
+		scope,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	if err := db.conn.QueryRow("SELECT COUNT(*) FROM transactional_only_senders").Scan(&stats.TransactionalOnlySendersCount); err != nil {
-		return nil, err
+// scanGeneration returns how many times the scan state of a scope was reset
+func scanGeneration(tx *sql.Tx, scope string) (int64, error) {
+	var generation int64
+	err := tx.QueryRow("SELECT generation FROM scan_generations WHERE scope = ?", scope).Scan(&generation)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
+	return generation, err
+}
 
-	if err := db.conn.QueryRow("SELECT COUNT(*) FROM action_log").Scan(&stats.TotalActionsCount); err != nil {
+// resetFolderStatesIfAdded resets the scan state for scope of the account a
+// rule insert added a rule for, or of every account for a rule for all of them
+func (db *DB) resetFolderStatesIfAdded(result sql.Result, table string, rule rules.Rule, account, scope string) (bool, error) {
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if added == 0 {
+		return false, db.ruleConflict(table, rule, account)
+	}
+	if err := db.ResetFolderStates(account, scope); err != nil {
+		return true, fmt.Errorf("failed to reset folder state: %w", err)
+	}
+	return true, nil
+}
+
+// setRuleSimulate switches a rule in table between simulating and deleting and
+// resets the scan state for scanScope of its account when it starts deleting
+func (db *DB) setRuleSimulate(table, scanScope string, id int64, simulate bool) error {
+	result, err := db.conn.Exec(fmt.Sprintf("UPDATE %s SET simulate = ? WHERE id = ? AND simulate != ?", table), simulate, id, simulate)
+	if err != nil {
+		return err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil || changed == 0 || simulate {
+		return err
+	}
+
+	var account string
+	if err := db.conn.QueryRow(fmt.Sprintf("SELECT account FROM %s WHERE id = ?", table), id).Scan(&account); err != nil {
+		return err
+	}
+	if err := db.ResetFolderStates(account, scanScope); err != nil {
+		return fmt.Errorf("failed to reset folder state: %w", err)
+	}
+	return nil
+}
+
+// setRuleScope updates the folder scope of a rule in table and resets the
+// scan state for scanScope of its account if the scope changed
+func (db *DB) setRuleScope(table, scanScope, pattern, account string, scope rules.FolderScope, except []string) (bool, error) {
+	result, err := db.conn.Exec(
+		fmt.Sprintf("UPDATE %s SET folder_scope = ?, except_folders = ? WHERE email = ? AND account = ? AND (folder_scope != ? OR except_folders != ?)", table),
+		scope, joinFolders(except), pattern, account, scope, joinFolders(except),
+	)
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil || changed == 0 {
+		return false, err
+	}
+	if err := db.ResetFolderStates(account, scanScope); err != nil {
+		return true, fmt.Errorf("failed to reset folder state: %w", err)
+	}
+	return true, nil
+}
+
+// ruleConflict returns ErrRuleExists if the rule an insert ignored differs
+// from the one in table only by match type
+func (db *DB) ruleConflict(table string, rule rules.Rule, account string) error {
+	var existing rules.MatchType
+	err := db.conn.QueryRow(
+		fmt.Sprintf("SELECT match_type FROM %s WHERE email = ? AND account = ?", table), rule.Pattern, account,
+	).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing != rule.Type {
+		return fmt.Errorf("%w as a %s rule", ErrRuleExists, existing)
+	}
+	return nil
+}
+
+// EmailDetail operations
+
+func (db *DB) SaveEmailDetail(detail *EmailDetail) (int64, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO email_details (message_id, sender, sender_name, recipients, subject, date, headers, body_text, body_html, has_attachments, raw_source, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		detail.MessageID, detail.Sender, detail.SenderName, detail.Recipients, detail.Subject, detail.Date,
+		detail.Headers, detail.BodyText, detail.BodyHTML, detail.HasAttachments, detail.RawSource, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (db *DB) GetEmailDetail(id int64) (*EmailDetail, error) {
+	var detail EmailDetail
+	var hasAttachments int
+	err := db.conn.QueryRow(
+		`SELECT id, message_id, sender, COALESCE(sender_name, ''), recipients, subject, date, headers, body_text, body_html, has_attachments, raw_source, created_at
+		 FROM email_details WHERE id = ?`, id,
+	).Scan(&detail.ID, &detail.MessageID, &detail.Sender, &detail.SenderName, &detail.Recipients, &detail.Subject, &detail.Date,
+		&detail.Headers, &detail.BodyText, &detail.BodyHTML, &hasAttachments, &detail.RawSource, &detail.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	detail.HasAttachments = hasAttachments == 1
+	return &detail, nil
+}
+
+// Attachment operations
+
+func (db *DB) AddAttachment(a *Attachment) (int64, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO attachments (email_detail_id, filename, content_type, size, sha256, stored, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.EmailDetailID, a.Filename, a.ContentType, a.Size, a.SHA256, a.Stored, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetAttachments returns the attachments of a stored email in message order
+func (db *DB) GetAttachments(emailDetailID int64) ([]Attachment, error) {
+	rows, err := db.conn.Query(
+		`SELECT id, email_detail_id, filename, content_type, size, sha256, stored, created_at
+		 FROM attachments WHERE email_detail_id = ? ORDER BY id`, emailDetailID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.EmailDetailID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.Stored, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (db *DB) GetAttachment(id int64) (*Attachment, error) {
+	var a Attachment
+	err := db.conn.QueryRow(
+		`SELECT id, email_detail_id, filename, content_type, size, sha256, stored, created_at
+		 FROM attachments WHERE id = ?`, id,
+	).Scan(&a.ID, &a.EmailDetailID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.Stored, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetStoredAttachmentHashes returns the hashes of all attachments whose
+// content was kept, for pruning the blob store
+func (db *DB) GetStoredAttachmentHashes() (map[string]bool, error) {
+	rows, err := db.conn.Query("SELECT DISTINCT sha256 FROM attachments WHERE stored = 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes[hash] = true
+	}
+	return hashes, rows.Err()
+}
+
+// Archived message operations
+
+const archivedMessageColumns = "id, COALESCE(action_log_id, 0), message_id, sender, subject, date, folder, size, sha256, archived_at"
+
+func scanArchivedMessage(row interface{ Scan(...any) error }) (*ArchivedMessage, error) {
+	var m ArchivedMessage
+	err := row.Scan(&m.ID, &m.ActionLogID, &m.MessageID, &m.Sender, &m.Subject, &m.Date, &m.Folder, &m.Size, &m.SHA256, &m.ArchivedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// AddArchivedMessage records a message written to the archive
+func (db *DB) AddArchivedMessage(m *ArchivedMessage) (int64, error) {
+	var actionLogID sql.NullInt64
+	if m.ActionLogID > 0 {
+		actionLogID = sql.NullInt64{Int64: m.ActionLogID, Valid: true}
+	}
+	result, err := db.conn.Exec(
+		`INSERT INTO archived_messages (action_log_id, message_id, sender, subject, date, folder, size, sha256, archived_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		actionLogID, m.MessageID, m.Sender, m.Subject, m.Date, m.Folder, m.Size, m.SHA256, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (db *DB) GetArchivedMessage(id int64) (*ArchivedMessage, error) {
+	m, err := scanArchivedMessage(db.conn.QueryRow(
+		"SELECT "+archivedMessageColumns+" FROM archived_messages WHERE id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// FindArchivedMessage returns the archived copy of the message an action log
+// entry is about: the one archived by that entry, or else the latest with the
+// same Message-ID
+func (db *DB) FindArchivedMessage(actionLogID int64, messageID string) (*ArchivedMessage, error) {
+	m, err := scanArchivedMessage(db.conn.QueryRow(
+		"SELECT "+archivedMessageColumns+` FROM archived_messages
+		 WHERE action_log_id = ? OR (message_id != '' AND message_id = ?)
+		 ORDER BY action_log_id = ? DESC, archived_at DESC LIMIT 1`,
+		actionLogID, messageID, actionLogID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// SearchArchivedMessages returns archived messages matching filter, newest
+// first; limit 0 returns all of them
+func (db *DB) SearchArchivedMessages(filter ArchiveFilter, limit int) ([]ArchivedMessage, error) {
+	var where []string
+	var args []any
+	if !filter.Since.IsZero() {
+		where = append(where, "archived_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "archived_at < ?")
+		args = append(args, filter.Until)
+	}
+	if sender := strings.ToLower(strings.TrimSpace(filter.Sender)); sender != "" {
+		// A bare domain matches every address at it
+		if strings.Contains(sender, "@") {
+			where = append(where, "LOWER(sender) = ?")
+			args = append(args, sender)
+		} else {
+			where = append(where, "LOWER(sender) LIKE ?")
+			args = append(args, "%@"+sender)
+		}
+	}
+
+	query := "SELECT " + archivedMessageColumns + " FROM archived_messages"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY archived_at DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ArchivedMessage
+	for rows.Next() {
+		m, err := scanArchivedMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *m)
+	}
+	return messages, rows.Err()
+}
+
+// PurgeOldArchivedMessages forgets messages archived more than olderThanDays
+// ago; their files are removed by pruning the archive afterwards
+func (db *DB) PurgeOldArchivedMessages(olderThanDays int) (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -olderThanDays)
+	result, err := db.conn.Exec("DELETE FROM archived_messages WHERE archived_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetArchivedHashes returns the hashes of all archived messages, for pruning
+// the archive
+func (db *DB) GetArchivedHashes() (map[string]bool, error) {
+	rows, err := db.conn.Query("SELECT DISTINCT sha256 FROM archived_messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes[hash] = true
+	}
+	return hashes, rows.Err()
+}
+
+// OAuth token operations
+
+// GetOAuthToken returns the stored token for account, or nil if it was never
+// authorized
+func (db *DB) GetOAuthToken(account string) (*OAuthToken, error) {
+	t := &OAuthToken{Account: account}
+	var expiry sql.NullTime
+	err := db.conn.QueryRow(
+		"SELECT access_token, refresh_token, expiry, updated_at FROM oauth_tokens WHERE account = ?", account,
+	).Scan(&t.AccessToken, &t.RefreshToken, &expiry, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Expiry = expiry.Time
+	return t, nil
+}
+
+// SaveOAuthToken stores t, replacing the account's previous token
+func (db *DB) SaveOAuthToken(t *OAuthToken) error {
+	var expiry any
+	if !t.Expiry.IsZero() {
+		expiry = t.Expiry
+	}
+	_, err := db.conn.Exec(
+		`INSERT INTO oauth_tokens (account, access_token, refresh_token, expiry, updated_at)
+		 VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(account) DO UPDATE SET
+		 	access_token = excluded.access_token,
+		 	refresh_token = excluded.refresh_token,
+		 	expiry = excluded.expiry,
+		 	updated_at = excluded.updated_at`,
+		t.Account, t.AccessToken, t.RefreshToken, expiry, time.Now(),
+	)
+	return err
+}
+
+// DeleteOAuthToken forgets the account's token so it has to be authorized again
+func (db *DB) DeleteOAuthToken(account string) error {
+	_, err := db.conn.Exec("DELETE FROM oauth_tokens WHERE account = ?", account)
+	return err
+}
+
+// Folder override operations
+
+// GetFolderOverrides returns the folders the user included in or excluded
+// from scanning for account, or for every account if it is empty. Overrides
+// for every account come first, so an account's own can replace them.
+func (db *DB) GetFolderOverrides(account string) ([]FolderOverride, error) {
+	where, args := forAccount("account", account)
+	rows, err := db.conn.Query(
+		"SELECT account, folder, mode, created_at FROM folder_overrides WHERE "+where+" ORDER BY account, folder",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []FolderOverride
+	for rows.Next() {
+		var o FolderOverride
+		if err := rows.Scan(&o.Account, &o.Folder, &o.Mode, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// SetFolderOverride includes or excludes a folder, replacing any earlier
+// override of it for the same account
+func (db *DB) SetFolderOverride(o *FolderOverride) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO folder_overrides (account, folder, mode, created_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(account, folder) DO UPDATE SET mode = excluded.mode, created_at = excluded.created_at`,
+		o.Account, o.Folder, o.Mode, time.Now(),
+	)
+	return err
+}
+
+// RemoveFolderOverride returns a folder to the default policy for account
+func (db *DB) RemoveFolderOverride(account, folder string) error {
+	_, err := db.conn.Exec("DELETE FROM folder_overrides WHERE account = ? AND folder = ?", account, folder)
+	return err
+}
+
+// ActionLog operations
+
+// LogAction records an action on account, or on every account if it is empty
+func (db *DB) LogAction(account, action, sender, subject, messageID, details string) error {
+	_, err := db.AddActionLog(&ActionLog{
+		Account:   account,
+		Action:    action,
+		Sender:    sender,
+		Subject:   subject,
+		MessageID: messageID,
+		Details:   details,
+	})
+	return err
+}
+
+func (db *DB) LogActionWithEmail(action, sender, subject, messageID, details string, emailDetailID int64) error {
+	_, err := db.AddActionLog(&ActionLog{
+		Action:        action,
+		Sender:        sender,
+		Subject:       subject,
+		MessageID:     messageID,
+		Details:       details,
+		EmailDetailID: &emailDetailID,
+	})
+	return err
+}
+
+// AddActionLog inserts an action log entry and returns its ID
+func (db *DB) AddActionLog(l *ActionLog) (int64, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO action_log (action, sender, subject, message_id, details, email_detail_id, folder, model_score, account, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.Action, l.Sender, l.Subject, l.MessageID, l.Details, l.EmailDetailID, nullString(l.Folder), l.ModelScore, l.Account, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+const actionLogColumns = "id, action, sender, subject, message_id, details, email_detail_id, folder, applied_at, model_score, account, created_at"
+
+// scanActionLog reads a row selected with actionLogColumns
+func scanActionLog(row interface{ Scan(...any) error }) (*ActionLog, error) {
+	var l ActionLog
+	var subject, messageID, details, folder sql.NullString
+	var emailDetailID sql.NullInt64
+	var appliedAt sql.NullTime
+	var modelScore sql.NullFloat64
+	if err := row.Scan(&l.ID, &l.Action, &l.Sender, &subject, &messageID, &details, &emailDetailID, &folder, &appliedAt, &modelScore, &l.Account, &l.CreatedAt); err != nil {
+		return nil, err
+	}
+	l.Subject = subject.String
+	l.MessageID = messageID.String
+	l.Details = details.String
+	l.Folder = folder.String
+	if emailDetailID.Valid {
+		l.EmailDetailID = &emailDetailID.Int64
+	}
+	if appliedAt.Valid {
+		l.AppliedAt = &appliedAt.Time
+	}
+	if modelScore.Valid {
+		l.ModelScore = &modelScore.Float64
+	}
+	return &l, nil
+}
+
+// GetActionLogs returns a page of the log for account, newest first; an empty
+// account returns every entry
+func (db *DB) GetActionLogs(account string, limit, offset int) ([]ActionLog, error) {
+	where, args := forAccount("account", account)
+	rows, err := db.conn.Query(
+		"SELECT "+actionLogColumns+" FROM action_log WHERE "+where+" ORDER BY created_at DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []ActionLog
+	for rows.Next() {
+		l, err := scanActionLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, *l)
+	}
+	return logs, rows.Err()
+}
+
+func (db *DB) GetActionLogByID(id int64) (*ActionLog, error) {
+	l, err := scanActionLog(db.conn.QueryRow(
+		"SELECT "+actionLogColumns+" FROM action_log WHERE id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// HasPendingSimulation reports whether a simulated action for messageID in
+// account is still waiting to be applied
+func (db *DB) HasPendingSimulation(account, messageID string) (bool, error) {
+	var count int
+	err := db.conn.QueryRow(
+		"SELECT COUNT(*) FROM action_log WHERE action IN (?, ?) AND message_id = ? AND account = ? AND applied_at IS NULL",
+		ActionWouldDelete, ActionWouldDeleteMarketing, messageID, account,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// IsRestored reports whether the user restored a message to the account's
+// mailbox from the dashboard
+func (db *DB) IsRestored(account, messageID string) (bool, error) {
+	if messageID == "" {
+		return false, nil
+	}
+	where, args := forAccount("account", account)
+	var count int
+	err := db.conn.QueryRow(
+		"SELECT COUNT(*) FROM action_log WHERE action = ? AND message_id = ? AND "+where,
+		append([]any{ActionRestoredEmail, messageID}, args...)...,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// MarkActionApplied records that a simulated action was carried out
+func (db *DB) MarkActionApplied(id int64) error {
+	_, err := db.conn.Exec("UPDATE action_log SET applied_at = ? WHERE id = ?", time.Now(), id)
+	return err
+}
+
+func (db *DB) GetActionLogCount(account string) (int, error) {
+	where, args := forAccount("account", account)
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM action_log WHERE "+where, args...).Scan(&count)
+	return count, err
+}
+
+// Quarantine operations
+
+// AddQuarantineEntry records that the email logged by actionLogID was moved to the quarantine folder
+func (db *DB) AddQuarantineEntry(actionLogID int64, messageID string) error {
+	_, err := db.conn.Exec(
+		"INSERT INTO quarantine (action_log_id, message_id, status, created_at) VALUES (?, ?, ?, ?)",
+		actionLogID, messageID, QuarantineStatusQuarantined, time.Now(),
+	)
+	return err
+}
+
+const quarantineColumns = `q.id, q.action_log_id, q.message_id, q.status, q.created_at,
+	l.sender, l.subject, l.details, l.email_detail_id, l.folder, l.account`
+
+func scanQuarantineEntry(row interface{ Scan(...any) error }) (*QuarantineEntry, error) {
+	var e QuarantineEntry
+	var subject, details, folder sql.NullString
+	var emailDetailID sql.NullInt64
+	err := row.Scan(&e.ID, &e.ActionLogID, &e.MessageID, &e.Status, &e.CreatedAt,
+		&e.Sender, &subject, &details, &emailDetailID, &folder, &e.Account)
+	if err != nil {
+		return nil, err
+	}
+	e.Subject = subject.String
+	e.Details = details.String
+	e.OriginalFolder = folder.String
+	if emailDetailID.Valid {
+		e.EmailDetailID = &emailDetailID.Int64
+	}
+	return &e, nil
+}
+
+func (db *DB) queryQuarantine(where string, args ...any) ([]QuarantineEntry, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+quarantineColumns+" FROM quarantine q JOIN action_log l ON l.id = q.action_log_id WHERE "+where+" ORDER BY q.created_at DESC",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []QuarantineEntry
+	for rows.Next() {
+		e, err := scanQuarantineEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// GetQuarantinedEmails returns emails of account that are still sitting in the
+// quarantine folder; an empty account returns those of every account
+func (db *DB) GetQuarantinedEmails(account string) ([]QuarantineEntry, error) {
+	where, args := forAccount("l.account", account)
+	return db.queryQuarantine("q.status = ? AND "+where, append([]any{QuarantineStatusQuarantined}, args...)...)
+}
+
+// GetExpiredQuarantine returns emails quarantined in exactly the given
+// accounts that are older than the specified number of days
+func (db *DB) GetExpiredQuarantine(olderThanDays int, accounts ...string) ([]QuarantineEntry, error) {
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -olderThanDays)
+	args := []any{QuarantineStatusQuarantined, cutoff}
+	for _, account := range accounts {
+		args = append(args, account)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(accounts)), ", ")
+	return db.queryQuarantine("q.status = ? AND q.created_at < ? AND l.account IN ("+placeholders+")", args...)
+}
+
+func (db *DB) GetQuarantineEntryByID(id int64) (*QuarantineEntry, error) {
+	e, err := scanQuarantineEntry(db.conn.QueryRow(
+		"SELECT "+quarantineColumns+" FROM quarantine q JOIN action_log l ON l.id = q.action_log_id WHERE q.id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ResolveQuarantineEntry marks a quarantined email as released or purged
+func (db *DB) ResolveQuarantineEntry(id int64, status string) error {
+	_, err := db.conn.Exec(
+		"UPDATE quarantine SET status = ?, resolved_at = ? WHERE id = ?",
+		status, time.Now(), id,
+	)
+	return err
+}
+
+// ClassifierCorrection operations
+
+// AddClassifierCorrection records that the classifier got an email wrong
+func (db *DB) AddClassifierCorrection(c *ClassifierCorrection) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO classifier_corrections (sender, subject, message_id, email_detail_id, is_transactional, source, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.Sender, c.Subject, c.MessageID, c.EmailDetailID, c.IsTransactional, c.Source, time.Now(),
+	)
+	return err
+}
+
+// GetClassifierCorrection returns the latest correction for a message, or nil
+func (db *DB) GetClassifierCorrection(messageID string) (*ClassifierCorrection, error) {
+	var c ClassifierCorrection
+	var subject, msgID sql.NullString
+	var emailDetailID sql.NullInt64
+	err := db.conn.QueryRow(
+		`SELECT id, sender, subject, message_id, email_detail_id, is_transactional, source, created_at
+		 FROM classifier_corrections WHERE message_id = ? ORDER BY id DESC LIMIT 1`, messageID,
+	).Scan(&c.ID, &c.Sender, &subject, &msgID, &emailDetailID, &c.IsTransactional, &c.Source, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Subject = subject.String
+	c.MessageID = msgID.String
+	if emailDetailID.Valid {
+		c.EmailDetailID = &emailDetailID.Int64
+	}
+	return &c, nil
+}
+
+// IsMarkedTransactional reports whether the user released a message from
+// quarantine or told the classifier it was transactional, so it must not be
+// filtered again
+func (db *DB) IsMarkedTransactional(messageID string) (bool, error) {
+	if messageID == "" {
+		return false, nil
+	}
+	var marked bool
+	err := db.conn.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM quarantine WHERE message_id = ? AND status = ?)
+		     OR EXISTS (SELECT 1 FROM classifier_corrections WHERE message_id = ? AND is_transactional = 1)`,
+		messageID, QuarantineStatusReleased, messageID,
+	).Scan(&marked)
+	return marked, err
+}
+
+// GetUntrainedCorrections returns corrections whose label the learned model
+// doesn't have yet, oldest first
+func (db *DB) GetUntrainedCorrections() ([]ClassifierCorrection, error) {
+	rows, err := db.conn.Query(
+		`SELECT c.id, c.sender, c.subject, c.message_id, c.email_detail_id, c.is_transactional, c.source, c.created_at
+		 FROM classifier_corrections c
+		 WHERE c.message_id IS NOT NULL AND c.message_id != ''
+		   AND c.id = (SELECT MAX(id) FROM classifier_corrections WHERE message_id = c.message_id)
+		   AND NOT EXISTS (SELECT 1 FROM model_documents d
+		                   WHERE d.message_id = c.message_id AND d.is_transactional = c.is_transactional)
+		 ORDER BY c.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var corrections []ClassifierCorrection
+	for rows.Next() {
+		var c ClassifierCorrection
+		var subject, msgID sql.NullString
+		var emailDetailID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Sender, &subject, &msgID, &emailDetailID, &c.IsTransactional, &c.Source, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Subject = subject.String
+		c.MessageID = msgID.String
+		if emailDetailID.Valid {
+			c.EmailDetailID = &emailDetailID.Int64
+		}
+		corrections = append(corrections, c)
+	}
+	return corrections, rows.Err()
+}
+
+// Learned model operations
+
+// GetUntrainedMarketingEmails returns stored emails that were filtered as
+// marketing and haven't been added to the learned model yet
+func (db *DB) GetUntrainedMarketingEmails(limit int) ([]EmailDetail, error) {
+	rows, err := db.conn.Query(
+		`SELECT DISTINCT `+emailDetailRowColumns+`
+		 FROM email_details e
+		 JOIN action_log a ON a.email_detail_id = e.id
+		 WHERE (a.action IN (?, ?) OR (a.action = ? AND a.applied_at IS NOT NULL))
+		   AND e.message_id IS NOT NULL AND e.message_id != ''
+		   AND NOT EXISTS (SELECT 1 FROM model_documents d WHERE d.message_id = e.message_id)
+		 ORDER BY e.id LIMIT ?`,
+		ActionDeletedMarketing, ActionQuarantined, ActionWouldDeleteMarketing, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []EmailDetail
+	for rows.Next() {
+		var d EmailDetail
+		if err := scanEmailDetailRow(rows, &d); err != nil {
+			return nil, err
+		}
+		details = append(details, d)
+	}
+	return details, rows.Err()
+}
+
+// emailDetailRowColumns are the email_details columns read by
+// scanEmailDetailRow, qualified with the alias e
+const emailDetailRowColumns = "e.id, e.message_id, e.sender, e.sender_name, e.recipients, e.subject, e.date, e.headers, e.body_text, e.body_html, e.has_attachments, e.created_at"
+
+// scanEmailDetailRow reads emailDetailRowColumns followed by any extra columns
+func scanEmailDetailRow(row interface{ Scan(...any) error }, d *EmailDetail, extra ...any) error {
+	var messageID, sender, senderName, recipients, subject, date, headers, bodyText, bodyHTML sql.NullString
+	var hasAttachments int
+	dest := append([]any{&d.ID, &messageID, &sender, &senderName, &recipients, &subject, &date, &headers,
+		&bodyText, &bodyHTML, &hasAttachments, &d.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	d.MessageID = messageID.String
+	d.Sender = sender.String
+	d.SenderName = senderName.String
+	d.Recipients = recipients.String
+	d.Subject = subject.String
+	d.Date = date.String
+	d.Headers = headers.String
+	d.BodyText = bodyText.String
+	d.BodyHTML = bodyHTML.String
+	d.HasAttachments = hasAttachments == 1
+	return nil
+}
+
+// GetLabeledEmails returns stored emails with a known label: emails the user
+// corrected get the correction's label, and emails filtered as marketing
+// without a correction count as marketing
+func (db *DB) GetLabeledEmails() ([]LabeledEmail, error) {
+	rows, err := db.conn.Query(
+		`SELECT `+emailDetailRowColumns+`, c.is_transactional
+		 FROM classifier_corrections c
+		 JOIN email_details e ON e.id = c.email_detail_id
+		 WHERE c.id = (SELECT MAX(id) FROM classifier_corrections WHERE message_id = c.message_id)
+		 UNION
+		 SELECT DISTINCT `+emailDetailRowColumns+`, 0
+		 FROM email_details e
+		 JOIN action_log a ON a.email_detail_id = e.id
+		 WHERE (a.action IN (?, ?) OR (a.action = ? AND a.applied_at IS NOT NULL))
+		   AND NOT EXISTS (SELECT 1 FROM classifier_corrections c WHERE c.message_id = e.message_id)
+		 ORDER BY 1`,
+		ActionDeletedMarketing, ActionQuarantined, ActionWouldDeleteMarketing,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labeled []LabeledEmail
+	for rows.Next() {
+		var l LabeledEmail
+		if err := scanEmailDetailRow(rows, &l.Email, &l.IsTransactional); err != nil {
+			return nil, err
+		}
+		labeled = append(labeled, l)
+	}
+	return labeled, rows.Err()
+}
+
+// TrainModel adds a message's tokens to the learned model under a label. A
+// message trained before with the other label is moved over, so corrections
+// override earlier guesses; retraining with the same label does nothing.
+func (db *DB) TrainModel(messageID string, tokens []string, transactional bool) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prevTransactional bool
+	var prevTokens string
+	err = tx.QueryRow(
+		"SELECT is_transactional, tokens FROM model_documents WHERE message_id = ?", messageID,
+	).Scan(&prevTransactional, &prevTokens)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(
+			"INSERT INTO model_documents (message_id, is_transactional, tokens, trained_at) VALUES (?, ?, ?, ?)",
+			messageID, transactional, strings.Join(tokens, " "), time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case prevTransactional == transactional:
+		return nil
+	default:
+		// Undo the earlier label before applying the new one
+		if err := adjustTokenCounts(tx, strings.Fields(prevTokens), prevTransactional, -1); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"UPDATE model_documents SET is_transactional = ?, tokens = ?, trained_at = ? WHERE message_id = ?",
+			transactional, strings.Join(tokens, " "), time.Now(), messageID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := adjustTokenCounts(tx, tokens, transactional, 1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func adjustTokenCounts(tx *sql.Tx, tokens []string, transactional bool, delta int) error {
+	column := "marketing"
+	if transactional {
+		column = "transactional"
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		`INSERT INTO model_tokens (token, %[1]s) VALUES (?, MAX(?, 0))
+		 ON CONFLICT(token) DO UPDATE SET %[1]s = MAX(%[1]s + ?, 0)`, column))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, token := range tokens {
+		if _, err := stmt.Exec(token, delta, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenQueryBatch keeps IN lists below SQLite's bound parameter limit
+const tokenQueryBatch = 500
+
+// GetTokenCounts returns how many transactional and marketing messages each
+// token appeared in; tokens the model has never seen are left out
+func (db *DB) GetTokenCounts(tokens []string) (map[string]TokenCount, error) {
+	counts := make(map[string]TokenCount)
+	for start := 0; start < len(tokens); start += tokenQueryBatch {
+		batch := tokens[start:min(start+tokenQueryBatch, len(tokens))]
+		args := make([]any, len(batch))
+		for i, token := range batch {
+			args[i] = token
+		}
+
+		rows, err := db.conn.Query(
+			"SELECT token, transactional, marketing FROM model_tokens WHERE token IN (?"+strings.Repeat(", ?", len(batch)-1)+")",
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var token string
+			var c TokenCount
+			if err := rows.Scan(&token, &c.Transactional, &c.Marketing); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[token] = c
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// GetModelTotals counts the messages the learned model was trained on
+func (db *DB) GetModelTotals() (ModelTotals, error) {
+	var t ModelTotals
+	err := db.conn.QueryRow(
+		`SELECT COALESCE(SUM(is_transactional), 0), COALESCE(SUM(1 - is_transactional), 0) FROM model_documents`,
+	).Scan(&t.Transactional, &t.Marketing)
+	return t, err
+}
+
+// PurgeOldEmailDetails deletes email details older than the specified number of days
+// along with their attachments and removes references from action_log entries
+func (db *DB) PurgeOldEmailDetails(olderThanDays int) (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -olderThanDays)
+
+	// First, clear references in action_log
+	_, err := db.conn.Exec(
+		`UPDATE action_log SET email_detail_id = NULL
+		 WHERE email_detail_id IN (SELECT id FROM email_details WHERE created_at < ?)`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear email references: %w", err)
+	}
+
+	_, err = db.conn.Exec(
+		`DELETE FROM attachments
+		 WHERE email_detail_id IN (SELECT id FROM email_details WHERE created_at < ?)`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old attachments: %w", err)
+	}
+
+	// Then delete old email details
+	result, err := db.conn.Exec(
+		"DELETE FROM email_details WHERE created_at < ?",
+		cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old email details: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Stats
+
+type Stats struct {
+	BlockedSendersCount           int
+	TransactionalOnlySendersCount int
+	AllowedSendersCount           int
+	QuarantinedCount              int
+	Model                         ModelTotals
+	TotalActionsCount             int
+	RecentActions                 []ActionLog
+}
+
+func (db *DB) GetStats() (*Stats, error) {
+	stats := &Stats{}
+
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM blocked_senders").Scan(&stats.BlockedSendersCount); err != nil {
+		return nil, err
+	}
+
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM transactional_only_senders").Scan(&stats.TransactionalOnlySendersCount); err != nil {
+		return nil, err
+	}
+
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM allowed_senders").Scan(&stats.AllowedSendersCount); err != nil {
+		return nil, err
+	}
+
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM quarantine WHERE status = ?", QuarantineStatusQuarantined).Scan(&stats.QuarantinedCount); err != nil {
+		return nil, err
+	}
+
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM action_log").Scan(&stats.TotalActionsCount); err != nil {
+		return nil, err
+	}
+
+	model, err := db.GetModelTotals()
+	if err != nil {
 		return nil, err
 	}
+	stats.Model = model
 
-	logs, err := db.GetActionLogs(10, 0)
+	logs, err := db.GetActionLogs("", 10, 0)
 	if err != nil {
 		return nil, err
 	}
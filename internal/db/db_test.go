@@ -0,0 +1,280 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"postal-inspection-service/internal/rules"
+)
+
+// firstRelease is the schema of the first release, with a rule of each kind
+// and a log entry
+const firstRelease = `
+	CREATE TABLE blocked_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE NOT NULL,
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE transactional_only_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE NOT NULL,
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE email_details (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT,
+		sender TEXT,
+		recipients TEXT,
+		subject TEXT,
+		date TEXT,
+		headers TEXT,
+		body_text TEXT,
+		body_html TEXT,
+		has_attachments INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE action_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		subject TEXT,
+		message_id TEXT,
+		details TEXT,
+		email_detail_id INTEGER,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email_detail_id) REFERENCES email_details(id)
+	);
+	CREATE INDEX idx_blocked_senders_email ON blocked_senders(email);
+	CREATE INDEX idx_transactional_only_senders_email ON transactional_only_senders(email);
+
+	INSERT INTO blocked_senders (id, email, reason) VALUES (3, 'spam@example.com', 'Added from USPIS/Block');
+	INSERT INTO transactional_only_senders (id, email, reason) VALUES (5, 'shop@example.com', 'Added from USPIS/Transactional Only');
+	INSERT INTO action_log (action, sender, subject) VALUES ('deleted_email', 'spam@example.com', 'Win big');
+`
+
+// beforeAccounts is the schema just before rules gained an account, with
+// folder state keyed by scope alone
+const beforeAccounts = `
+	CREATE TABLE blocked_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE NOT NULL,
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		simulate INTEGER NOT NULL DEFAULT 0,
+		match_type TEXT NOT NULL DEFAULT 'address'
+	);
+	CREATE TABLE transactional_only_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE NOT NULL,
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		simulate INTEGER NOT NULL DEFAULT 0,
+		match_type TEXT NOT NULL DEFAULT 'address'
+	);
+	CREATE TABLE allowed_senders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE NOT NULL,
+		match_type TEXT NOT NULL DEFAULT 'address',
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE action_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		subject TEXT,
+		message_id TEXT,
+		details TEXT,
+		email_detail_id INTEGER,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		folder TEXT
+	);
+	CREATE TABLE folder_state (
+		scope TEXT NOT NULL,
+		folder TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		last_uid INTEGER NOT NULL,
+		highest_modseq INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope, folder)
+	);
+	CREATE INDEX idx_blocked_senders_email ON blocked_senders(email);
+	CREATE INDEX idx_transactional_only_senders_email ON transactional_only_senders(email);
+	CREATE INDEX idx_allowed_senders_email ON allowed_senders(email);
+
+	INSERT INTO blocked_senders (id, email, reason, simulate, match_type) VALUES (3, 'example.com', 'Added from USPIS/Block Domain', 1, 'subdomains');
+	INSERT INTO transactional_only_senders (id, email, reason) VALUES (5, 'shop@example.com', 'Added from USPIS/Transactional Only');
+	INSERT INTO allowed_senders (id, email, reason) VALUES (7, 'boss@example.com', 'Added from USPIS/Allow');
+	INSERT INTO action_log (action, sender, subject, folder) VALUES ('deleted_email', 'spam@example.com', 'Win big', 'INBOX');
+	INSERT INTO folder_state (scope, folder, uid_validity, last_uid) VALUES ('blocked', 'INBOX', 1, 400);
+`
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name          string
+		schema        string
+		blocked       []BlockedSender
+		transactional []string
+		allowed       []string
+		logs          int
+		ordersSkipped bool
+	}{
+		{
+			name: "new database",
+		},
+		{
+			name:          "first release",
+			schema:        firstRelease,
+			blocked:       []BlockedSender{{ID: 3, Email: "spam@example.com", MatchType: rules.MatchAddress, Reason: "Added from USPIS/Block"}},
+			transactional: []string{"shop@example.com"},
+			logs:          1,
+			ordersSkipped: true,
+		},
+		{
+			name:          "before accounts",
+			schema:        beforeAccounts,
+			blocked:       []BlockedSender{{ID: 3, Email: "example.com", MatchType: rules.MatchSubdomains, Reason: "Added from USPIS/Block Domain", Simulate: true}},
+			transactional: []string{"shop@example.com"},
+			allowed:       []string{"boss@example.com"},
+			logs:          1,
+			ordersSkipped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			if tt.schema != "" {
+				conn, err := sql.Open("sqlite3", path)
+				if err != nil {
+					t.Fatalf("sql.Open: %v", err)
+				}
+				if _, err := conn.Exec(tt.schema); err != nil {
+					t.Fatalf("creating old schema: %v", err)
+				}
+				conn.Close()
+			}
+
+			database, err := New(path)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer database.Close()
+
+			blocked, err := database.GetBlockedSenders("")
+			if err != nil {
+				t.Fatalf("GetBlockedSenders: %v", err)
+			}
+			if len(blocked) != len(tt.blocked) {
+				t.Fatalf("blocked senders = %+v, want %+v", blocked, tt.blocked)
+			}
+			for i, got := range blocked {
+				want := tt.blocked[i]
+				if got.ID != want.ID || got.Email != want.Email || got.MatchType != want.MatchType ||
+					got.Reason != want.Reason || got.Simulate != want.Simulate || got.Account != "" || got.FolderScope != rules.ScopeAll {
+					t.Errorf("blocked sender = %+v, want %+v for every account and folder", got, want)
+				}
+			}
+
+			transactional, err := database.GetTransactionalOnlySenders("")
+			if err != nil {
+				t.Fatalf("GetTransactionalOnlySenders: %v", err)
+			}
+			if got := transactionalEmails(transactional); got != strings.Join(tt.transactional, ", ") {
+				t.Errorf("transactional-only senders = %q, want %q", got, tt.transactional)
+			}
+
+			allowed, err := database.GetAllowedSenders("")
+			if err != nil {
+				t.Fatalf("GetAllowedSenders: %v", err)
+			}
+			if len(allowed) != len(tt.allowed) || len(allowed) > 0 && allowed[0].Email != tt.allowed[0] {
+				t.Errorf("allowed senders = %+v, want %q", allowed, tt.allowed)
+			}
+
+			if logs, err := database.GetActionLogCount(""); err != nil || logs != tt.logs {
+				t.Errorf("GetActionLogCount = %d, %v; want %d", logs, err, tt.logs)
+			}
+
+			// Folder state from before accounts is dropped for a full rescan
+			states, _, err := database.GetFolderStates("", ScanScopeBlocked)
+			if err != nil || len(states) != 0 {
+				t.Errorf("GetFolderStates = %v, %v; want none", states, err)
+			}
+
+			overrides, err := database.GetFolderOverrides("")
+			if err != nil {
+				t.Fatalf("GetFolderOverrides: %v", err)
+			}
+			ordersSkipped := len(overrides) == 1 && overrides[0].Folder == "Orders" && overrides[0].Mode == FolderExclude
+			if ordersSkipped != tt.ordersSkipped || !ordersSkipped && len(overrides) > 0 {
+				t.Errorf("folder overrides = %+v, want Orders excluded: %v", overrides, tt.ordersSkipped)
+			}
+
+			// The rules are now unique per account
+			for _, want := range tt.blocked {
+				added, err := database.AddBlockedSender(&BlockedSender{Email: want.Email, MatchType: want.MatchType, Reason: "test", Account: "work"})
+				if err != nil || !added {
+					t.Errorf("AddBlockedSender for another account = %v, %v; want added", added, err)
+				}
+			}
+
+			// Migrating again changes nothing
+			before := dump(t, database)
+			if err := database.migrate(); err != nil {
+				t.Fatalf("second migrate: %v", err)
+			}
+			if after := dump(t, database); after != before {
+				t.Errorf("second migrate changed the database:\n%s\nwant:\n%s", after, before)
+			}
+		})
+	}
+}
+
+func transactionalEmails(senders []TransactionalOnlySender) string {
+	emails := make([]string, len(senders))
+	for i, s := range senders {
+		emails[i] = s.Email
+	}
+	return strings.Join(emails, ", ")
+}
+
+// dump describes the schema of a database and the number of rows in each table
+func dump(t *testing.T, database *DB) string {
+	t.Helper()
+	rows, err := database.conn.Query("SELECT type, name, COALESCE(sql, '') FROM sqlite_master ORDER BY type, name")
+	if err != nil {
+		t.Fatalf("reading schema: %v", err)
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	var tables []string
+	for rows.Next() {
+		var kind, name, schema string
+		if err := rows.Scan(&kind, &name, &schema); err != nil {
+			t.Fatalf("reading schema: %v", err)
+		}
+		fmt.Fprintf(&b, "%s %s: %s\n", kind, name, schema)
+		if kind == "table" {
+			tables = append(tables, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("reading schema: %v", err)
+	}
+
+	for _, table := range tables {
+		var count int
+		if err := database.conn.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %q", table)).Scan(&count); err != nil {
+			t.Fatalf("counting %s: %v", table, err)
+		}
+		fmt.Fprintf(&b, "%s: %d rows\n", table, count)
+	}
+	return b.String()
+}
@@ -1,36 +1,80 @@
 package db
 
-import "time"
+import (
+	"time"
+
+	"postal-inspection-service/internal/rules"
+)
 
 type BlockedSender struct {
-	ID        int64     `json:"id"`
-	Email     string    `json:"email"`
-	Reason    string    `json:"reason"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int64             `json:"id"`
+	Email         string            `json:"email"` // Address, domain or pattern depending on MatchType
+	MatchType     rules.MatchType   `json:"match_type"`
+	Reason        string            `json:"reason"`
+	Simulate      bool              `json:"simulate"` // Only record what would be deleted
+	Account       string            `json:"account"`  // Empty for every account
+	FolderScope   rules.FolderScope `json:"folder_scope"`
+	ExceptFolders []string          `json:"except_folders,omitempty"` // Folders left out with rules.ScopeExcept
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+// Rule returns the sender pattern of the rule
+func (s BlockedSender) Rule() rules.Rule {
+	return rules.Rule{Pattern: s.Email, Type: s.MatchType}
 }
 
 type TransactionalOnlySender struct {
-	ID        int64     `json:"id"`
-	Email     string    `json:"email"`
-	Reason    string    `json:"reason"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int64             `json:"id"`
+	Email         string            `json:"email"` // Address, domain or pattern depending on MatchType
+	MatchType     rules.MatchType   `json:"match_type"`
+	Reason        string            `json:"reason"`
+	Simulate      bool              `json:"simulate"` // Only record what would be deleted
+	Account       string            `json:"account"`  // Empty for every account
+	FolderScope   rules.FolderScope `json:"folder_scope"`
+	ExceptFolders []string          `json:"except_folders,omitempty"` // Folders left out with rules.ScopeExcept
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+// Rule returns the sender pattern of the rule
+func (s TransactionalOnlySender) Rule() rules.Rule {
+	return rules.Rule{Pattern: s.Email, Type: s.MatchType}
+}
+
+// AllowedSender is a protected sender that no rule may act on
+type AllowedSender struct {
+	ID        int64           `json:"id"`
+	Email     string          `json:"email"` // Address, domain or pattern depending on MatchType
+	MatchType rules.MatchType `json:"match_type"`
+	Reason    string          `json:"reason"`
+	Account   string          `json:"account"` // Empty for every account
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Rule returns the sender pattern of the rule
+func (s AllowedSender) Rule() rules.Rule {
+	return rules.Rule{Pattern: s.Email, Type: s.MatchType}
 }
 
 type ActionLog struct {
-	ID            int64     `json:"id"`
-	Action        string    `json:"action"`
-	Sender        string    `json:"sender"`
-	Subject       string    `json:"subject"`
-	MessageID     string    `json:"message_id"`
-	Details       string    `json:"details"`
-	EmailDetailID *int64    `json:"email_detail_id,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int64      `json:"id"`
+	Action        string     `json:"action"`
+	Sender        string     `json:"sender"`
+	Subject       string     `json:"subject"`
+	MessageID     string     `json:"message_id"`
+	Details       string     `json:"details"`
+	EmailDetailID *int64     `json:"email_detail_id,omitempty"`
+	Folder        string     `json:"folder,omitempty"`
+	AppliedAt     *time.Time `json:"applied_at,omitempty"`  // When a simulated action was carried out
+	ModelScore    *float64   `json:"model_score,omitempty"` // Learned model's probability that the email is transactional
+	Account       string     `json:"account,omitempty"`     // Mailbox acted on; empty for rule changes for every account
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 type EmailDetail struct {
 	ID             int64     `json:"id"`
 	MessageID      string    `json:"message_id"`
 	Sender         string    `json:"sender"`
+	SenderName     string    `json:"sender_name,omitempty"` // Decoded display name
 	Recipients     string    `json:"recipients"`
 	Subject        string    `json:"subject"`
 	Date           string    `json:"date"`
@@ -38,9 +82,153 @@ type EmailDetail struct {
 	BodyText       string    `json:"body_text"`
 	BodyHTML       string    `json:"body_html"`
 	HasAttachments bool      `json:"has_attachments"`
+	RawSource      []byte    `json:"-"` // Original RFC 822 message, nil for older entries
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Attachment describes a file attached to a stored email. Its content is in
+// the blob store under SHA256 when Stored is set.
+type Attachment struct {
+	ID            int64     `json:"id"`
+	EmailDetailID int64     `json:"email_detail_id"`
+	Filename      string    `json:"filename"`
+	ContentType   string    `json:"content_type"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Stored        bool      `json:"stored"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ArchivedMessage is the original source of a deleted email, kept in the
+// archive under SHA256
+type ArchivedMessage struct {
+	ID          int64     `json:"id"`
+	ActionLogID int64     `json:"action_log_id,omitempty"`
+	MessageID   string    `json:"message_id"`
+	Sender      string    `json:"sender"`
+	Subject     string    `json:"subject"`
+	Date        string    `json:"date"`
+	Folder      string    `json:"folder"`
+	Size        int64     `json:"size"` // Uncompressed
+	SHA256      string    `json:"sha256"`
+	ArchivedAt  time.Time `json:"archived_at"`
+}
+
+// ArchiveFilter selects archived messages. Zero fields match everything;
+// Sender is an address or a domain.
+type ArchiveFilter struct {
+	Since  time.Time
+	Until  time.Time
+	Sender string
+}
+
+// OAuthToken is the OAuth2 grant an account signs in to IMAP with. The
+// refresh token is replaced whenever the provider rotates it.
+type OAuthToken struct {
+	Account      string    `json:"account"`
+	AccessToken  string    `json:"-"`
+	RefreshToken string    `json:"-"`
+	Expiry       time.Time `json:"expiry"` // Zero if the provider didn't say
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// QuarantineEntry is an email held in the quarantine folder, joined with the
+// action log entry that put it there
+type QuarantineEntry struct {
+	ID             int64     `json:"id"`
+	ActionLogID    int64     `json:"action_log_id"`
+	MessageID      string    `json:"message_id"`
+	Status         string    `json:"status"`
+	Sender         string    `json:"sender"`
+	Subject        string    `json:"subject"`
+	Details        string    `json:"details"`
+	OriginalFolder string    `json:"original_folder"`
+	EmailDetailID  *int64    `json:"email_detail_id,omitempty"`
+	Account        string    `json:"account"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
+const (
+	QuarantineStatusQuarantined = "quarantined"
+	QuarantineStatusReleased    = "released"
+	QuarantineStatusPurged      = "purged"
+)
+
+// ClassifierCorrection records a user telling us the classifier was wrong
+type ClassifierCorrection struct {
+	ID              int64     `json:"id"`
+	Sender          string    `json:"sender"`
+	Subject         string    `json:"subject"`
+	MessageID       string    `json:"message_id"`
+	EmailDetailID   *int64    `json:"email_detail_id,omitempty"`
+	IsTransactional bool      `json:"is_transactional"`
+	Source          string    `json:"source"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Sources of classifier corrections
+const (
+	CorrectionSourceQuarantineRelease = "quarantine_release"
+	CorrectionSourceLogFeedback       = "log_feedback"
+	CorrectionSourceNotMarketing      = "not_marketing_folder"
+)
+
+// LabeledEmail is a stored email whose correct classification is known
+type LabeledEmail struct {
+	Email           EmailDetail
+	IsTransactional bool
+}
+
+// TokenCount is how many trained messages of each label contained a token
+type TokenCount struct {
+	Transactional int
+	Marketing     int
+}
+
+// ModelTotals is how many messages of each label the learned model was trained on
+type ModelTotals struct {
+	Transactional int
+	Marketing     int
+}
+
+// Total is the number of trained messages
+func (t ModelTotals) Total() int {
+	return t.Transactional + t.Marketing
+}
+
+// FolderState records how far a folder has been scanned for one rule set, so
+// routine polls only look at messages that arrived since
+type FolderState struct {
+	Account       string    `json:"account"`
+	Scope         string    `json:"scope"`
+	Folder        string    `json:"folder"`
+	UIDValidity   uint32    `json:"uid_validity"`
+	LastUID       uint32    `json:"last_uid"`
+	HighestModSeq uint64    `json:"highest_modseq"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// FolderOverride includes a folder the default policy skips in scanning, or
+// excludes one it would scan
+type FolderOverride struct {
+	Account   string    `json:"account"` // Empty for every account
+	Folder    string    `json:"folder"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Modes of a FolderOverride
+const (
+	FolderInclude = "include"
+	FolderExclude = "exclude"
+)
+
+// Scan scopes for FolderState
+const (
+	ScanScopeBlocked           = "blocked"
+	ScanScopeTransactionalOnly = "transactional_only"
+)
+
 const (
 	ActionBlockedSender            = "blocked_sender"
 	ActionDeletedEmail             = "deleted_email"
@@ -48,4 +236,19 @@ const (
 	ActionTransactionalOnlySender  = "transactional_only_sender"
 	ActionRemovedTransactionalOnly = "removed_transactional_only"
 	ActionDeletedMarketing         = "deleted_marketing"
+	ActionQuarantined              = "quarantined"
+	ActionReleasedQuarantine       = "released_quarantine"
+	ActionPurgedQuarantine         = "purged_quarantine"
+	ActionRestoredEmail            = "restored_email"
+	ActionWouldDelete              = "would_delete"
+	ActionWouldDeleteMarketing     = "would_delete_marketing"
+	ActionAllowedSender            = "allowed_sender"
+	ActionRemovedAllowed           = "removed_allowed"
+	ActionSkippedAllowlisted       = "skipped_allowlisted"
+	ActionMarkedTransactional      = "marked_transactional"
 )
+
+// IsSimulatedAction reports whether an action was only recorded by a dry run
+func IsSimulatedAction(action string) bool {
+	return action == ActionWouldDelete || action == ActionWouldDeleteMarketing
+}
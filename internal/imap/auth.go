@@ -0,0 +1,97 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-sasl"
+)
+
+// AuthMode selects how the client logs in
+type AuthMode string
+
+const (
+	// AuthPassword logs in with LOGIN and a password or app password
+	AuthPassword AuthMode = "password"
+	// AuthXOAuth2 authenticates with an OAuth2 access token using the
+	// XOAUTH2 mechanism understood by Gmail and Microsoft 365
+	AuthXOAuth2 AuthMode = "xoauth2"
+	// AuthOAuthBearer authenticates with an OAuth2 access token using the
+	// standard OAUTHBEARER mechanism (RFC 7628)
+	AuthOAuthBearer AuthMode = "oauthbearer"
+)
+
+// ParseAuthMode validates an authentication mode name
+func ParseAuthMode(s string) (AuthMode, error) {
+	switch mode := AuthMode(s); mode {
+	case AuthPassword, AuthXOAuth2, AuthOAuthBearer:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown auth mode %q (want password, xoauth2 or oauthbearer)", s)
+	}
+}
+
+// IsOAuth reports whether the mode signs in with an access token
+func (m AuthMode) IsOAuth() bool {
+	return m == AuthXOAuth2 || m == AuthOAuthBearer
+}
+
+// TokenSource supplies OAuth2 access tokens, refreshing them when they expire
+type TokenSource interface {
+	AccessToken() (string, error)
+}
+
+// Credentials are what a session logs in with
+type Credentials struct {
+	Mode     AuthMode // Empty means AuthPassword
+	Username string
+	Password string
+	Tokens   TokenSource // Required for the OAuth2 modes
+	// Server and Port are sent along with OAUTHBEARER tokens
+	Server string
+	Port   int
+}
+
+// Authenticate logs client in with creds
+func Authenticate(client *imapclient.Client, creds Credentials) error {
+	if !creds.Mode.IsOAuth() {
+		return client.Login(creds.Username, creds.Password).Wait()
+	}
+	if creds.Tokens == nil {
+		return fmt.Errorf("no token source for %s", creds.Mode)
+	}
+
+	token, err := creds.Tokens.AccessToken()
+	if err != nil {
+		return err
+	}
+	var saslClient sasl.Client
+	if creds.Mode == AuthXOAuth2 {
+		saslClient = &xoauth2Client{username: creds.Username, token: token}
+	} else {
+		saslClient = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: creds.Username,
+			Token:    token,
+			Host:     creds.Server,
+			Port:     creds.Port,
+		})
+	}
+	return client.Authenticate(saslClient)
+}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism, which go-sasl lacks.
+// See https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// Next answers the JSON error the server sends when the token is rejected
+// with an empty response, after which the server fails the command
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
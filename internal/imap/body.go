@@ -0,0 +1,150 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+)
+
+// maxPartDepth bounds how deeply nested multiparts and attached messages are
+// followed
+const maxPartDepth = 10
+
+// messageBody is what is taken from a message's parts: the first plain text
+// and HTML bodies found, and everything else as attachments
+type messageBody struct {
+	text, html  string
+	attachments []Attachment
+}
+
+// parseContent fills in the headers and bodies of a raw RFC 822 message.
+// Transfer encodings and charsets are decoded; a message that is cut short,
+// such as a partial fetch, gives whatever could be read.
+func parseContent(email *FetchedEmail, raw []byte) error {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if entity == nil {
+		return err
+	}
+	if err != nil {
+		log.Printf("Unsupported encoding in message %s, reading it as is: %v", email.MessageID, err)
+	}
+
+	var headerLines []string
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		headerLines = append(headerLines, fmt.Sprintf("%s: %s", fields.Key(), DecodeHeader(fields.Value())))
+	}
+	email.Headers = strings.Join(headerLines, "\n")
+
+	var body messageBody
+	body.read(entity, 0)
+	email.BodyText = body.text
+	email.BodyHTML = body.html
+	email.Attachments = body.attachments
+	email.HasAttachments = len(body.attachments) > 0
+	return nil
+}
+
+// read walks an entity and its parts. Parts marked as attachments and
+// anything that isn't text are counted as attachments; text nested in
+// forwarded messages is used when the outer message has none of its own.
+func (b *messageBody) read(entity *message.Entity, depth int) {
+	mediaType, typeParams, err := entity.Header.ContentType()
+	if err != nil || mediaType == "" {
+		mediaType = "text/plain"
+	}
+	disposition, dispositionParams, _ := entity.Header.ContentDisposition()
+
+	if disposition == "attachment" {
+		b.attach(entity, mediaType, dispositionParams["filename"], typeParams["name"])
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxPartDepth {
+			return
+		}
+		mr := entity.MultipartReader()
+		for {
+			// Errors here are mostly messages cut short; keep what was read
+			part, _ := mr.NextPart()
+			if part == nil {
+				return
+			}
+			b.read(part, depth+1)
+		}
+
+	case mediaType == "message/rfc822" || mediaType == "message/global":
+		if depth >= maxPartDepth {
+			return
+		}
+		inner, err := message.Read(entity.Body)
+		if inner == nil {
+			log.Printf("Error reading attached message: %v", err)
+			return
+		}
+		b.read(inner, depth+1)
+
+	case mediaType == "text/plain":
+		if b.text == "" {
+			b.text = readText(entity)
+		}
+
+	case mediaType == "text/html":
+		if b.html == "" {
+			b.html = readText(entity)
+		}
+
+	default:
+		// Images, PDFs, calendar invites and so on, inline or not
+		b.attach(entity, mediaType, dispositionParams["filename"], typeParams["name"])
+	}
+}
+
+// attach records a part as an attachment, named by whichever filename the
+// sender gave. Text attachments have been converted to UTF-8 like bodies.
+func (b *messageBody) attach(entity *message.Entity, mediaType string, names ...string) {
+	var filename string
+	for _, name := range names {
+		if name != "" {
+			filename = DecodeHeader(name)
+			break
+		}
+	}
+	// A part cut short still counts as an attachment
+	data, _ := io.ReadAll(entity.Body)
+	b.attachments = append(b.attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+	})
+}
+
+// readText reads a text part, which go-message has already converted to
+// UTF-8. Text in a charset it doesn't know, or without a charset when it
+// isn't UTF-8, is read as Windows-1252 so it comes out legible.
+func readText(entity *message.Entity) string {
+	data, err := io.ReadAll(entity.Body)
+	if err != nil && len(data) == 0 {
+		return ""
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	r, err := charset.Reader("windows-1252", bytes.NewReader(data))
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
@@ -0,0 +1,146 @@
+package imap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMessageBodies(t *testing.T) {
+	tests := []struct {
+		file string
+
+		subject     string
+		fromName    string
+		text        []string // Substrings BodyText must contain
+		html        []string // Substrings BodyHTML must contain
+		noText      bool
+		noHTML      bool
+		attachments []string // Attachment filenames, in order
+		headers     []string // Substrings Headers must contain
+	}{
+		{
+			file:     "plain-qp-latin1.eml",
+			subject:  "Votre commande a été expédiée",
+			fromName: "Boutique Élégante",
+			text:     []string{"Votre commande n° 402-7731 a été expédiée.", "Montant payé : 89,90 €"},
+			noHTML:   true,
+			headers:  []string{"Subject: Votre commande a été expédiée", "From: Boutique Élégante <commandes@boutique.example.fr>"},
+		},
+		{
+			file:     "html-base64-utf8.eml",
+			subject:  "Versandbestätigung",
+			fromName: "Versand",
+			html:     []string{"Hallo Jürgen,", "Sendungsnummer: 00340434161094022115"},
+			noText:   true,
+		},
+		{
+			file:     "alternative-windows1252.eml",
+			subject:  "Summer sale",
+			fromName: "Outfitters",
+			text:     []string{"Don’t miss our summer sale – 30% off everything!"},
+			// The soft line break must be joined back up
+			html:    []string{"<h1>Don’t miss our summer sale – 30% off everything!</h1>", "quoted-printable encoding. This long line"},
+			headers: []string{"List-Unsubscribe: <https://outfitters.example.com/u/abc>"},
+		},
+		{
+			file:        "mixed-related-attachment.eml",
+			subject:     "Your invoice for May",
+			text:        []string{"Amount due: $84.12"},
+			html:        []string{`<img src="cid:logo@utility">`},
+			attachments: []string{"logo.png", "invoice-2024-05.pdf"},
+		},
+		{
+			file:     "forwarded-rfc822.eml",
+			subject:  "Fwd: Booking confirmation",
+			fromName: "Pat",
+			text:     []string{"See below for the hotel details."},
+			html:     []string{"Reservation code: QX7PLM"},
+		},
+		{
+			file:     "forwarded-only.eml",
+			subject:  "Fwd: Ihre Rechnung",
+			fromName: "Pat",
+			text:     []string{"Ihre Rechnung für Mai steht bereit."},
+			noHTML:   true,
+		},
+		{
+			file:    "unknown-charset.eml",
+			subject: "Rebajas",
+			text:    []string{"¡Rebajas de verano! Envío gratis a partir de 30€."},
+		},
+		{
+			file:    "iso-2022-jp.eml",
+			subject: "ご注文の確認",
+			text:    []string{"ご注文ありがとうございます。注文番号: 2024-0611"},
+		},
+		{
+			file:    "no-content-type.eml",
+			subject: "Security alert",
+			text:    []string{"A new device signed in to your account."},
+			noHTML:  true,
+		},
+		{
+			// Cut off partway through the HTML part, like a partial fetch
+			file:    "truncated.eml",
+			subject: "Top picks for you",
+			text:    []string{"Top picks for you — shop now"},
+			html:    []string{"<html><body><p>Top picks for you, shop now and save.</p>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			email, err := ParseMessage(raw)
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+
+			if email.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", email.Subject, tt.subject)
+			}
+			if email.FromName != tt.fromName {
+				t.Errorf("FromName = %q, want %q", email.FromName, tt.fromName)
+			}
+			for _, want := range tt.text {
+				if !strings.Contains(email.BodyText, want) {
+					t.Errorf("BodyText = %q, want it to contain %q", email.BodyText, want)
+				}
+			}
+			for _, want := range tt.html {
+				if !strings.Contains(email.BodyHTML, want) {
+					t.Errorf("BodyHTML = %q, want it to contain %q", email.BodyHTML, want)
+				}
+			}
+			if tt.noText && email.BodyText != "" {
+				t.Errorf("BodyText = %q, want none", email.BodyText)
+			}
+			if tt.noHTML && email.BodyHTML != "" {
+				t.Errorf("BodyHTML = %q, want none", email.BodyHTML)
+			}
+			if email.HasAttachments != (len(tt.attachments) > 0) {
+				t.Errorf("HasAttachments = %v, want %v", email.HasAttachments, len(tt.attachments) > 0)
+			}
+			var names []string
+			for _, a := range email.Attachments {
+				names = append(names, a.Filename)
+				if len(a.Data) == 0 {
+					t.Errorf("attachment %q is empty", a.Filename)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.attachments, ",") {
+				t.Errorf("attachments = %q, want %q", names, tt.attachments)
+			}
+			for _, want := range tt.headers {
+				if !strings.Contains(email.Headers, want) {
+					t.Errorf("Headers = %q, want them to contain %q", email.Headers, want)
+				}
+			}
+		})
+	}
+}
@@ -2,23 +2,31 @@ package imap
 
 import (
 	"bytes"
-	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"mime"
-	"mime/multipart"
 	"net/mail"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+
+	"postal-inspection-service/internal/rules"
 )
 
 // Folder paths for USPIS
 const (
 	FolderBlock             = "USPIS/Block"
 	FolderTransactionalOnly = "USPIS/Transactional Only"
+	FolderQuarantine        = "USPIS/Quarantine"
+	FolderAllow             = "USPIS/Allow"
+	FolderNotMarketing      = "USPIS/Not Marketing"
+
+	// Emails dropped here create a rule for the sender's whole domain
+	FolderBlockDomain             = "USPIS/Block Domain"
+	FolderTransactionalOnlyDomain = "USPIS/Transactional Only Domain"
 )
 
 // Email represents a simplified email message
@@ -35,6 +43,7 @@ type FetchedEmail struct {
 	UID            uint32
 	MessageID      string
 	From           string
+	FromName       string // Decoded display name of the sender, if any
 	To             string
 	Subject        string
 	Date           string
@@ -42,40 +51,117 @@ type FetchedEmail struct {
 	BodyText       string
 	BodyHTML       string
 	HasAttachments bool
+	Attachments    []Attachment
+	Raw            []byte // Original RFC 822 source
+}
+
+// Attachment is a part of a message other than its text and HTML bodies
+type Attachment struct {
+	Filename    string // Empty if the sender didn't name it
+	ContentType string // Media type without parameters, e.g. "application/pdf"
+	Data        []byte // Decoded content
 }
 
-// Client wraps IMAP operations for iCloud
+// Options tunes how the client talks to the server
+type Options struct {
+	// MaxConnections caps the pooled sessions open at once; IDLE sessions are not counted
+	MaxConnections int
+	// ServerSearch finds sender matches with IMAP SEARCH instead of downloading
+	// every envelope. It falls back to client-side filtering if SEARCH fails.
+	ServerSearch bool
+	// DeleteMode chooses how messages are removed; empty means DeleteModeAuto
+	DeleteMode DeleteMode
+	// TLS chooses how the connection is secured; empty means TLSModeTLS
+	TLS TLSMode
+	// RootCAs verifies the server certificate; nil uses the system roots
+	RootCAs *x509.CertPool
+	// Auth chooses how to log in; empty means AuthPassword
+	Auth AuthMode
+	// Tokens supplies access tokens for the OAuth2 auth modes
+	Tokens TokenSource
+}
+
+// Client wraps IMAP operations for one mailbox
 type Client struct {
-	server   string
-	port     int
-	email    string
-	password string
+	server       string
+	port         int
+	creds        Credentials
+	tlsMode      TLSMode
+	rootCAs      *x509.CertPool
+	serverSearch bool
+	deleteMode   DeleteMode
+	pool         *sessionPool
+
+	mu            sync.Mutex
+	trash         string
+	trashLookedUp bool
 }
 
-// NewClient creates a new IMAP client configuration
-func NewClient(server string, port int, email, password string) *Client {
-	return &Client{
-		server:   server,
-		port:     port,
-		email:    email,
-		password: password,
+// NewClient creates a new IMAP client configuration. password is ignored
+// when opts.Auth is an OAuth2 mode.
+func NewClient(server string, port int, username, password string, opts Options) *Client {
+	c := &Client{
+		server: server,
+		port:   port,
+		creds: Credentials{
+			Mode:     opts.Auth,
+			Username: username,
+			Password: password,
+			Tokens:   opts.Tokens,
+			Server:   server,
+			Port:     port,
+		},
+		tlsMode:      opts.TLS,
+		rootCAs:      opts.RootCAs,
+		serverSearch: opts.ServerSearch,
+		deleteMode:   opts.DeleteMode,
+	}
+	if c.deleteMode == "" {
+		c.deleteMode = DeleteModeAuto
 	}
+	c.pool = newSessionPool(opts.MaxConnections, c.connect)
+	return c
+}
+
+// Close logs out all pooled sessions
+func (c *Client) Close() {
+	c.pool.close()
+}
+
+// PoolStats returns counters for session reuse versus re-establishment
+func (c *Client) PoolStats() PoolStats {
+	return c.pool.stats()
+}
+
+// acquire checks out a logged-in session from the pool. It must be handed back
+// with release.
+func (c *Client) acquire() (*imapclient.Client, error) {
+	return c.pool.get()
+}
+
+// release returns a session to the pool
+func (c *Client) release(client *imapclient.Client) {
+	c.pool.put(client)
 }
 
 // connect establishes a connection to the IMAP server
 func (c *Client) connect() (*imapclient.Client, error) {
-	addr := fmt.Sprintf("%s:%d", c.server, c.port)
+	return c.connectWithOptions(&imapclient.Options{})
+}
 
-	client, err := imapclient.DialTLS(addr, &imapclient.Options{
-		TLSConfig: &tls.Config{
-			ServerName: c.server,
-		},
-	})
+// connectWithOptions dials and logs in using the given client options. The TLS
+// configuration is always filled in from the client settings.
+func (c *Client) connectWithOptions(options *imapclient.Options) (*imapclient.Client, error) {
+	if options.WordDecoder == nil {
+		options.WordDecoder = wordDecoder
+	}
+
+	client, err := Dial(c.server, c.port, c.tlsMode, c.rootCAs, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	if err := client.Login(c.email, c.password).Wait(); err != nil {
+	if err := Authenticate(client, c.creds); err != nil {
 		client.Close()
 		return nil, fmt.Errorf("failed to login: %w", err)
 	}
@@ -83,41 +169,15 @@ func (c *Client) connect() (*imapclient.Client, error) {
 	return client, nil
 }
 
-// ListFolders returns all folders in the mailbox
-func (c *Client) ListFolders() ([]string, error) {
-	client, err := c.connect()
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-
-	listCmd := client.List("", "*", nil)
-	var folders []string
-
-	for {
-		mbox := listCmd.Next()
-		if mbox == nil {
-			break
-		}
-		folders = append(folders, mbox.Mailbox)
-	}
-
-	if err := listCmd.Close(); err != nil {
-		return nil, fmt.Errorf("failed to list folders: %w", err)
-	}
-
-	return folders, nil
-}
-
 // CreateUSPISFolders ensures the USPIS folder structure exists
 func (c *Client) CreateUSPISFolders() error {
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer c.release(client)
 
-	folders := []string{"USPIS", FolderBlock, FolderTransactionalOnly}
+	folders := []string{"USPIS", FolderBlock, FolderBlockDomain, FolderTransactionalOnly, FolderTransactionalOnlyDomain, FolderQuarantine, FolderAllow, FolderNotMarketing}
 
 	for _, folder := range folders {
 		// Try to select to check if exists
@@ -142,11 +202,11 @@ func (c *Client) CreateUSPISFolders() error {
 
 // fetchEmailsFromFolder is a helper to fetch all emails from a specific folder
 func (c *Client) fetchEmailsFromFolder(folder string) ([]Email, error) {
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	mbox, err := client.Select(folder, nil).Wait()
 	if err != nil {
@@ -190,7 +250,7 @@ func (c *Client) fetchEmailsFromFolder(folder string) ([]Email, error) {
 
 		if msgData.Envelope != nil {
 			email.MessageID = msgData.Envelope.MessageID
-			email.Subject = msgData.Envelope.Subject
+			email.Subject = DecodeHeader(msgData.Envelope.Subject)
 			if len(msgData.Envelope.From) > 0 {
 				from := msgData.Envelope.From[0]
 				email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
@@ -213,11 +273,11 @@ func (c *Client) deleteEmailsFromFolder(folder string, uids []uint32) error {
 		return nil
 	}
 
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	_, err = client.Select(folder, nil).Wait()
 	if err != nil {
@@ -231,17 +291,8 @@ func (c *Client) deleteEmailsFromFolder(folder string, uids []uint32) error {
 
 	uidSet := imap.UIDSetNum(imapUIDs...)
 
-	storeCmd := client.Store(uidSet, &imap.StoreFlags{
-		Op:    imap.StoreFlagsAdd,
-		Flags: []imap.Flag{imap.FlagDeleted},
-	}, nil)
-
-	if err := storeCmd.Close(); err != nil {
-		return fmt.Errorf("failed to mark as deleted: %w", err)
-	}
-
-	if err := client.Expunge().Close(); err != nil {
-		return fmt.Errorf("failed to expunge: %w", err)
+	if _, err := c.removeMessages(client, folder, uidSet); err != nil {
+		return err
 	}
 
 	return nil
@@ -278,11 +329,11 @@ func (c *Client) FetchEmailsFromSenders(folder string, senders []string) ([]Emai
 		return nil, nil
 	}
 
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	_, err = client.Select(folder, nil).Wait()
 	if err != nil {
@@ -335,7 +386,7 @@ func (c *Client) FetchEmailsFromSenders(folder string, senders []string) ([]Emai
 
 			if msgData.Envelope != nil {
 				email.MessageID = msgData.Envelope.MessageID
-				email.Subject = msgData.Envelope.Subject
+				email.Subject = DecodeHeader(msgData.Envelope.Subject)
 				if len(msgData.Envelope.From) > 0 {
 					from := msgData.Envelope.From[0]
 					email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
@@ -362,51 +413,88 @@ type FolderEmails struct {
 	Emails []Email
 }
 
-// ScanFoldersForSenders searches multiple folders for emails from specific senders using a single connection
-func (c *Client) ScanFoldersForSenders(folders []string, senders []string) ([]FolderEmails, error) {
-	if len(senders) == 0 || len(folders) == 0 {
-		return nil, nil
+// FolderState is the incremental scan position of a folder. A zero value
+// means the folder has never been scanned.
+type FolderState struct {
+	UIDValidity   uint32
+	LastUID       uint32
+	HighestModSeq uint64 // Only tracked when the server supports CONDSTORE
+}
+
+// ScanFoldersForSenders searches multiple folders for emails from specific senders using a single connection.
+// Only messages with a UID above the state recorded in since are examined; a folder without
+// state, or whose UIDVALIDITY changed, is scanned in full. The returned map holds the new
+// state of every folder that was scanned.
+func (c *Client) ScanFoldersForSenders(folders []string, senders *rules.Matcher, since map[string]FolderState) ([]FolderEmails, map[string]FolderState, error) {
+	if senders.Len() == 0 || len(folders) == 0 {
+		return nil, nil, nil
 	}
 
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
-	// Build a set of senders for fast lookup (lowercase)
-	senderSet := make(map[string]bool)
-	for _, s := range senders {
-		senderSet[strings.ToLower(s)] = true
-	}
+	// Glob and regex rules can't be expressed as a SEARCH, so every new
+	// message has to be checked locally
+	searchTerms, searchable := senders.SearchTerms()
+
+	condStore := client.Caps().Has(imap.CapCondStore)
+	searchFailed := false
 
 	var results []FolderEmails
-	var foldersScanned, totalEmails int
+	states := make(map[string]FolderState)
+	var foldersScanned, foldersSkipped, totalEmails int
 
 	for _, folder := range folders {
-		mbox, err := client.Select(folder, nil).Wait()
+		mbox, err := client.Select(folder, &imap.SelectOptions{CondStore: condStore}).Wait()
 		if err != nil {
 			log.Printf("Failed to select folder %s: %v", folder, err)
 			continue
 		}
-		foldersScanned++
 
-		// Skip empty folders
-		if mbox.NumMessages == 0 {
+		prev, known := since[folder]
+		plan := planFolderScan(prev, known, mbox, condStore)
+		if plan.rescan {
+			log.Printf("UIDVALIDITY of %s changed (%d -> %d), rescanning folder", folder, prev.UIDValidity, mbox.UIDValidity)
+		}
+		state := plan.state
+		if plan.skip {
+			states[folder] = state
+			foldersSkipped++
 			continue
 		}
+		foldersScanned++
 
-		// Fetch all emails in folder (just envelope - lightweight)
-		var seqSet imap.SeqSet
-		seqSet.AddRange(1, mbox.NumMessages)
+		// "n:*" always matches the last message, so UIDs we've already seen
+		// are filtered below.
+		var uidSet imap.UIDSet
+		uidSet.AddRange(imap.UID(plan.from+1), 0)
 
+		// Let the server find candidate messages; the envelopes are still
+		// checked below because FROM is a substring match
+		if c.serverSearch && searchable && !searchFailed {
+			matched, err := searchSenders(client, uidSet, searchTerms)
+			if err != nil {
+				log.Printf("Server-side SEARCH failed in %s, falling back to client-side filtering: %v", folder, err)
+				searchFailed = true
+			} else if len(matched) == 0 {
+				states[folder] = state
+				continue
+			} else {
+				uidSet = matched
+			}
+		}
+
+		// Fetch the envelopes of candidate emails (lightweight)
 		fetchOptions := &imap.FetchOptions{
 			UID:      true,
 			Flags:    true,
 			Envelope: true,
 		}
 
-		fetchCmd := client.Fetch(seqSet, fetchOptions)
+		fetchCmd := client.Fetch(uidSet, fetchOptions)
 
 		var folderEmails []Email
 		for {
@@ -420,6 +508,14 @@ func (c *Client) ScanFoldersForSenders(folders []string, senders []string) ([]Fo
 				continue
 			}
 
+			uid := uint32(msgData.UID)
+			if uid <= plan.from {
+				continue
+			}
+			if uid > state.LastUID {
+				state.LastUID = uid
+			}
+
 			// Extract sender email
 			var fromEmail string
 			if msgData.Envelope != nil && len(msgData.Envelope.From) > 0 {
@@ -427,16 +523,16 @@ func (c *Client) ScanFoldersForSenders(folders []string, senders []string) ([]Fo
 				fromEmail = strings.ToLower(fmt.Sprintf("%s@%s", from.Mailbox, from.Host))
 			}
 
-			// Check if sender is in our list
-			if fromEmail != "" && senderSet[fromEmail] {
+			// Check if sender matches one of the rules
+			if senders.Match(fromEmail) >= 0 {
 				email := Email{
-					UID:   uint32(msgData.UID),
+					UID:   uid,
 					Flags: flagsToStrings(msgData.Flags),
 					From:  fromEmail,
 				}
 				if msgData.Envelope != nil {
 					email.MessageID = msgData.Envelope.MessageID
-					email.Subject = msgData.Envelope.Subject
+					email.Subject = DecodeHeader(msgData.Envelope.Subject)
 				}
 				folderEmails = append(folderEmails, email)
 			}
@@ -444,7 +540,10 @@ func (c *Client) ScanFoldersForSenders(folders []string, senders []string) ([]Fo
 		}
 
 		if err := fetchCmd.Close(); err != nil {
+			// Leave the state untouched so the folder is retried next time
 			log.Printf("Error fetching from %s: %v", folder, err)
+		} else {
+			states[folder] = state
 		}
 
 		if len(folderEmails) > 0 {
@@ -455,30 +554,127 @@ func (c *Client) ScanFoldersForSenders(folders []string, senders []string) ([]Fo
 		}
 	}
 
-	log.Printf("Scan complete: checked %d emails across %d folders, %d folders had matches", totalEmails, foldersScanned, len(results))
-	return results, nil
+	log.Printf("Scan complete: checked %d new emails across %d folders (%d unchanged), %d folders had matches",
+		totalEmails, foldersScanned, foldersSkipped, len(results))
+	return results, states, nil
+}
+
+// folderScan is how a folder is scanned, decided from its state after the
+// last scan and what SELECT reports about it now
+type folderScan struct {
+	from   uint32      // Highest UID already scanned; 0 scans the folder in full
+	state  FolderState // State to record if no newer message turns up
+	skip   bool        // Nothing arrived since the last scan
+	rescan bool        // The UIDVALIDITY changed, so earlier UIDs mean nothing
 }
 
-// DeleteEmailsFromFolders deletes emails from multiple folders using a single connection
-func (c *Client) DeleteEmailsFromFolders(folderUIDs map[string][]uint32) error {
+// planFolderScan decides how to scan a folder. prev is its state from the
+// last scan, if known; condStore reports whether HIGHESTMODSEQ is tracked.
+func planFolderScan(prev FolderState, known bool, mbox *imap.SelectData, condStore bool) folderScan {
+	var plan folderScan
+	if known && prev.UIDValidity != mbox.UIDValidity {
+		plan.rescan = true
+		known = false
+	}
+	if !known {
+		prev = FolderState{}
+	}
+	plan.from = prev.LastUID
+
+	plan.state = FolderState{
+		UIDValidity:   mbox.UIDValidity,
+		LastUID:       prev.LastUID,
+		HighestModSeq: mbox.HighestModSeq,
+	}
+	if mbox.UIDNext > 0 && uint32(mbox.UIDNext)-1 > plan.state.LastUID {
+		plan.state.LastUID = uint32(mbox.UIDNext) - 1
+	}
+
+	unchanged := mbox.UIDNext > 0 && uint32(mbox.UIDNext)-1 <= prev.LastUID
+	if condStore && prev.HighestModSeq > 0 && mbox.HighestModSeq == prev.HighestModSeq {
+		unchanged = true
+	}
+	plan.skip = mbox.NumMessages == 0 || (known && unchanged)
+	return plan
+}
+
+// searchBatchSize caps the number of FROM keys OR'd into a single SEARCH so
+// the command stays within server line-length and complexity limits
+const searchBatchSize = 25
+
+// searchSenders runs UID SEARCH FROM queries for senders within uidRange on the
+// selected folder and returns the UIDs of all matches
+func searchSenders(client *imapclient.Client, uidRange imap.UIDSet, senders []string) (imap.UIDSet, error) {
+	var matched imap.UIDSet
+
+	for _, batch := range senderBatches(senders) {
+		criteria := fromCriteria(batch)
+		criteria.UID = []imap.UIDSet{uidRange}
+
+		data, err := client.UIDSearch(&criteria, nil).Wait()
+		if err != nil {
+			return nil, err
+		}
+		if uids := data.AllUIDs(); len(uids) > 0 {
+			matched.AddNum(uids...)
+		}
+	}
+
+	return matched, nil
+}
+
+// senderBatches splits senders into groups of at most searchBatchSize
+func senderBatches(senders []string) [][]string {
+	var batches [][]string
+	for start := 0; start < len(senders); start += searchBatchSize {
+		batches = append(batches, senders[start:min(start+searchBatchSize, len(senders))])
+	}
+	return batches
+}
+
+// fromCriteria builds a balanced OR tree of FROM keys so deep nesting is
+// avoided. senders must not be empty, as an empty tree matches everything.
+func fromCriteria(senders []string) imap.SearchCriteria {
+	if len(senders) == 1 {
+		return imap.SearchCriteria{
+			Header: []imap.SearchCriteriaHeaderField{{Key: "From", Value: senders[0]}},
+		}
+	}
+
+	mid := len(senders) / 2
+	return imap.SearchCriteria{
+		Or: [][2]imap.SearchCriteria{{fromCriteria(senders[:mid]), fromCriteria(senders[mid:])}},
+	}
+}
+
+// DeleteEmailsFromFolders deletes emails from multiple folders using a single
+// connection. It returns the folders whose emails were deleted, also when
+// deleting from others failed.
+func (c *Client) DeleteEmailsFromFolders(folderUIDs map[string][]uint32) ([]string, error) {
 	if len(folderUIDs) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
+	var deleted []string
+	var failed int
+	var firstErr error
 	for folder, uids := range folderUIDs {
 		if len(uids) == 0 {
 			continue
 		}
 
-		_, err = client.Select(folder, nil).Wait()
-		if err != nil {
+		if _, err := client.Select(folder, nil).Wait(); err != nil {
 			log.Printf("Failed to select folder %s for deletion: %v", folder, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
 
@@ -489,25 +685,28 @@ func (c *Client) DeleteEmailsFromFolders(folderUIDs map[string][]uint32) error {
 
 		uidSet := imap.UIDSetNum(imapUIDs...)
 
-		storeCmd := client.Store(uidSet, &imap.StoreFlags{
-			Op:    imap.StoreFlagsAdd,
-			Flags: []imap.Flag{imap.FlagDeleted},
-		}, nil)
-
-		if err := storeCmd.Close(); err != nil {
-			log.Printf("Failed to mark as deleted in %s: %v", folder, err)
-			continue
-		}
-
-		if err := client.Expunge().Close(); err != nil {
-			log.Printf("Failed to expunge in %s: %v", folder, err)
+		how, err := c.removeMessages(client, folder, uidSet)
+		if err != nil {
+			// An unsupported mode is the same for every folder and
+			// left to the caller to report
+			if !errors.Is(err, ErrDeleteUnsupported) {
+				log.Printf("Failed to delete emails in %s: %v", folder, err)
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
 
-		log.Printf("Deleted %d emails from %s", len(uids), folder)
+		log.Printf("Deleted %d emails from %s (%s)", len(uids), folder, how)
+		deleted = append(deleted, folder)
 	}
 
-	return nil
+	if failed > 0 {
+		return deleted, fmt.Errorf("failed to delete emails from %d folders: %w", failed, firstErr)
+	}
+	return deleted, nil
 }
 
 // FetchFullEmailsByUIDs fetches full email content for specific UIDs in a folder
@@ -516,11 +715,11 @@ func (c *Client) FetchFullEmailsByUIDs(folder string, uids []uint32) ([]FetchedE
 		return nil, nil
 	}
 
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	_, err = client.Select(folder, nil).Wait()
 	if err != nil {
@@ -555,56 +754,68 @@ func (c *Client) FetchFullEmailsByUIDs(folder string, uids []uint32) ([]FetchedE
 			continue
 		}
 
-		email := FetchedEmail{
-			UID: uint32(msgData.UID),
-		}
+		email := fetchedEmail(msgData, true)
+		emails = append(emails, email)
+	}
 
-		if msgData.Envelope != nil {
-			email.MessageID = msgData.Envelope.MessageID
-			email.Subject = msgData.Envelope.Subject
-			if !msgData.Envelope.Date.IsZero() {
-				email.Date = msgData.Envelope.Date.Format("2006-01-02 15:04:05")
-			}
-			if len(msgData.Envelope.From) > 0 {
-				from := msgData.Envelope.From[0]
-				email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
-			}
-			if len(msgData.Envelope.To) > 0 {
-				var tos []string
-				for _, to := range msgData.Envelope.To {
-					tos = append(tos, fmt.Sprintf("%s@%s", to.Mailbox, to.Host))
-				}
-				email.To = strings.Join(tos, ", ")
-			}
-		}
+	if err := fetchCmd.Close(); err != nil {
+		return nil, fmt.Errorf("fetch failed: %w", err)
+	}
 
-		// Parse body content
-		for _, section := range msgData.BodySection {
-			if len(section.Bytes) == 0 {
-				continue
-			}
-			parsed, parseErr := mail.ReadMessage(bytes.NewReader(section.Bytes))
-			if parseErr != nil {
-				log.Printf("Error parsing message: %v", parseErr)
-				continue
-			}
+	return emails, nil
+}
 
-			var headerLines []string
-			for key, values := range parsed.Header {
-				for _, value := range values {
-					headerLines = append(headerLines, fmt.Sprintf("%s: %s", key, value))
-				}
-			}
-			email.Headers = strings.Join(headerLines, "\n")
+// classifyFetchSize is how much of each message is downloaded for
+// classification: all headers and usually the first text part
+const classifyFetchSize = 64 * 1024
+
+// FetchEmailsForClassification fetches the headers and the start of the body
+// of specific UIDs in a folder, without marking them as read. Raw is not set
+// because the source may be truncated.
+func (c *Client) FetchEmailsForClassification(folder string, uids []uint32) ([]FetchedEmail, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	client, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(client)
+
+	if _, err := client.Select(folder, nil).Wait(); err != nil {
+		return nil, fmt.Errorf("failed to select folder %s: %w", folder, err)
+	}
+
+	imapUIDs := make([]imap.UID, len(uids))
+	for i, uid := range uids {
+		imapUIDs[i] = imap.UID(uid)
+	}
+
+	fetchOptions := &imap.FetchOptions{
+		UID:      true,
+		Envelope: true,
+		BodySection: []*imap.FetchItemBodySection{{
+			Peek:    true,
+			Partial: &imap.SectionPartial{Offset: 0, Size: classifyFetchSize},
+		}},
+	}
+
+	fetchCmd := client.Fetch(imap.UIDSetNum(imapUIDs...), fetchOptions)
 
-			bodyText, bodyHTML, hasAttachments := parseEmailBody(parsed)
-			email.BodyText = bodyText
-			email.BodyHTML = bodyHTML
-			email.HasAttachments = hasAttachments
+	var emails []FetchedEmail
+	for {
+		msg := fetchCmd.Next()
+		if msg == nil {
 			break
 		}
 
-		emails = append(emails, email)
+		msgData, err := msg.Collect()
+		if err != nil {
+			log.Printf("Error collecting message: %v", err)
+			continue
+		}
+		emails = append(emails, fetchedEmail(msgData, false))
 	}
 
 	if err := fetchCmd.Close(); err != nil {
@@ -614,6 +825,85 @@ func (c *Client) FetchFullEmailsByUIDs(folder string, uids []uint32) ([]FetchedE
 	return emails, nil
 }
 
+// fetchedEmail builds a FetchedEmail from the envelope and body section of a
+// fetched message. keepRaw stores the section as the original source.
+func fetchedEmail(msgData *imapclient.FetchMessageBuffer, keepRaw bool) FetchedEmail {
+	email := FetchedEmail{
+		UID: uint32(msgData.UID),
+	}
+
+	if msgData.Envelope != nil {
+		email.MessageID = msgData.Envelope.MessageID
+		email.Subject = DecodeHeader(msgData.Envelope.Subject)
+		if !msgData.Envelope.Date.IsZero() {
+			email.Date = msgData.Envelope.Date.Format("2006-01-02 15:04:05")
+		}
+		if len(msgData.Envelope.From) > 0 {
+			from := msgData.Envelope.From[0]
+			email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
+			email.FromName = DecodeHeader(from.Name)
+		}
+		if len(msgData.Envelope.To) > 0 {
+			var tos []string
+			for _, to := range msgData.Envelope.To {
+				tos = append(tos, formatAddress(to.Name, fmt.Sprintf("%s@%s", to.Mailbox, to.Host)))
+			}
+			email.To = strings.Join(tos, ", ")
+		}
+	}
+
+	// Parse body content
+	for _, section := range msgData.BodySection {
+		if len(section.Bytes) == 0 {
+			continue
+		}
+		if err := parseContent(&email, section.Bytes); err != nil {
+			log.Printf("Error parsing message: %v", err)
+			continue
+		}
+		if keepRaw {
+			email.Raw = section.Bytes
+		}
+		break
+	}
+
+	return email
+}
+
+// ParseMessage parses an RFC 822 message, such as a .eml file, into a
+// FetchedEmail the way a fetched message would be
+func ParseMessage(raw []byte) (*FetchedEmail, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	email := &FetchedEmail{
+		MessageID: strings.Trim(strings.TrimSpace(parsed.Header.Get("Message-Id")), "<>"),
+		From:      ParseEmailAddress(parsed.Header.Get("From")),
+		Subject:   DecodeHeader(parsed.Header.Get("Subject")),
+		Raw:       raw,
+	}
+	if from, err := addressParser.Parse(parsed.Header.Get("From")); err == nil {
+		email.FromName = from.Name
+	}
+	if date, err := parsed.Header.Date(); err == nil {
+		email.Date = date.Format("2006-01-02 15:04:05")
+	}
+	if to, err := addressParser.ParseList(parsed.Header.Get("To")); err == nil {
+		var tos []string
+		for _, addr := range to {
+			tos = append(tos, formatAddress(addr.Name, addr.Address))
+		}
+		email.To = strings.Join(tos, ", ")
+	}
+
+	if err := parseContent(email, raw); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
 func flagsToStrings(flags []imap.Flag) []string {
 	result := make([]string, len(flags))
 	for i, f := range flags {
@@ -628,7 +918,7 @@ func ParseEmailAddress(from string) string {
 		return ""
 	}
 
-	addr, err := mail.ParseAddress(from)
+	addr, err := addressParser.Parse(from)
 	if err == nil {
 		return strings.ToLower(addr.Address)
 	}
@@ -638,11 +928,11 @@ func ParseEmailAddress(from string) string {
 
 // FetchRecentEmailsWithFlags fetches the N most recent emails with all their flags for diagnostics
 func (c *Client) FetchRecentEmailsWithFlags(count int) ([]Email, error) {
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	mbox, err := client.Select("INBOX", nil).Wait()
 	if err != nil {
@@ -689,7 +979,7 @@ func (c *Client) FetchRecentEmailsWithFlags(count int) ([]Email, error) {
 
 		if msgData.Envelope != nil {
 			email.MessageID = msgData.Envelope.MessageID
-			email.Subject = msgData.Envelope.Subject
+			email.Subject = DecodeHeader(msgData.Envelope.Subject)
 			if len(msgData.Envelope.From) > 0 {
 				from := msgData.Envelope.From[0]
 				email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
@@ -708,11 +998,11 @@ func (c *Client) FetchRecentEmailsWithFlags(count int) ([]Email, error) {
 
 // FetchFullEmailsFromFolder fetches emails with full body content from a folder
 func (c *Client) FetchFullEmailsFromFolder(folder string) ([]FetchedEmail, error) {
-	client, err := c.connect()
+	client, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	defer c.release(client)
 
 	mbox, err := client.Select(folder, nil).Wait()
 	if err != nil {
@@ -747,58 +1037,7 @@ func (c *Client) FetchFullEmailsFromFolder(folder string) ([]FetchedEmail, error
 			continue
 		}
 
-		email := FetchedEmail{
-			UID: uint32(msgData.UID),
-		}
-
-		if msgData.Envelope != nil {
-			email.MessageID = msgData.Envelope.MessageID
-			email.Subject = msgData.Envelope.Subject
-			if !msgData.Envelope.Date.IsZero() {
-				email.Date = msgData.Envelope.Date.Format("2006-01-02 15:04:05")
-			}
-			if len(msgData.Envelope.From) > 0 {
-				from := msgData.Envelope.From[0]
-				email.From = fmt.Sprintf("%s@%s", from.Mailbox, from.Host)
-			}
-			if len(msgData.Envelope.To) > 0 {
-				var tos []string
-				for _, to := range msgData.Envelope.To {
-					tos = append(tos, fmt.Sprintf("%s@%s", to.Mailbox, to.Host))
-				}
-				email.To = strings.Join(tos, ", ")
-			}
-		}
-
-		// Parse body content (BodySection is []FetchBodySectionBuffer)
-		for _, section := range msgData.BodySection {
-			if len(section.Bytes) == 0 {
-				continue
-			}
-			parsed, parseErr := mail.ReadMessage(bytes.NewReader(section.Bytes))
-			if parseErr != nil {
-				log.Printf("Error parsing message: %v", parseErr)
-				continue
-			}
-
-			// Extract headers
-			var headerLines []string
-			for key, values := range parsed.Header {
-				for _, value := range values {
-					headerLines = append(headerLines, fmt.Sprintf("%s: %s", key, value))
-				}
-			}
-			email.Headers = strings.Join(headerLines, "\n")
-
-			// Parse body
-			bodyText, bodyHTML, hasAttachments := parseEmailBody(parsed)
-			email.BodyText = bodyText
-			email.BodyHTML = bodyHTML
-			email.HasAttachments = hasAttachments
-			break // Only process first body section
-		}
-
-		emails = append(emails, email)
+		emails = append(emails, fetchedEmail(msgData, true))
 	}
 
 	if err := fetchCmd.Close(); err != nil {
@@ -817,94 +1056,3 @@ func (c *Client) FetchFullEmailsFromBlockFolder() ([]FetchedEmail, error) {
 func (c *Client) FetchFullEmailsFromTransactionalOnlyFolder() ([]FetchedEmail, error) {
 	return c.FetchFullEmailsFromFolder(FolderTransactionalOnly)
 }
-
-// parseEmailBody extracts text and HTML body from an email, and detects attachments
-func parseEmailBody(msg *mail.Message) (bodyText, bodyHTML string, hasAttachments bool) {
-	contentType := msg.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "text/plain"
-	}
-
-	mediaType, params, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		// Try to read body as plain text
-		body, _ := io.ReadAll(msg.Body)
-		return string(body), "", false
-	}
-
-	if strings.HasPrefix(mediaType, "text/plain") {
-		body, _ := io.ReadAll(msg.Body)
-		return string(body), "", false
-	}
-
-	if strings.HasPrefix(mediaType, "text/html") {
-		body, _ := io.ReadAll(msg.Body)
-		return "", string(body), false
-	}
-
-	if strings.HasPrefix(mediaType, "multipart/") {
-		boundary := params["boundary"]
-		if boundary == "" {
-			body, _ := io.ReadAll(msg.Body)
-			return string(body), "", false
-		}
-
-		reader := multipart.NewReader(msg.Body, boundary)
-		return parseMultipart(reader)
-	}
-
-	// For other content types (like application/octet-stream), treat as attachment
-	return "", "", true
-}
-
-// parseMultipart recursively parses multipart content
-func parseMultipart(reader *multipart.Reader) (bodyText, bodyHTML string, hasAttachments bool) {
-	for {
-		part, err := reader.NextPart()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			break
-		}
-
-		contentType := part.Header.Get("Content-Type")
-		contentDisposition := part.Header.Get("Content-Disposition")
-
-		// Check if this is an attachment
-		if strings.Contains(contentDisposition, "attachment") {
-			hasAttachments = true
-			continue
-		}
-
-		mediaType, params, _ := mime.ParseMediaType(contentType)
-
-		if strings.HasPrefix(mediaType, "text/plain") && bodyText == "" {
-			body, _ := io.ReadAll(part)
-			bodyText = string(body)
-		} else if strings.HasPrefix(mediaType, "text/html") && bodyHTML == "" {
-			body, _ := io.ReadAll(part)
-			bodyHTML = string(body)
-		} else if strings.HasPrefix(mediaType, "multipart/") {
-			boundary := params["boundary"]
-			if boundary != "" {
-				subReader := multipart.NewReader(part, boundary)
-				subText, subHTML, subAttach := parseMultipart(subReader)
-				if bodyText == "" {
-					bodyText = subText
-				}
-				if bodyHTML == "" {
-					bodyHTML = subHTML
-				}
-				if subAttach {
-					hasAttachments = true
-				}
-			}
-		} else if contentDisposition != "" || !strings.HasPrefix(mediaType, "text/") {
-			// Non-text parts without explicit attachment disposition
-			// could be inline images, etc.
-			hasAttachments = true
-		}
-	}
-	return
-}
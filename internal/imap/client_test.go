@@ -0,0 +1,186 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestSenderBatches(t *testing.T) {
+	tests := []struct {
+		senders int
+		sizes   []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{25, []int{25}},
+		{26, []int{25, 1}},
+		{51, []int{25, 25, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.senders), func(t *testing.T) {
+			senders := make([]string, tt.senders)
+			for i := range senders {
+				senders[i] = fmt.Sprintf("sender%d@example.com", i)
+			}
+
+			batches := senderBatches(senders)
+			var sizes []int
+			var all []string
+			for _, batch := range batches {
+				sizes = append(sizes, len(batch))
+				all = append(all, batch...)
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.sizes) {
+				t.Errorf("batch sizes = %v, want %v", sizes, tt.sizes)
+			}
+			if strings.Join(all, " ") != strings.Join(senders, " ") {
+				t.Errorf("batches = %v, want every sender once in order", batches)
+			}
+		})
+	}
+}
+
+func TestFromCriteria(t *testing.T) {
+	tests := []struct {
+		senders int
+		depth   int // Levels of OR above the deepest FROM key
+	}{
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{25, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.senders), func(t *testing.T) {
+			senders := make([]string, tt.senders)
+			for i := range senders {
+				senders[i] = fmt.Sprintf("sender%d@example.com", i)
+			}
+
+			criteria := fromCriteria(senders)
+			keys, depth := flattenFrom(t, criteria)
+			if strings.Join(keys, " ") != strings.Join(senders, " ") {
+				t.Errorf("FROM keys = %v, want %v", keys, senders)
+			}
+			if depth != tt.depth {
+				t.Errorf("depth = %d, want %d", depth, tt.depth)
+			}
+		})
+	}
+}
+
+// flattenFrom returns the FROM keys of a criteria tree in order and the
+// depth of its OR nesting, failing if a node is neither a key nor an OR
+func flattenFrom(t *testing.T, c imap.SearchCriteria) ([]string, int) {
+	t.Helper()
+	switch {
+	case len(c.Header) == 1 && len(c.Or) == 0:
+		if c.Header[0].Key != "From" {
+			t.Fatalf("header key = %q, want From", c.Header[0].Key)
+		}
+		return []string{c.Header[0].Value}, 0
+	case len(c.Header) == 0 && len(c.Or) == 1:
+		left, leftDepth := flattenFrom(t, c.Or[0][0])
+		right, rightDepth := flattenFrom(t, c.Or[0][1])
+		return append(left, right...), max(leftDepth, rightDepth) + 1
+	default:
+		t.Fatalf("criteria %+v is neither a FROM key nor an OR", c)
+		return nil, 0
+	}
+}
+
+func TestPlanFolderScan(t *testing.T) {
+	seen := FolderState{UIDValidity: 7, LastUID: 100, HighestModSeq: 500}
+
+	tests := []struct {
+		name      string
+		prev      FolderState
+		known     bool
+		mbox      imap.SelectData
+		condStore bool
+		want      folderScan
+	}{
+		{
+			name: "never scanned",
+			mbox: imap.SelectData{NumMessages: 40, UIDNext: 121, UIDValidity: 7},
+			want: folderScan{from: 0, state: FolderState{UIDValidity: 7, LastUID: 120}},
+		},
+		{
+			name:  "nothing new",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 40, UIDNext: 101, UIDValidity: 7},
+			want:  folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 100}, skip: true},
+		},
+		{
+			name:  "new mail",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 42, UIDNext: 103, UIDValidity: 7},
+			want:  folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 102}},
+		},
+		{
+			name:  "uidvalidity changed",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 40, UIDNext: 41, UIDValidity: 8},
+			want:  folderScan{from: 0, state: FolderState{UIDValidity: 8, LastUID: 40}, rescan: true},
+		},
+		{
+			name:  "uidvalidity changed to a lower uidnext",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 40, UIDNext: 101, UIDValidity: 8},
+			want:  folderScan{from: 0, state: FolderState{UIDValidity: 8, LastUID: 100}, rescan: true},
+		},
+		{
+			name: "empty folder",
+			mbox: imap.SelectData{UIDNext: 1, UIDValidity: 7},
+			want: folderScan{from: 0, state: FolderState{UIDValidity: 7}, skip: true},
+		},
+		{
+			name:  "no uidnext",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 40, UIDValidity: 7},
+			want:  folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 100}},
+		},
+		{
+			name:      "highestmodseq unchanged",
+			prev:      seen,
+			known:     true,
+			mbox:      imap.SelectData{NumMessages: 40, UIDValidity: 7, HighestModSeq: 500},
+			condStore: true,
+			want:      folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 100, HighestModSeq: 500}, skip: true},
+		},
+		{
+			name:      "highestmodseq advanced",
+			prev:      seen,
+			known:     true,
+			mbox:      imap.SelectData{NumMessages: 41, UIDNext: 102, UIDValidity: 7, HighestModSeq: 510},
+			condStore: true,
+			want:      folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 101, HighestModSeq: 510}},
+		},
+		{
+			name:  "highestmodseq ignored without condstore",
+			prev:  seen,
+			known: true,
+			mbox:  imap.SelectData{NumMessages: 40, UIDValidity: 7, HighestModSeq: 500},
+			want:  folderScan{from: 100, state: FolderState{UIDValidity: 7, LastUID: 100, HighestModSeq: 500}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planFolderScan(tt.prev, tt.known, &tt.mbox, tt.condStore); got != tt.want {
+				t.Errorf("planFolderScan = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
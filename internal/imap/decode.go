@@ -0,0 +1,73 @@
+package imap
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/charset"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset go-message
+// knows, not just the UTF-8 and ISO-8859-1 the standard library handles
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// addressParser parses address headers with encoded display names
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// DecodeHeader decodes encoded words such as "=?UTF-8?B?...?=" in a header
+// value. Raw 8-bit values that aren't valid UTF-8 are read as Windows-1252,
+// which is what such senders almost always mean. Parts that can't be decoded
+// are left as they are.
+func DecodeHeader(value string) string {
+	if strings.Contains(value, "=?") {
+		if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+	}
+	if !utf8.ValidString(value) {
+		r, err := charset.Reader("windows-1252", strings.NewReader(value))
+		if err == nil {
+			if decoded, err := io.ReadAll(r); err == nil {
+				value = string(decoded)
+			}
+		}
+	}
+	return value
+}
+
+// formatAddress renders an address with its decoded display name, e.g.
+// "Zalando <info@zalando.de>"
+func formatAddress(name, address string) string {
+	name = DecodeHeader(name)
+	if name == "" {
+		return address
+	}
+	return fmt.Sprintf("%s <%s>", name, address)
+}
+
+// encodeAddress is the reverse of formatAddress for writing a header: a
+// non-ASCII display name is turned back into encoded words
+func encodeAddress(name, address string) string {
+	if name == "" {
+		return address
+	}
+	return (&mail.Address{Name: name, Address: address}).String()
+}
+
+// encodeAddressList re-encodes a list built by formatAddress. Entries that
+// don't parse are kept as they are.
+func encodeAddressList(list string) string {
+	addrs, err := addressParser.ParseList(list)
+	if err != nil {
+		return list
+	}
+	encoded := make([]string, len(addrs))
+	for i, a := range addrs {
+		encoded[i] = encodeAddress(a.Name, a.Address)
+	}
+	return strings.Join(encoded, ", ")
+}
@@ -0,0 +1,186 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// DeleteMode selects how messages are removed from a folder
+type DeleteMode string
+
+const (
+	// DeleteModeAuto picks the safest strategy the server supports, and
+	// never a full EXPUNGE
+	DeleteModeAuto DeleteMode = "auto"
+	// DeleteModeTrash moves messages to the special-use \Trash folder
+	DeleteModeTrash DeleteMode = "trash"
+	// DeleteModeUIDExpunge permanently removes only our own UIDs (UIDPLUS)
+	DeleteModeUIDExpunge DeleteMode = "uid-expunge"
+	// DeleteModeExpunge flags messages \Deleted and runs a full EXPUNGE, which
+	// also removes anything other clients flagged \Deleted in that folder.
+	// It also lets moves be emulated that way on servers without MOVE or
+	// UIDPLUS.
+	DeleteModeExpunge DeleteMode = "expunge"
+)
+
+// ErrDeleteUnsupported is wrapped by errors for a deletion mode the server
+// can't carry out, which stays that way until DELETE_MODE is changed
+var ErrDeleteUnsupported = errors.New("delete mode not supported by the server")
+
+// ParseDeleteMode validates a deletion mode name
+func ParseDeleteMode(s string) (DeleteMode, error) {
+	switch mode := DeleteMode(s); mode {
+	case DeleteModeAuto, DeleteModeTrash, DeleteModeUIDExpunge, DeleteModeExpunge:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown delete mode %q (want auto, trash, uid-expunge or expunge)", s)
+	}
+}
+
+// CheckDeleteMode reports whether the server supports the configured deletion
+// mode, so a misconfiguration can be shown once rather than on every delete
+func (c *Client) CheckDeleteMode() error {
+	client, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release(client)
+
+	_, _, err = c.deleteStrategy(client, "")
+	return err
+}
+
+// deleteStrategy resolves the configured deletion mode for messages in folder
+// to the mode the server supports and, for DeleteModeTrash, the Trash folder
+func (c *Client) deleteStrategy(client *imapclient.Client, folder string) (DeleteMode, string, error) {
+	canUIDExpunge := client.Caps().Has(imap.CapUIDPlus)
+
+	mode := c.deleteMode
+	trash := ""
+	if mode == DeleteModeAuto || mode == DeleteModeTrash {
+		// Without knowing whether there is a Trash the messages would
+		// be destroyed, so they are left in place
+		var err error
+		trash, err = c.trashFolder(client)
+		if err != nil {
+			return "", "", fmt.Errorf("could not look up Trash folder: %w", err)
+		}
+		// Messages already in the Trash are removed for good
+		if trash == folder {
+			trash = ""
+		}
+	}
+
+	switch mode {
+	case DeleteModeAuto:
+		switch {
+		case trash != "":
+			return DeleteModeTrash, trash, nil
+		case canUIDExpunge:
+			return DeleteModeUIDExpunge, "", nil
+		default:
+			return "", "", fmt.Errorf("%w: no \\Trash folder and no UIDPLUS support; set DELETE_MODE=%s to allow a full EXPUNGE",
+				ErrDeleteUnsupported, DeleteModeExpunge)
+		}
+	case DeleteModeTrash:
+		if trash == "" && folder == "" {
+			return "", "", fmt.Errorf("%w: no \\Trash folder found for delete mode %s", ErrDeleteUnsupported, DeleteModeTrash)
+		}
+	case DeleteModeUIDExpunge:
+		if !canUIDExpunge {
+			return "", "", fmt.Errorf("%w: server does not support UIDPLUS required by delete mode %s", ErrDeleteUnsupported, DeleteModeUIDExpunge)
+		}
+	}
+	return mode, trash, nil
+}
+
+// removeMessages removes uids from the currently selected folder using the
+// configured deletion mode and returns a short description of what was done
+func (c *Client) removeMessages(client *imapclient.Client, folder string, uidSet imap.UIDSet) (string, error) {
+	mode, trash, err := c.deleteStrategy(client, folder)
+	if err != nil {
+		return "", err
+	}
+
+	switch mode {
+	case DeleteModeTrash:
+		if trash == "" {
+			return "", fmt.Errorf("no \\Trash folder found for delete mode %s", DeleteModeTrash)
+		}
+		if err := c.moveMessages(client, uidSet, trash); err != nil {
+			return "", err
+		}
+		return "moved to " + trash, nil
+
+	case DeleteModeUIDExpunge:
+		if err := expungeUIDs(client, uidSet, true); err != nil {
+			return "", err
+		}
+		return "expunged", nil
+
+	default:
+		if err := expungeUIDs(client, uidSet, false); err != nil {
+			return "", err
+		}
+		return "expunged", nil
+	}
+}
+
+// expungeUIDs flags messages \Deleted and expunges them, limited to uidSet when
+// the server supports UID EXPUNGE
+func expungeUIDs(client *imapclient.Client, uidSet imap.UIDSet, uidExpunge bool) error {
+	storeCmd := client.Store(uidSet, &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}, nil)
+	if err := storeCmd.Close(); err != nil {
+		return fmt.Errorf("failed to mark as deleted: %w", err)
+	}
+
+	expungeCmd := client.Expunge()
+	if uidExpunge {
+		expungeCmd = client.UIDExpunge(uidSet)
+	}
+	if err := expungeCmd.Close(); err != nil {
+		return fmt.Errorf("failed to expunge: %w", err)
+	}
+	return nil
+}
+
+// trashFolder returns the name of the \Trash folder, or "" if the account
+// doesn't advertise one. The result is cached for the lifetime of the client.
+func (c *Client) trashFolder(client *imapclient.Client) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.trashLookedUp {
+		return c.trash, nil
+	}
+
+	trash, err := findSpecialUseFolder(client, imap.MailboxAttrTrash)
+	if err != nil {
+		return "", err
+	}
+	c.trash = trash
+	c.trashLookedUp = true
+	return trash, nil
+}
+
+// findSpecialUseFolder returns the first folder carrying the given special-use attribute
+func findSpecialUseFolder(client *imapclient.Client, attr imap.MailboxAttr) (string, error) {
+	mailboxes, err := listMailboxes(client)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mbox := range mailboxes {
+		if hasAttr(mbox.Attrs, attr) {
+			return mbox.Mailbox, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,70 @@
+package imap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// TLSMode selects how the connection to the server is secured
+type TLSMode string
+
+const (
+	// TLSModeTLS connects with implicit TLS, usually on port 993
+	TLSModeTLS TLSMode = "tls"
+	// TLSModeStartTLS upgrades a plain connection with STARTTLS, usually on port 143
+	TLSModeStartTLS TLSMode = "starttls"
+	// TLSModePlain doesn't encrypt at all; only for servers on a trusted network
+	TLSModePlain TLSMode = "plain"
+)
+
+// ParseTLSMode validates a TLS mode name
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch mode := TLSMode(s); mode {
+	case TLSModeTLS, TLSModeStartTLS, TLSModePlain:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown TLS mode %q (want tls, starttls or plain)", s)
+	}
+}
+
+// LoadCertPool returns the system roots plus the PEM certificates in path,
+// for servers whose certificate is signed by a private CA
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Dial connects to server secured as mode, without logging in. rootCAs
+// verifies the server certificate; nil uses the system roots.
+func Dial(server string, port int, mode TLSMode, rootCAs *x509.CertPool, options *imapclient.Options) (*imapclient.Client, error) {
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+	options.TLSConfig = &tls.Config{
+		ServerName: server,
+		RootCAs:    rootCAs,
+	}
+
+	switch mode {
+	case TLSModeStartTLS:
+		return imapclient.DialStartTLS(addr, options)
+	case TLSModePlain:
+		return imapclient.DialInsecure(addr, options)
+	default:
+		return imapclient.DialTLS(addr, options)
+	}
+}
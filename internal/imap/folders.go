@@ -0,0 +1,218 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// skippedAttrs mark folders that are not scanned for senders unless included
+// by the user: mail the user wrote or threw away, spam, and virtual views such
+// as Gmail's All Mail that hold copies of mail kept in other folders
+var skippedAttrs = []imap.MailboxAttr{
+	imap.MailboxAttrSent,
+	imap.MailboxAttrDrafts,
+	imap.MailboxAttrTrash,
+	imap.MailboxAttrJunk,
+	imap.MailboxAttrAll,
+	imap.MailboxAttrFlagged,
+	imap.MailboxAttrImportant,
+}
+
+// unselectableAttrs mark folders that can't be opened, so they are never scanned
+var unselectableAttrs = []imap.MailboxAttr{
+	imap.MailboxAttrNoSelect,
+	imap.MailboxAttrNonExistent,
+}
+
+// skippedNames are used instead of skippedAttrs for servers that don't mark
+// any folder with a special-use attribute. They are matched against the last
+// part of the name, so "INBOX.Sent" is skipped too.
+var skippedNames = map[string]bool{
+	"Sent":             true,
+	"Sent Messages":    true,
+	"Sent Items":       true,
+	"Sent Mail":        true,
+	"Drafts":           true,
+	"Trash":            true,
+	"Deleted Messages": true,
+	"Deleted Items":    true,
+}
+
+// junkNames are the usual names of spam folders, skipped like skippedNames
+// unless the policy scans junk
+var junkNames = map[string]bool{
+	"Junk":        true,
+	"Junk E-mail": true,
+	"Spam":        true,
+}
+
+// Folder is a mailbox and the attributes the server reports for it, such as
+// \Sent or \Noselect
+type Folder struct {
+	Name  string
+	Delim rune // Hierarchy delimiter, 0 if the server has none
+	Attrs []imap.MailboxAttr
+}
+
+// Has reports whether the folder carries any of attrs
+func (f Folder) Has(attrs ...imap.MailboxAttr) bool {
+	return hasAttr(f.Attrs, attrs...)
+}
+
+// Selectable reports whether the folder can be opened and hold mail
+func (f Folder) Selectable() bool {
+	return !f.Has(unselectableAttrs...)
+}
+
+// Leaf returns the last part of the folder's hierarchical name
+func (f Folder) Leaf() string {
+	if f.Delim == 0 {
+		return f.Name
+	}
+	delim := string(f.Delim)
+	if i := strings.LastIndex(f.Name, delim); i >= 0 {
+		return f.Name[i+len(delim):]
+	}
+	return f.Name
+}
+
+// ListFolders returns every folder in the mailbox with its attributes,
+// including special-use attributes when the server supports them
+func (c *Client) ListFolders() ([]Folder, error) {
+	client, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(client)
+
+	mailboxes, err := listMailboxes(client)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]Folder, len(mailboxes))
+	for i, mbox := range mailboxes {
+		folders[i] = Folder{Name: mbox.Mailbox, Delim: mbox.Delim, Attrs: mbox.Attrs}
+	}
+	return folders, nil
+}
+
+// FolderPolicy decides which folders are scanned for senders. By default
+// every folder is, except those whose special-use attributes mark them as
+// sent mail, drafts, trash, spam or a virtual view, and the USPIS folders.
+// Servers that mark no folder at all have them skipped by their usual names.
+type FolderPolicy struct {
+	Include  []string // Scanned even if their attributes would skip them
+	Exclude  []string // Never scanned; wins over Include
+	ScanJunk bool     // Scan spam folders like any other
+}
+
+// FolderDecision is whether a folder is scanned and why
+type FolderDecision struct {
+	Folder Folder
+	Scan   bool
+	Reason string
+}
+
+// Decide applies the policy to the folders of a mailbox
+func (p FolderPolicy) Decide(folders []Folder) []FolderDecision {
+	specialUse := false
+	for _, f := range folders {
+		if f.Has(imap.MailboxAttrSent, imap.MailboxAttrDrafts, imap.MailboxAttrTrash, imap.MailboxAttrJunk, imap.MailboxAttrArchive, imap.MailboxAttrAll) {
+			specialUse = true
+			break
+		}
+	}
+
+	decisions := make([]FolderDecision, len(folders))
+	for i, f := range folders {
+		decisions[i] = p.decide(f, specialUse)
+	}
+	return decisions
+}
+
+func (p FolderPolicy) decide(f Folder, specialUse bool) FolderDecision {
+	skip := func(reason string) FolderDecision {
+		return FolderDecision{Folder: f, Reason: reason}
+	}
+
+	switch {
+	case f.Name == "USPIS" || strings.HasPrefix(f.Name, "USPIS/"):
+		return skip("USPIS folder")
+	case !f.Selectable():
+		return skip("can't be opened")
+	case containsFolder(p.Exclude, f.Name):
+		return skip("excluded")
+	case containsFolder(p.Include, f.Name):
+		return FolderDecision{Folder: f, Scan: true, Reason: "included"}
+	}
+
+	for _, attr := range skippedAttrs {
+		if attr == imap.MailboxAttrJunk && p.ScanJunk {
+			continue
+		}
+		if f.Has(attr) {
+			return skip(string(attr) + " folder")
+		}
+	}
+	if !specialUse && skippedNames[f.Leaf()] {
+		return skip("usual name of a sent, drafts or trash folder")
+	}
+	if !specialUse && !p.ScanJunk && junkNames[f.Leaf()] {
+		return skip("usual name of a spam folder")
+	}
+	return FolderDecision{Folder: f, Scan: true}
+}
+
+// Select returns the names of the folders the policy scans
+func (p FolderPolicy) Select(folders []Folder) []string {
+	var names []string
+	for _, d := range p.Decide(folders) {
+		if d.Scan {
+			names = append(names, d.Folder.Name)
+		}
+	}
+	return names
+}
+
+// containsFolder reports whether names lists folder. INBOX is matched case
+// insensitively, as IMAP requires.
+func containsFolder(names []string, folder string) bool {
+	for _, name := range names {
+		if name == folder || strings.EqualFold(name, "INBOX") && strings.EqualFold(folder, "INBOX") {
+			return true
+		}
+	}
+	return false
+}
+
+// listMailboxes lists every folder with its attributes, including special-use
+// attributes when the server supports them
+func listMailboxes(client *imapclient.Client) ([]*imap.ListData, error) {
+	var options *imap.ListOptions
+	if client.Caps().Has(imap.CapSpecialUse) {
+		options = &imap.ListOptions{ReturnSpecialUse: true}
+	}
+
+	mailboxes, err := client.List("", "*", options).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folders: %w", err)
+	}
+	return mailboxes, nil
+}
+
+// hasAttr reports whether attrs contains any of want. Servers differ in how
+// they capitalize attributes, e.g. \Noselect and \NoSelect.
+func hasAttr(attrs []imap.MailboxAttr, want ...imap.MailboxAttr) bool {
+	for _, a := range attrs {
+		for _, w := range want {
+			if strings.EqualFold(string(a), string(w)) {
+				return true
+			}
+		}
+	}
+	return false
+}
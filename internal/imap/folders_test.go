@@ -0,0 +1,143 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestFolderPolicyDecide(t *testing.T) {
+	type want struct {
+		scan   bool
+		reason string
+	}
+
+	tests := []struct {
+		name    string
+		policy  FolderPolicy
+		folders []Folder
+		want    map[string]want
+	}{
+		{
+			name: "attributes only",
+			folders: []Folder{
+				{Name: "INBOX"},
+				{Name: "Sent Messages", Attrs: []imap.MailboxAttr{imap.MailboxAttrSent}},
+				{Name: "Bin", Attrs: []imap.MailboxAttr{imap.MailboxAttrTrash}},
+				{Name: "Bulk", Attrs: []imap.MailboxAttr{imap.MailboxAttrJunk}},
+				{Name: "[Gmail]/All Mail", Attrs: []imap.MailboxAttr{imap.MailboxAttrAll}},
+				{Name: "Archive", Attrs: []imap.MailboxAttr{imap.MailboxAttrArchive}},
+			},
+			want: map[string]want{
+				"INBOX":            {true, ""},
+				"Sent Messages":    {false, `\Sent folder`},
+				"Bin":              {false, `\Trash folder`},
+				"Bulk":             {false, `\Junk folder`},
+				"[Gmail]/All Mail": {false, `\All folder`},
+				"Archive":          {true, ""},
+			},
+		},
+		{
+			name: "names only",
+			folders: []Folder{
+				{Name: "INBOX", Delim: '.'},
+				{Name: "INBOX.Sent", Delim: '.'},
+				{Name: "INBOX.Drafts", Delim: '.'},
+				{Name: "Deleted Messages", Delim: '.'},
+				{Name: "Spam", Delim: '.'},
+				{Name: "INBOX.Sent.Receipts", Delim: '.'},
+			},
+			want: map[string]want{
+				"INBOX":               {true, ""},
+				"INBOX.Sent":          {false, "usual name of a sent, drafts or trash folder"},
+				"INBOX.Drafts":        {false, "usual name of a sent, drafts or trash folder"},
+				"Deleted Messages":    {false, "usual name of a sent, drafts or trash folder"},
+				"Spam":                {false, "usual name of a spam folder"},
+				"INBOX.Sent.Receipts": {true, ""},
+			},
+		},
+		{
+			// Once the server marks any folder, names are no longer trusted
+			name: "attributes and names",
+			folders: []Folder{
+				{Name: "INBOX"},
+				{Name: "Sent", Attrs: []imap.MailboxAttr{imap.MailboxAttrSent}},
+				{Name: "Trash"},
+				{Name: "Spam"},
+				{Name: "Junk", Attrs: []imap.MailboxAttr{imap.MailboxAttrJunk}},
+			},
+			want: map[string]want{
+				"INBOX": {true, ""},
+				"Sent":  {false, `\Sent folder`},
+				"Trash": {true, ""},
+				"Spam":  {true, ""},
+				"Junk":  {false, `\Junk folder`},
+			},
+		},
+		{
+			name:   "mixed case",
+			policy: FolderPolicy{Include: []string{"inbox"}, Exclude: []string{"receipts"}},
+			folders: []Folder{
+				{Name: "Inbox"},
+				{Name: "Sent", Attrs: []imap.MailboxAttr{`\SENT`}},
+				{Name: "Drafts", Attrs: []imap.MailboxAttr{`\drafts`}},
+				{Name: "Parent", Attrs: []imap.MailboxAttr{`\NoSelect`}},
+				{Name: "Receipts"},
+				{Name: "sent"},
+			},
+			want: map[string]want{
+				"Inbox":    {true, "included"},
+				"Sent":     {false, `\Sent folder`},
+				"Drafts":   {false, `\Drafts folder`},
+				"Parent":   {false, "can't be opened"},
+				"Receipts": {true, ""},
+				"sent":     {true, ""},
+			},
+		},
+		{
+			name:   "uspis folders",
+			policy: FolderPolicy{Include: []string{"USPIS/Block"}},
+			folders: []Folder{
+				{Name: "USPIS", Delim: '/'},
+				{Name: "USPIS/Block", Delim: '/'},
+				{Name: "USPIS/Transactional Only", Delim: '/'},
+				{Name: "USPIS Receipts", Delim: '/'},
+			},
+			want: map[string]want{
+				"USPIS":                    {false, "USPIS folder"},
+				"USPIS/Block":              {false, "USPIS folder"},
+				"USPIS/Transactional Only": {false, "USPIS folder"},
+				"USPIS Receipts":           {true, ""},
+			},
+		},
+		{
+			name:   "include and exclude",
+			policy: FolderPolicy{Include: []string{"Sent", "Orders"}, Exclude: []string{"Orders"}, ScanJunk: true},
+			folders: []Folder{
+				{Name: "Sent", Attrs: []imap.MailboxAttr{imap.MailboxAttrSent}},
+				{Name: "Orders"},
+				{Name: "Junk", Attrs: []imap.MailboxAttr{imap.MailboxAttrJunk}},
+			},
+			want: map[string]want{
+				"Sent":   {true, "included"},
+				"Orders": {false, "excluded"},
+				"Junk":   {true, ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := tt.policy.Decide(tt.folders)
+			if len(decisions) != len(tt.folders) {
+				t.Fatalf("Decide returned %d decisions for %d folders", len(decisions), len(tt.folders))
+			}
+			for _, d := range decisions {
+				w := tt.want[d.Folder.Name]
+				if d.Scan != w.scan || d.Reason != w.reason {
+					t.Errorf("%s: scan %v (%q), want %v (%q)", d.Folder.Name, d.Scan, d.Reason, w.scan, w.reason)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// ErrIdleUnsupported is returned by Watch when the server does not advertise IDLE
+var ErrIdleUnsupported = errors.New("server does not support IDLE")
+
+const (
+	watchRetryMin = 5 * time.Second
+	watchRetryMax = 5 * time.Minute
+)
+
+// Watch keeps a long-lived IDLE session open on folder and calls notify whenever
+// the server reports that new messages arrived (including messages moved into
+// the folder). Dropped connections are re-established with backoff until ctx is
+// cancelled. Watch returns ErrIdleUnsupported if the server can't IDLE.
+func (c *Client) Watch(ctx context.Context, folder string, notify func()) error {
+	backoff := watchRetryMin
+
+	for {
+		started := time.Now()
+		err := c.watchFolder(ctx, folder, notify)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrIdleUnsupported) {
+			return err
+		}
+
+		// A session that stayed up for a while was healthy, so start over
+		if time.Since(started) > watchRetryMax {
+			backoff = watchRetryMin
+		}
+
+		log.Printf("IDLE session on %s ended: %v (reconnecting in %v)", folder, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > watchRetryMax {
+			backoff = watchRetryMax
+		}
+	}
+}
+
+// watchFolder runs a single IDLE session until the connection drops or ctx is done
+func (c *Client) watchFolder(ctx context.Context, folder string, notify func()) error {
+	// The server reports the new message count with EXISTS and removals with
+	// EXPUNGE. Only growth is interesting; our own deletions must not wake
+	// the poller again.
+	var mu sync.Mutex
+	var known uint32
+
+	client, err := c.connectWithOptions(&imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Expunge: func(seqNum uint32) {
+				mu.Lock()
+				if known > 0 {
+					known--
+				}
+				mu.Unlock()
+			},
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages == nil {
+					return
+				}
+				mu.Lock()
+				grew := *data.NumMessages > known
+				known = *data.NumMessages
+				mu.Unlock()
+				if grew {
+					notify()
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	caps := client.Caps()
+	if !caps.Has(imap.CapIdle) && !caps.Has(imap.CapIMAP4rev2) {
+		return ErrIdleUnsupported
+	}
+
+	mbox, err := client.Select(folder, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("failed to select folder %s: %w", folder, err)
+	}
+	mu.Lock()
+	known = mbox.NumMessages
+	mu.Unlock()
+
+	idleCmd, err := client.Idle()
+	if err != nil {
+		return fmt.Errorf("failed to start IDLE: %w", err)
+	}
+	log.Printf("IDLE session open on %s", folder)
+
+	// The IDLE command is restarted by imapclient before the server's
+	// inactivity timeout, so Wait only returns once the connection drops.
+	done := make(chan error, 1)
+	go func() {
+		done <- idleCmd.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		if err := idleCmd.Close(); err != nil {
+			return err
+		}
+		<-done
+		client.Logout().Wait()
+		return nil
+	case err := <-done:
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return err
+	}
+}
@@ -0,0 +1,152 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// MoveEmailsToFolder moves emails from multiple folders into dest using a
+// single connection. It returns the folders whose emails were moved, also
+// when moving from others failed.
+func (c *Client) MoveEmailsToFolder(folderUIDs map[string][]uint32, dest string) ([]string, error) {
+	if len(folderUIDs) == 0 {
+		return nil, nil
+	}
+
+	client, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(client)
+
+	var moved []string
+	var failed int
+	var firstErr error
+	for folder, uids := range folderUIDs {
+		if len(uids) == 0 {
+			continue
+		}
+
+		if _, err := client.Select(folder, nil).Wait(); err != nil {
+			log.Printf("Failed to select folder %s for move: %v", folder, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		imapUIDs := make([]imap.UID, len(uids))
+		for i, uid := range uids {
+			imapUIDs[i] = imap.UID(uid)
+		}
+
+		if err := c.moveMessages(client, imap.UIDSetNum(imapUIDs...), dest); err != nil {
+			if !errors.Is(err, ErrDeleteUnsupported) {
+				log.Printf("Failed to move emails from %s to %s: %v", folder, dest, err)
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		log.Printf("Moved %d emails from %s to %s", len(uids), folder, dest)
+		moved = append(moved, folder)
+	}
+
+	if failed > 0 {
+		return moved, fmt.Errorf("failed to move emails from %d folders: %w", failed, firstErr)
+	}
+	return moved, nil
+}
+
+// MoveByMessageID finds a message in folder by its Message-ID header and moves
+// it to dest. It reports false if no such message is in the folder.
+func (c *Client) MoveByMessageID(folder, messageID, dest string) (bool, error) {
+	client, err := c.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer c.release(client)
+
+	uids, err := searchMessageID(client, folder, messageID)
+	if err != nil || len(uids) == 0 {
+		return false, err
+	}
+
+	if err := c.moveMessages(client, imap.UIDSetNum(uids...), dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteByMessageID finds a message in folder by its Message-ID header and
+// deletes it using the configured deletion mode. It reports false if no such
+// message is in the folder.
+func (c *Client) DeleteByMessageID(folder, messageID string) (bool, error) {
+	client, err := c.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer c.release(client)
+
+	uids, err := searchMessageID(client, folder, messageID)
+	if err != nil || len(uids) == 0 {
+		return false, err
+	}
+
+	if _, err := c.removeMessages(client, folder, imap.UIDSetNum(uids...)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// searchMessageID selects folder and returns the UIDs of messages with the given Message-ID
+func searchMessageID(client *imapclient.Client, folder, messageID string) ([]imap.UID, error) {
+	if messageID == "" {
+		return nil, fmt.Errorf("message has no Message-ID")
+	}
+
+	if _, err := client.Select(folder, nil).Wait(); err != nil {
+		return nil, fmt.Errorf("failed to select folder %s: %w", folder, err)
+	}
+
+	// The envelope strips the angle brackets that the header carries
+	data, err := client.UIDSearch(&imap.SearchCriteria{
+		Header: []imap.SearchCriteriaHeaderField{{Key: "Message-ID", Value: messageID}},
+	}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s: %w", folder, err)
+	}
+	return data.AllUIDs(), nil
+}
+
+// moveMessages moves uids from the selected folder to dest, emulating MOVE with
+// COPY and expunge on servers without RFC 6851 support. Without UIDPLUS that
+// takes a full EXPUNGE, which is only run if the user chose DeleteModeExpunge.
+func (c *Client) moveMessages(client *imapclient.Client, uidSet imap.UIDSet, dest string) error {
+	caps := client.Caps()
+	if caps.Has(imap.CapMove) {
+		if _, err := client.Move(uidSet, dest).Wait(); err != nil {
+			return fmt.Errorf("failed to move to %s: %w", dest, err)
+		}
+		return nil
+	}
+
+	uidExpunge := caps.Has(imap.CapUIDPlus)
+	if !uidExpunge && c.deleteMode != DeleteModeExpunge {
+		return fmt.Errorf("%w: server supports neither MOVE nor UIDPLUS; set DELETE_MODE=%s to allow moving with a full EXPUNGE",
+			ErrDeleteUnsupported, DeleteModeExpunge)
+	}
+
+	if _, err := client.Copy(uidSet, dest).Wait(); err != nil {
+		return fmt.Errorf("failed to copy to %s: %w", dest, err)
+	}
+	return expungeUIDs(client, uidSet, uidExpunge)
+}
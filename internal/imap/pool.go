@@ -0,0 +1,161 @@
+package imap
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+const (
+	// sessionHealthCheckAfter is how long a session may sit idle before it is
+	// verified with a NOOP on checkout
+	sessionHealthCheckAfter = 30 * time.Second
+	// sessionMaxIdle is how long an unused session is kept before it is logged
+	// out; servers drop idle connections after roughly 30 minutes anyway
+	sessionMaxIdle = 10 * time.Minute
+)
+
+// PoolStats reports how IMAP sessions were obtained
+type PoolStats struct {
+	Reused      int64 // Checkouts served by an existing session
+	Established int64 // Fresh TLS dial + LOGIN
+	Discarded   int64 // Sessions dropped because they were dead or stale
+	Open        int   // Sessions currently open (idle and in use)
+}
+
+type idleSession struct {
+	client *imapclient.Client
+	since  time.Time
+}
+
+// sessionPool keeps logged-in connections around so that the operations in a
+// poll cycle share them instead of logging in every time
+type sessionPool struct {
+	dial func() (*imapclient.Client, error)
+	sem  chan struct{}
+
+	mu   sync.Mutex
+	idle []idleSession
+	open int
+
+	reused      atomic.Int64
+	established atomic.Int64
+	discarded   atomic.Int64
+}
+
+func newSessionPool(maxConns int, dial func() (*imapclient.Client, error)) *sessionPool {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	return &sessionPool{
+		dial: dial,
+		sem:  make(chan struct{}, maxConns),
+	}
+}
+
+// get checks out a healthy session, dialing a new one if none is available.
+// It blocks while the connection limit is reached.
+func (p *sessionPool) get() (*imapclient.Client, error) {
+	p.sem <- struct{}{}
+
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// Most recently used first; it is the most likely to still be alive
+		s := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.healthy(s) {
+			p.reused.Add(1)
+			return s.client, nil
+		}
+		p.discard(s.client)
+	}
+
+	client, err := p.dial()
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.open++
+	p.mu.Unlock()
+	p.established.Add(1)
+	return client, nil
+}
+
+// put returns a session to the pool. Sessions whose connection dropped while
+// in use are closed so the next checkout logs in again.
+func (p *sessionPool) put(client *imapclient.Client) {
+	defer func() { <-p.sem }()
+
+	if client.State() == imap.ConnStateLogout {
+		p.discard(client)
+		return
+	}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, idleSession{client: client, since: time.Now()})
+	p.mu.Unlock()
+}
+
+func (p *sessionPool) healthy(s idleSession) bool {
+	if s.client.State() == imap.ConnStateLogout {
+		return false
+	}
+	idleFor := time.Since(s.since)
+	if idleFor > sessionMaxIdle {
+		return false
+	}
+	if idleFor > sessionHealthCheckAfter {
+		if err := s.client.Noop().Wait(); err != nil {
+			log.Printf("IMAP session failed health check: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func (p *sessionPool) discard(client *imapclient.Client) {
+	client.Close()
+	p.mu.Lock()
+	p.open--
+	p.mu.Unlock()
+	p.discarded.Add(1)
+}
+
+// close logs out all idle sessions
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.mu.Unlock()
+
+	for _, s := range idle {
+		s.client.Logout().Wait()
+		s.client.Close()
+	}
+}
+
+func (p *sessionPool) stats() PoolStats {
+	p.mu.Lock()
+	open := p.open
+	p.mu.Unlock()
+
+	return PoolStats{
+		Reused:      p.reused.Load(),
+		Established: p.established.Load(),
+		Discarded:   p.discarded.Load(),
+		Open:        open,
+	}
+}
@@ -0,0 +1,140 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// AppendEmail puts a previously fetched email back into folder. The original
+// source is used when it was stored; otherwise a message is rebuilt from the
+// parsed headers and bodies.
+func (c *Client) AppendEmail(folder string, email *FetchedEmail) error {
+	raw := email.Raw
+	date := messageDate(email)
+	if len(raw) == 0 {
+		var err error
+		raw, err = composeMessage(email, date)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild message: %w", err)
+		}
+	}
+
+	client, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release(client)
+
+	appendCmd := client.Append(folder, int64(len(raw)), &imap.AppendOptions{Time: date})
+	if _, err := appendCmd.Write(raw); err != nil {
+		appendCmd.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := appendCmd.Close(); err != nil {
+		return fmt.Errorf("failed to append to %s: %w", folder, err)
+	}
+	if _, err := appendCmd.Wait(); err != nil {
+		return fmt.Errorf("failed to append to %s: %w", folder, err)
+	}
+
+	log.Printf("Appended email %s to %s (%d bytes)", email.MessageID, folder, len(raw))
+	return nil
+}
+
+// messageDate returns the date to file the email under, preferring the Date
+// header of the original source
+func messageDate(email *FetchedEmail) time.Time {
+	if len(email.Raw) > 0 {
+		if msg, err := mail.ReadMessage(bytes.NewReader(email.Raw)); err == nil {
+			if date, err := msg.Header.Date(); err == nil {
+				return date
+			}
+		}
+	}
+	if date, err := time.ParseInLocation("2006-01-02 15:04:05", email.Date, time.Local); err == nil {
+		return date
+	}
+	return time.Now()
+}
+
+// composeMessage builds a minimal RFC 822 message from parsed email fields
+func composeMessage(email *FetchedEmail, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writeHeader := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+		}
+	}
+	writeHeader("From", encodeAddress(email.FromName, email.From))
+	writeHeader("To", encodeAddressList(email.To))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	if email.MessageID != "" {
+		writeHeader("Message-ID", "<"+email.MessageID+">")
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	switch {
+	case email.BodyText != "" && email.BodyHTML != "":
+		mw := multipart.NewWriter(&buf)
+		writeHeader("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+		buf.WriteString("\r\n")
+		if err := writePart(mw, "text/plain", email.BodyText); err != nil {
+			return nil, err
+		}
+		if err := writePart(mw, "text/html", email.BodyHTML); err != nil {
+			return nil, err
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+
+	case email.BodyHTML != "":
+		writeHeader("Content-Type", "text/html; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, email.BodyHTML); err != nil {
+			return nil, err
+		}
+
+	default:
+		writeHeader("Content-Type", "text/plain; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, email.BodyText); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writePart(mw *multipart.Writer, contentType, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(part, body)
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,87 @@
+// Package mbox reads and writes mailboxes in the mbox format: messages
+// separated by "From " lines, with body lines starting with "From " quoted as
+// ">From ".
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Reader returns the messages of an mbox one at a time
+type Reader struct {
+	r       *bufio.Reader
+	pending []byte // "From " line of the next message, already read
+	done    bool
+}
+
+// NewReader returns a reader for the mbox in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message without its "From " separator line, or
+// io.EOF after the last one
+func (m *Reader) Next() ([]byte, error) {
+	if m.done {
+		return nil, io.EOF
+	}
+
+	// Skip anything before the first separator
+	for m.pending == nil {
+		line, err := m.r.ReadBytes('\n')
+		if isSeparator(line) {
+			m.pending = line
+			break
+		}
+		if err == io.EOF {
+			m.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var msg bytes.Buffer
+	for {
+		line, err := m.r.ReadBytes('\n')
+		if isSeparator(line) {
+			m.pending = line
+			return trimSeparatorNewline(msg.Bytes()), nil
+		}
+		msg.Write(unquote(line))
+		if err == io.EOF {
+			m.done = true
+			return trimSeparatorNewline(msg.Bytes()), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isSeparator(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// unquote removes one ">" from lines like ">From " and ">>From " (mboxrd)
+func unquote(line []byte) []byte {
+	trimmed := bytes.TrimLeft(line, ">")
+	if len(trimmed) < len(line) && bytes.HasPrefix(trimmed, []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// trimSeparatorNewline drops the blank line that precedes the next "From "
+func trimSeparatorNewline(msg []byte) []byte {
+	if bytes.HasSuffix(msg, []byte("\r\n\r\n")) {
+		return msg[:len(msg)-2]
+	}
+	if bytes.HasSuffix(msg, []byte("\n\n")) {
+		return msg[:len(msg)-1]
+	}
+	return msg
+}
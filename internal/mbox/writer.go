@@ -0,0 +1,55 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Writer writes messages to an mbox, quoting body lines the way Reader
+// expects
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a writer that appends messages to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteMessage writes msg preceded by a "From " line naming the sender and
+// the time it was received
+func (m *Writer) WriteMessage(from string, date time.Time, msg []byte) error {
+	if from = strings.Join(strings.Fields(from), ""); from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, date.UTC().Format(time.ANSIC))
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line = msg[:i+1]
+		}
+		msg = msg[len(line):]
+		buf.Write(quote(line))
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	// A blank line separates each message from the next "From " line
+	buf.WriteByte('\n')
+
+	_, err := m.w.Write(buf.Bytes())
+	return err
+}
+
+// quote adds one ">" to lines like "From " and ">From " (mboxrd)
+func quote(line []byte) []byte {
+	if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		return append([]byte(">"), line...)
+	}
+	return line
+}
@@ -0,0 +1,205 @@
+// Package oauth signs IMAP accounts in with OAuth2 for providers that don't
+// offer app passwords, such as Gmail and Microsoft 365. The authorization code
+// flow is run once from the dashboard; after that the tokens are kept in the
+// database and refreshed as they expire.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Endpoint is where a provider authorizes users and issues tokens
+type Endpoint struct {
+	AuthURL  string
+	TokenURL string
+	Scopes   []string
+	// Params are added to the authorization URL
+	Params map[string]string
+}
+
+// Endpoints are the presets for the IMAP_PROVIDER names that support OAuth2
+var Endpoints = map[string]Endpoint{
+	"gmail": {
+		AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+		Scopes:   []string{"https://mail.google.com/"},
+		// Google only issues a refresh token when consent is asked for offline access
+		Params: map[string]string{"access_type": "offline", "prompt": "consent"},
+	},
+	"outlook": {
+		AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		Scopes:   []string{"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"},
+	},
+}
+
+// ResolveEndpoint returns the preset for provider with any non-empty
+// override applied. Providers without a preset need both URLs.
+func ResolveEndpoint(provider, authURL, tokenURL string, scopes []string) (Endpoint, error) {
+	endpoint := Endpoints[provider]
+	if authURL != "" {
+		endpoint.AuthURL = authURL
+	}
+	if tokenURL != "" {
+		endpoint.TokenURL = tokenURL
+	}
+	if len(scopes) > 0 {
+		endpoint.Scopes = scopes
+	}
+	if endpoint.AuthURL == "" || endpoint.TokenURL == "" {
+		return Endpoint{}, fmt.Errorf("no OAuth2 endpoints known for provider %q; set OAUTH_AUTH_URL and OAUTH_TOKEN_URL", provider)
+	}
+	return endpoint, nil
+}
+
+// Config identifies the app registered with the provider
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Endpoint     Endpoint
+	// HTTPClient talks to the token endpoint; nil uses a client with a timeout
+	HTTPClient *http.Client
+}
+
+// Token is an access token and the refresh token that renews it
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time // Zero if the provider didn't say
+}
+
+// authCodeURL returns the page that asks the user to grant access. The
+// challenge is derived from verifier, which must be sent with the code (PKCE).
+func (c *Config) authCodeURL(state, verifier, loginHint string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {c.RedirectURL},
+		"scope":                 {strings.Join(c.Endpoint.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if loginHint != "" {
+		params.Set("login_hint", loginHint)
+	}
+	for k, v := range c.Endpoint.Params {
+		params.Set(k, v)
+	}
+
+	sep := "?"
+	if strings.Contains(c.Endpoint.AuthURL, "?") {
+		sep = "&"
+	}
+	return c.Endpoint.AuthURL + sep + params.Encode()
+}
+
+// exchange trades the code from the authorization redirect for a token
+func (c *Config) exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	return c.requestToken(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.RedirectURL},
+		"code_verifier": {verifier},
+	})
+}
+
+// refresh gets a new access token. Providers that rotate refresh tokens
+// return a new one that replaces refreshToken; the others keep it valid.
+func (c *Config) refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	token, err := c.requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+// tokenResponse is the token endpoint's reply, success or error (RFC 6749 5.1, 5.2)
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	TokenType        string      `json:"token_type"`
+	RefreshToken     string      `json:"refresh_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+// requestToken posts a grant to the token endpoint
+func (c *Config) requestToken(ctx context.Context, params url.Values) (*Token, error) {
+	params.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		params.Set("client_secret", c.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s: %.200s", resp.Status, body)
+	}
+	if tr.Error != "" {
+		if tr.ErrorDescription != "" {
+			return nil, fmt.Errorf("token endpoint returned %s: %s", tr.Error, tr.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token endpoint returned %s", tr.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+
+	token := &Token{AccessToken: tr.AccessToken, RefreshToken: tr.RefreshToken}
+	if secs, err := tr.ExpiresIn.Int64(); err == nil && secs > 0 {
+		token.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return token, nil
+}
+
+// randomString returns n random bytes, URL-safe encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,216 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"postal-inspection-service/internal/db"
+)
+
+// mockProvider is a token endpoint that issues short-lived access tokens and,
+// when rotate is set, a new refresh token on every refresh
+type mockProvider struct {
+	t      *testing.T
+	rotate bool
+
+	mu        sync.Mutex
+	challenge string // code_challenge from the authorization URL
+	refresh   string // The refresh token currently valid
+	issued    int
+	refreshes int
+}
+
+func (m *mockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		m.t.Errorf("bad token request: %v", err)
+	}
+	if got := r.PostForm.Get("client_id"); got != "client" {
+		m.fail(w, "invalid_client", "client_id = "+got)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			m.fail(w, "invalid_grant", "bad code or verifier")
+			return
+		}
+		m.issue(w, true)
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != m.refresh {
+			m.fail(w, "invalid_grant", "refresh token revoked")
+			return
+		}
+		m.refreshes++
+		m.issue(w, m.rotate)
+	default:
+		m.fail(w, "unsupported_grant_type", "")
+	}
+}
+
+func (m *mockProvider) issue(w http.ResponseWriter, newRefresh bool) {
+	m.issued++
+	resp := map[string]any{
+		"access_token": "access-" + strconv.Itoa(m.issued),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	if newRefresh {
+		m.refresh = "refresh-" + strconv.Itoa(m.issued)
+		resp["refresh_token"] = m.refresh
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (m *mockProvider) fail(w http.ResponseWriter, code, desc string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": desc})
+}
+
+func newTestSource(t *testing.T, rotate bool) (*Source, *mockProvider, *db.DB) {
+	t.Helper()
+	provider := &mockProvider{t: t, rotate: rotate}
+	server := httptest.NewServer(provider)
+	t.Cleanup(server.Close)
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	source := NewSource(Config{
+		ClientID:    "client",
+		RedirectURL: "http://localhost:8080/oauth/callback",
+		Endpoint: Endpoint{
+			AuthURL:  server.URL + "/authorize",
+			TokenURL: server.URL + "/token",
+			Scopes:   []string{"mail"},
+		},
+	}, database, "user@example.com")
+	return source, provider, database
+}
+
+// authorize runs the dashboard flow against the mock provider
+func authorize(t *testing.T, source *Source, provider *mockProvider) {
+	t.Helper()
+	authURL, err := url.Parse(source.AuthCodeURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("login_hint") != "user@example.com" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	provider.mu.Lock()
+	provider.challenge = query.Get("code_challenge")
+	provider.mu.Unlock()
+
+	if err := source.Authorize(context.Background(), query.Get("state"), "the-code"); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+}
+
+// expire makes the stored access token look expired so the next use refreshes it
+func expire(t *testing.T, database *db.DB) {
+	t.Helper()
+	token, err := database.GetOAuthToken("user@example.com")
+	if err != nil || token == nil {
+		t.Fatalf("GetOAuthToken = %v, %v", token, err)
+	}
+	token.Expiry = time.Now().Add(-time.Minute)
+	if err := database.SaveOAuthToken(token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizeAndRotate(t *testing.T) {
+	source, provider, database := newTestSource(t, true)
+
+	if _, err := source.AccessToken(); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("AccessToken before authorizing = %v, want ErrNotAuthorized", err)
+	}
+
+	authorize(t, source, provider)
+
+	token, err := source.AccessToken()
+	if err != nil || token != "access-1" {
+		t.Fatalf("AccessToken = %q, %v; want access-1", token, err)
+	}
+	// A valid token is reused without asking the provider
+	if token, _ := source.AccessToken(); token != "access-1" || provider.refreshes != 0 {
+		t.Fatalf("AccessToken = %q after %d refreshes; want cached access-1", token, provider.refreshes)
+	}
+
+	expire(t, database)
+	token, err = source.AccessToken()
+	if err != nil || token != "access-2" {
+		t.Fatalf("AccessToken after expiry = %q, %v; want access-2", token, err)
+	}
+	stored, _ := database.GetOAuthToken("user@example.com")
+	if stored.RefreshToken != "refresh-2" {
+		t.Fatalf("stored refresh token = %q, want the rotated refresh-2", stored.RefreshToken)
+	}
+
+	// The rotated token must be the one used next; the mock rejects refresh-1
+	expire(t, database)
+	if token, err := source.AccessToken(); err != nil || token != "access-3" {
+		t.Fatalf("second refresh = %q, %v; want access-3", token, err)
+	}
+}
+
+func TestRefreshKeepsTokenWithoutRotation(t *testing.T) {
+	source, provider, database := newTestSource(t, false)
+	authorize(t, source, provider)
+
+	expire(t, database)
+	if token, err := source.AccessToken(); err != nil || token != "access-2" {
+		t.Fatalf("AccessToken after expiry = %q, %v; want access-2", token, err)
+	}
+	stored, _ := database.GetOAuthToken("user@example.com")
+	if stored.RefreshToken != "refresh-1" {
+		t.Fatalf("stored refresh token = %q, want refresh-1 kept", stored.RefreshToken)
+	}
+}
+
+func TestAuthorizeRejectsUnknownState(t *testing.T) {
+	source, provider, _ := newTestSource(t, true)
+	source.AuthCodeURL()
+
+	if err := source.Authorize(context.Background(), "forged", "the-code"); err == nil {
+		t.Fatal("Authorize with an unknown state succeeded")
+	}
+	if provider.issued != 0 {
+		t.Fatal("code was exchanged despite the unknown state")
+	}
+}
+
+func TestRevokedRefreshToken(t *testing.T) {
+	source, provider, database := newTestSource(t, true)
+	authorize(t, source, provider)
+
+	provider.mu.Lock()
+	provider.refresh = "revoked-elsewhere"
+	provider.mu.Unlock()
+	expire(t, database)
+	if _, err := source.AccessToken(); err == nil {
+		t.Fatal("AccessToken succeeded with a revoked refresh token")
+	}
+}
@@ -0,0 +1,161 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"postal-inspection-service/internal/db"
+)
+
+// ErrNotAuthorized means the account hasn't been granted access yet, or the
+// grant was revoked, and has to be authorized from the dashboard
+var ErrNotAuthorized = errors.New("account not authorized; sign in from the dashboard")
+
+// expiryMargin renews access tokens this long before they expire, so one is
+// never sent just as it runs out
+const expiryMargin = time.Minute
+
+// stateTTL is how long an authorization started on the dashboard can be finished
+const stateTTL = 10 * time.Minute
+
+// Source hands out access tokens for one account, refreshing and storing them
+// as needed. It is safe for concurrent use.
+type Source struct {
+	config  Config
+	db      *db.DB
+	account string
+
+	// mu serializes refreshes: with rotation the old refresh token stops
+	// working once used, so two at once would lock the account out
+	mu      sync.Mutex
+	pending map[string]pendingAuth
+}
+
+// pendingAuth is an authorization started on the dashboard, keyed by state
+type pendingAuth struct {
+	verifier string
+	expires  time.Time
+}
+
+// NewSource creates a token source for account, whose tokens are kept in database
+func NewSource(config Config, database *db.DB, account string) *Source {
+	return &Source{
+		config:  config,
+		db:      database,
+		account: account,
+		pending: make(map[string]pendingAuth),
+	}
+}
+
+// Account returns the account the tokens are for
+func (s *Source) Account() string {
+	return s.account
+}
+
+// RedirectURL returns where the provider sends the browser after authorization
+func (s *Source) RedirectURL() string {
+	return s.config.RedirectURL
+}
+
+// AuthCodeURL starts an authorization and returns the provider page the user
+// has to be sent to
+func (s *Source) AuthCodeURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for state, p := range s.pending {
+		if now.After(p.expires) {
+			delete(s.pending, state)
+		}
+	}
+
+	state := randomString(24)
+	verifier := randomString(32)
+	s.pending[state] = pendingAuth{verifier: verifier, expires: now.Add(stateTTL)}
+	return s.config.authCodeURL(state, verifier, s.account)
+}
+
+// Started reports whether state belongs to an authorization started with
+// AuthCodeURL that hasn't expired or finished
+func (s *Source) Started(state string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[state]
+	return ok && time.Now().Before(p.expires)
+}
+
+// Authorize finishes an authorization with the state and code the provider
+// redirected back with, and stores the token
+func (s *Source) Authorize(ctx context.Context, state, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[state]
+	if !ok || time.Now().After(p.expires) {
+		return fmt.Errorf("unknown or expired authorization; start again")
+	}
+	delete(s.pending, state)
+
+	token, err := s.config.exchange(ctx, code, p.verifier)
+	if err != nil {
+		return err
+	}
+	if token.RefreshToken == "" {
+		return fmt.Errorf("provider issued no refresh token; check that offline access is granted")
+	}
+	return s.save(token)
+}
+
+// AccessToken returns a valid access token, refreshing it first if it has
+// expired
+func (s *Source) AccessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.db.GetOAuthToken(s.account)
+	if err != nil {
+		return "", fmt.Errorf("failed to load token: %w", err)
+	}
+	if stored == nil || stored.RefreshToken == "" {
+		return "", ErrNotAuthorized
+	}
+	if stored.AccessToken != "" && !stored.Expiry.IsZero() && time.Now().Add(expiryMargin).Before(stored.Expiry) {
+		return stored.AccessToken, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	token, err := s.config.refresh(ctx, stored.RefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh token: %w", err)
+	}
+	if err := s.save(token); err != nil {
+		return "", fmt.Errorf("failed to store refreshed token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// Status returns the stored token, or nil if the account isn't authorized
+func (s *Source) Status() (*db.OAuthToken, error) {
+	return s.db.GetOAuthToken(s.account)
+}
+
+// Forget deletes the stored token; the account has to be authorized again
+func (s *Source) Forget() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.DeleteOAuthToken(s.account)
+}
+
+func (s *Source) save(token *Token) error {
+	return s.db.SaveOAuthToken(&db.OAuthToken{
+		Account:      s.account,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	})
+}
@@ -2,52 +2,163 @@ package poller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
+	"postal-inspection-service/internal/archive"
+	"postal-inspection-service/internal/blobstore"
 	"postal-inspection-service/internal/classifier"
 	"postal-inspection-service/internal/db"
 	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/rules"
 )
 
-// excludedFolders are folders that should not be scanned for blocked/marketing emails
-var excludedFolders = map[string]bool{
-	"Orders":                   true,
-	"USPIS":                    true,
-	"USPIS/Block":              true,
-	"USPIS/Transactional Only": true,
-	"Sent Messages":            true,
-	"Drafts":                   true,
-	"Deleted Messages":         true,
+// watchedFolders get a dedicated IDLE session so new mail is handled right away
+var watchedFolders = []string{
+	"INBOX",
+	imap.FolderBlock,
+	imap.FolderBlockDomain,
+	imap.FolderTransactionalOnly,
+	imap.FolderTransactionalOnlyDomain,
+	imap.FolderAllow,
+	imap.FolderNotMarketing,
+}
+
+// ErrNothingToApply is returned by ApplySimulated for entries that aren't
+// pending simulated actions
+var ErrNothingToApply = errors.New("no pending simulated action")
+
+// idleDebounce coalesces bursts of IDLE notifications (e.g. several messages
+// moved at once) into a single poll
+const idleDebounce = 2 * time.Second
+
+// Options configures the poller
+type Options struct {
+	// Interval between sweeps; with Idle set it is only a fallback
+	Interval time.Duration
+	// Idle processes new mail as soon as an IDLE session reports it
+	Idle bool
+	// QuarantineDays moves filtered marketing mail to USPIS/Quarantine and
+	// purges it after this many days; 0 deletes it immediately
+	QuarantineDays int
+	// DryRun only records what every rule would delete, as if all rules
+	// had their simulate flag set
+	DryRun bool
+	// ScanJunk applies every rule in the Junk or Spam folder, not only
+	// those scoped to include it
+	ScanJunk bool
+	// Classifier separates transactional from marketing mail for
+	// transactional-only senders; nil uses classifier.Default()
+	Classifier classifier.Classifier
+	// Model is trained every poll from filtered emails and corrections and
+	// consulted alongside Classifier; nil disables learning
+	Model *classifier.Bayes
+	// Blobs keeps the content of attachments of stored emails; nil keeps
+	// only their metadata
+	Blobs *blobstore.Store
+	// Archive keeps the original source of every email the poller deletes
+	// for ArchiveDays; nil turns archiving off
+	Archive     *archive.Store
+	ArchiveDays int
+	// Account identifies the mailbox in the database. Its rules are those
+	// for every account plus its own, and rules learned from its USPIS
+	// folders are scoped to it.
+	Account string
+	// Primary runs the housekeeping shared by all accounts, such as training
+	// the model and purging stored emails; exactly one poller should set it
+	Primary bool
 }
 
 type Poller struct {
-	client   *imap.Client
-	db       *db.DB
-	interval time.Duration
+	client         *imap.Client
+	db             *db.DB
+	interval       time.Duration
+	idle           bool
+	quarantineDays int
+	dryRun         bool
+	scanJunk       bool
+	classifier     classifier.Classifier
+	model          *classifier.Bayes
+	blobs          *blobstore.Store
+	archive        *archive.Store
+	archiveDays    int
+	account        string
+	primary        bool
+	trigger        chan struct{}
+
+	// deleteUnsupported is set once the server was found not to support
+	// the deletion mode, which is only reported the first time
+	deleteUnsupported bool
+}
+
+// pendingEmails are emails about to be removed from folder. Their content is
+// fetched beforehand, and the action is only logged once it was carried out.
+type pendingEmails struct {
+	folder  string
+	emails  []imap.Email
+	fetched map[uint32]*imap.FetchedEmail
+	entry   func(email imap.Email) *db.ActionLog
 }
 
-func New(client *imap.Client, database *db.DB, interval time.Duration) *Poller {
+func New(client *imap.Client, database *db.DB, opts Options) *Poller {
+	if opts.Classifier == nil {
+		opts.Classifier = classifier.Default()
+	}
+	if opts.Model != nil {
+		opts.Classifier = classifier.WithModel(opts.Classifier, opts.Model)
+	}
 	return &Poller{
-		client:   client,
-		db:       database,
-		interval: interval,
+		client:         client,
+		db:             database,
+		interval:       opts.Interval,
+		idle:           opts.Idle,
+		quarantineDays: opts.QuarantineDays,
+		dryRun:         opts.DryRun,
+		scanJunk:       opts.ScanJunk,
+		classifier:     opts.Classifier,
+		model:          opts.Model,
+		blobs:          opts.Blobs,
+		archive:        opts.Archive,
+		archiveDays:    opts.ArchiveDays,
+		account:        opts.Account,
+		primary:        opts.Primary,
+		trigger:        make(chan struct{}, 1),
 	}
 }
 
 func (p *Poller) Start(ctx context.Context) {
-	log.Printf("Starting poller with interval %v", p.interval)
+	if p.dryRun {
+		log.Println("Dry run: emails matching rules will be logged but not deleted")
+	}
+	if p.idle {
+		log.Printf("Starting poller for %s in IDLE mode with fallback sweep every %v", p.account, p.interval)
+	} else {
+		log.Printf("Starting poller for %s with interval %v", p.account, p.interval)
+	}
 
 	// Ensure USPIS folder structure exists
 	if err := p.client.CreateUSPISFolders(); err != nil {
 		log.Printf("Warning: Could not create USPIS folders: %v", err)
 	}
 
+	if err := p.client.CheckDeleteMode(); err != nil {
+		p.logRemoveError("Warning: Could not check delete mode", err)
+	}
+
 	// Start daily cleanup routine
 	go p.startDailyCleanup(ctx)
 
+	// Start IDLE watchers; the ticker below keeps running as a fallback sweep
+	if p.idle {
+		for _, folder := range watchedFolders {
+			go p.watch(ctx, folder)
+		}
+	}
+
 	// Run immediately on start
 	p.poll()
 
@@ -57,57 +168,137 @@ func (p *Poller) Start(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Poller stopped")
+			log.Printf("Poller for %s stopped", p.account)
 			return
 		case <-ticker.C:
 			p.poll()
+		case <-p.trigger:
+			// Give the server a moment to deliver the rest of a batch
+			select {
+			case <-ctx.Done():
+				continue
+			case <-time.After(idleDebounce):
+			}
+			select {
+			case <-p.trigger:
+			default:
+			}
+			log.Printf("IDLE notification received for %s", p.account)
+			p.poll()
+			ticker.Reset(p.interval)
 		}
 	}
 }
 
+// watch runs an IDLE session for a folder and wakes the poll loop on new mail
+func (p *Poller) watch(ctx context.Context, folder string) {
+	err := p.client.Watch(ctx, folder, p.notify)
+	if err != nil {
+		log.Printf("IDLE disabled for %s: %v (falling back to polling every %v)", folder, err, p.interval)
+	}
+}
+
+// notify requests a poll without blocking; pending requests are merged
+func (p *Poller) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
 func (p *Poller) poll() {
-	log.Println("Polling for emails...")
+	log.Printf("Polling %s for emails...", p.account)
 
-	// Step 1: Process USPIS/Block folder - add senders to blocked list
-	if err := p.processBlockFolder(); err != nil {
+	// Step 0: Process USPIS/Allow folder first so the allowlist is current for everything below
+	if err := p.processAllowFolder(); err != nil {
+		log.Printf("Error processing Allow folder: %v", err)
+	}
+
+	// Step 1: Process USPIS/Block folders - add senders (or their domains) to blocked list
+	if err := p.processBlockFolder(imap.FolderBlock, rules.MatchAddress); err != nil {
 		log.Printf("Error processing Block folder: %v", err)
 	}
+	if err := p.processBlockFolder(imap.FolderBlockDomain, rules.MatchSubdomains); err != nil {
+		log.Printf("Error processing Block Domain folder: %v", err)
+	}
 
-	// Step 2: Process USPIS/Transactional Only folder - add senders to transactional-only list
-	if err := p.processTransactionalOnlyFolder(); err != nil {
+	// Step 2: Process USPIS/Transactional Only folders - add senders (or their domains) to transactional-only list
+	if err := p.processTransactionalOnlyFolder(imap.FolderTransactionalOnly, rules.MatchAddress); err != nil {
 		log.Printf("Error processing Transactional Only folder: %v", err)
 	}
+	if err := p.processTransactionalOnlyFolder(imap.FolderTransactionalOnlyDomain, rules.MatchSubdomains); err != nil {
+		log.Printf("Error processing Transactional Only Domain folder: %v", err)
+	}
+
+	// Step 2b: Record emails dropped in USPIS/Not Marketing as corrections, then
+	// train the learned model on them and on everything filtered so far
+	if err := p.processNotMarketingFolder(); err != nil {
+		log.Printf("Error processing Not Marketing folder: %v", err)
+	}
+	if p.primary {
+		p.learn()
+	}
 
 	// Step 3: Delete emails from blocked senders in INBOX
 	if err := p.deleteBlockedSenderEmails(); err != nil {
-		log.Printf("Error deleting blocked sender emails: %v", err)
+		p.logRemoveError("Error deleting blocked sender emails", err)
 	}
 
 	// Step 4: Filter marketing emails from transactional-only senders
 	if err := p.filterMarketingEmails(); err != nil {
-		log.Printf("Error filtering marketing emails: %v", err)
+		p.logRemoveError("Error filtering marketing emails", err)
+	}
+
+	stats := p.client.PoolStats()
+	log.Printf("Poll of %s complete (IMAP sessions: %d reused, %d established, %d discarded, %d open)",
+		p.account, stats.Reused, stats.Established, stats.Discarded, stats.Open)
+}
+
+// logRemoveError logs an error from removing emails. A deletion mode the
+// server doesn't support fails the same way on every poll, so it is reported
+// once as a warning and the emails are left in place until it is fixed.
+func (p *Poller) logRemoveError(msg string, err error) {
+	if !errors.Is(err, imap.ErrDeleteUnsupported) {
+		log.Printf("%s: %v", msg, err)
+		return
 	}
+	if !p.deleteUnsupported {
+		p.deleteUnsupported = true
+		log.Printf("WARNING: emails in %s can't be removed and will be left in place: %v", p.account, err)
+	}
+}
 
-	log.Println("Poll complete")
+// folderRule builds the rule a dropped email creates: the sender's address, or
+// the sender's whole domain including subdomains
+func folderRule(sender string, matchType rules.MatchType) rules.Rule {
+	if matchType == rules.MatchSubdomains {
+		return rules.Rule{Pattern: rules.BaseDomain(rules.Domain(sender)), Type: rules.MatchSubdomains}
+	}
+	return rules.Rule{Pattern: sender, Type: rules.MatchAddress}
 }
 
-func (p *Poller) processBlockFolder() error {
-	emails, err := p.client.FetchFullEmailsFromBlockFolder()
+func (p *Poller) processBlockFolder(folder string, matchType rules.MatchType) error {
+	emails, err := p.client.FetchFullEmailsFromFolder(folder)
 	if err != nil {
 		if strings.Contains(err.Error(), "failed to select folder") {
-			log.Println("Block folder not found or empty")
+			log.Printf("%s folder not found or empty", folder)
 			return nil
 		}
-		return fmt.Errorf("failed to fetch emails from Block folder: %w", err)
+		return fmt.Errorf("failed to fetch emails from %s folder: %w", folder, err)
 	}
 
 	if len(emails) == 0 {
 		return nil
 	}
 
-	log.Printf("Found %d emails in USPIS/Block folder", len(emails))
+	log.Printf("Found %d emails in %s folder", len(emails), folder)
+
+	allowlist, err := p.db.GetAllowlist(p.account)
+	if err != nil {
+		return fmt.Errorf("failed to get allowlist: %w", err)
+	}
 
-	var uidsToDelete []uint32
+	var uidsToDelete, uidsToRestore []uint32
 
 	for _, email := range emails {
 		senderEmail := strings.ToLower(email.From)
@@ -115,73 +306,103 @@ func (p *Poller) processBlockFolder() error {
 			continue
 		}
 
+		// A mis-dropped email from a protected sender goes back to the inbox
+		if i := allowlist.Match(senderEmail); i >= 0 {
+			p.logSkipped(senderEmail, email.Subject, email.MessageID, folder, allowlist.Rule(i),
+				fmt.Sprintf("new blocked rule %s", folderRule(senderEmail, matchType)))
+			uidsToRestore = append(uidsToRestore, email.UID)
+			continue
+		}
+
 		// Save email details to database
 		emailDetailID, saveErr := p.saveEmailDetail(&email)
 		if saveErr != nil {
 			log.Printf("Error saving email detail: %v", saveErr)
 		}
 
-		blocked, err := p.db.IsBlocked(senderEmail)
-		if err != nil {
-			log.Printf("Error checking if sender is blocked: %v", err)
-			continue
+		// A sender already covered by a domain rule needs no address rule
+		blocked := false
+		if matchType == rules.MatchAddress {
+			blocked, err = p.db.IsBlocked(p.account, senderEmail)
+			if err != nil {
+				log.Printf("Error checking if sender is blocked: %v", err)
+				continue
+			}
 		}
 
 		if !blocked {
-			reason := fmt.Sprintf("Moved to Block folder: %s", email.Subject)
-			if err := p.db.AddBlockedSender(senderEmail, reason); err != nil {
+			rule := folderRule(senderEmail, matchType)
+			added, err := p.db.AddBlockedSender(&db.BlockedSender{
+				Email:     rule.Pattern,
+				MatchType: rule.Type,
+				Reason:    fmt.Sprintf("Moved to %s folder: %s", folder, email.Subject),
+				Account:   p.account,
+			})
+			if err != nil {
 				log.Printf("Error adding blocked sender: %v", err)
-			} else {
-				log.Printf("Blocked sender: %s", senderEmail)
+			} else if added {
+				log.Printf("Blocked sender: %s", rule)
 				p.logActionWithEmailDetail(
 					db.ActionBlockedSender,
-					senderEmail,
+					rule.String(),
 					email.Subject,
 					email.MessageID,
-					"Blocked via USPIS/Block folder",
+					fmt.Sprintf("Blocked via %s folder", folder),
 					emailDetailID,
 				)
 			}
 		}
 
 		uidsToDelete = append(uidsToDelete, email.UID)
-		p.logActionWithEmailDetail(
+		actionLogID := p.logActionWithEmailDetail(
 			db.ActionDeletedEmail,
 			senderEmail,
 			email.Subject,
 			email.MessageID,
-			"Deleted from Block folder",
+			fmt.Sprintf("Deleted from %s folder", folder),
 			emailDetailID,
 		)
+		p.archiveEmail(&email, folder, actionLogID)
+	}
+
+	if len(uidsToRestore) > 0 {
+		if _, err := p.client.MoveEmailsToFolder(map[string][]uint32{folder: uidsToRestore}, "INBOX"); err != nil {
+			log.Printf("Error moving allowlisted emails back to INBOX: %v", err)
+		}
 	}
 
 	if len(uidsToDelete) > 0 {
-		if err := p.client.DeleteEmailsFromBlockFolder(uidsToDelete); err != nil {
-			return fmt.Errorf("failed to delete emails from Block folder: %w", err)
+		if err := p.client.DeleteEmails(folder, uidsToDelete); err != nil {
+			return fmt.Errorf("failed to delete emails from %s folder: %w", folder, err)
 		}
-		log.Printf("Deleted %d emails from Block folder", len(uidsToDelete))
+		log.Printf("Deleted %d emails from %s folder", len(uidsToDelete), folder)
 	}
 
 	return nil
 }
 
-func (p *Poller) processTransactionalOnlyFolder() error {
-	emails, err := p.client.FetchFullEmailsFromTransactionalOnlyFolder()
+func (p *Poller) processTransactionalOnlyFolder(folder string, matchType rules.MatchType) error {
+	emails, err := p.client.FetchFullEmailsFromFolder(folder)
 	if err != nil {
 		if strings.Contains(err.Error(), "failed to select folder") {
-			log.Println("Transactional Only folder not found or empty")
+			log.Printf("%s folder not found or empty", folder)
 			return nil
 		}
-		return fmt.Errorf("failed to fetch emails from Transactional Only folder: %w", err)
+		return fmt.Errorf("failed to fetch emails from %s folder: %w", folder, err)
 	}
 
 	if len(emails) == 0 {
 		return nil
 	}
 
-	log.Printf("Found %d emails in USPIS/Transactional Only folder", len(emails))
+	log.Printf("Found %d emails in %s folder", len(emails), folder)
 
-	var uidsToDelete []uint32
+	allowlist, err := p.db.GetAllowlist(p.account)
+	if err != nil {
+		return fmt.Errorf("failed to get allowlist: %w", err)
+	}
+
+	var uidsToDelete, uidsToRestore []uint32
 
 	for _, email := range emails {
 		senderEmail := strings.ToLower(email.From)
@@ -189,58 +410,212 @@ func (p *Poller) processTransactionalOnlyFolder() error {
 			continue
 		}
 
+		// A mis-dropped email from a protected sender goes back to the inbox
+		if i := allowlist.Match(senderEmail); i >= 0 {
+			p.logSkipped(senderEmail, email.Subject, email.MessageID, folder, allowlist.Rule(i),
+				fmt.Sprintf("new transactional-only rule %s", folderRule(senderEmail, matchType)))
+			uidsToRestore = append(uidsToRestore, email.UID)
+			continue
+		}
+
 		// Save email details to database
 		emailDetailID, saveErr := p.saveEmailDetail(&email)
 		if saveErr != nil {
 			log.Printf("Error saving email detail: %v", saveErr)
 		}
 
-		isTransactionalOnly, err := p.db.IsTransactionalOnly(senderEmail)
-		if err != nil {
-			log.Printf("Error checking if sender is transactional-only: %v", err)
-			continue
+		// A sender already covered by a domain rule needs no address rule
+		isTransactionalOnly := false
+		if matchType == rules.MatchAddress {
+			isTransactionalOnly, err = p.db.IsTransactionalOnly(p.account, senderEmail)
+			if err != nil {
+				log.Printf("Error checking if sender is transactional-only: %v", err)
+				continue
+			}
 		}
 
 		if !isTransactionalOnly {
-			reason := fmt.Sprintf("Moved to Transactional Only folder: %s", email.Subject)
-			if err := p.db.AddTransactionalOnlySender(senderEmail, reason); err != nil {
+			rule := folderRule(senderEmail, matchType)
+			added, err := p.db.AddTransactionalOnlySender(&db.TransactionalOnlySender{
+				Email:     rule.Pattern,
+				MatchType: rule.Type,
+				Reason:    fmt.Sprintf("Moved to %s folder: %s", folder, email.Subject),
+				Account:   p.account,
+			})
+			if err != nil {
 				log.Printf("Error adding transactional-only sender: %v", err)
-			} else {
-				log.Printf("Added transactional-only sender: %s", senderEmail)
+			} else if added {
+				log.Printf("Added transactional-only sender: %s", rule)
 				p.logActionWithEmailDetail(
 					db.ActionTransactionalOnlySender,
-					senderEmail,
+					rule.String(),
 					email.Subject,
 					email.MessageID,
-					"Added via USPIS/Transactional Only folder - marketing emails will be deleted",
+					fmt.Sprintf("Added via %s folder - marketing emails will be deleted", folder),
 					emailDetailID,
 				)
 			}
 		}
 
 		uidsToDelete = append(uidsToDelete, email.UID)
-		p.logActionWithEmailDetail(
+		actionLogID := p.logActionWithEmailDetail(
 			db.ActionDeletedEmail,
 			senderEmail,
 			email.Subject,
 			email.MessageID,
-			"Deleted from Transactional Only folder",
+			fmt.Sprintf("Deleted from %s folder", folder),
 			emailDetailID,
 		)
+		p.archiveEmail(&email, folder, actionLogID)
+	}
+
+	if len(uidsToRestore) > 0 {
+		if _, err := p.client.MoveEmailsToFolder(map[string][]uint32{folder: uidsToRestore}, "INBOX"); err != nil {
+			log.Printf("Error moving allowlisted emails back to INBOX: %v", err)
+		}
 	}
 
 	if len(uidsToDelete) > 0 {
-		if err := p.client.DeleteEmailsFromTransactionalOnlyFolder(uidsToDelete); err != nil {
-			return fmt.Errorf("failed to delete emails from Transactional Only folder: %w", err)
+		if err := p.client.DeleteEmails(folder, uidsToDelete); err != nil {
+			return fmt.Errorf("failed to delete emails from %s folder: %w", folder, err)
+		}
+		log.Printf("Deleted %d emails from %s folder", len(uidsToDelete), folder)
+	}
+
+	return nil
+}
+
+// processAllowFolder adds the senders of emails dropped into USPIS/Allow to the
+// allowlist and moves the emails back to the inbox
+func (p *Poller) processAllowFolder() error {
+	emails, err := p.client.FetchFullEmailsFromFolder(imap.FolderAllow)
+	if err != nil {
+		if strings.Contains(err.Error(), "failed to select folder") {
+			log.Println("Allow folder not found or empty")
+			return nil
+		}
+		return fmt.Errorf("failed to fetch emails from Allow folder: %w", err)
+	}
+
+	if len(emails) == 0 {
+		return nil
+	}
+
+	log.Printf("Found %d emails in %s folder", len(emails), imap.FolderAllow)
+
+	var uids []uint32
+	for _, email := range emails {
+		uids = append(uids, email.UID)
+
+		senderEmail := strings.ToLower(email.From)
+		if senderEmail == "" {
+			continue
+		}
+
+		added, err := p.db.AddAllowedSender(&db.AllowedSender{
+			Email:     senderEmail,
+			MatchType: rules.MatchAddress,
+			Reason:    fmt.Sprintf("Moved to %s folder: %s", imap.FolderAllow, email.Subject),
+			Account:   p.account,
+		})
+		if err != nil {
+			log.Printf("Error adding allowed sender: %v", err)
+			continue
+		}
+		if added {
+			log.Printf("Allowlisted sender: %s", senderEmail)
+			p.logActionWithEmailDetail(
+				db.ActionAllowedSender,
+				senderEmail,
+				email.Subject,
+				email.MessageID,
+				fmt.Sprintf("Allowlisted via %s folder - no rule will touch this sender", imap.FolderAllow),
+				0,
+			)
+		}
+	}
+
+	if _, err := p.client.MoveEmailsToFolder(map[string][]uint32{imap.FolderAllow: uids}, "INBOX"); err != nil {
+		return fmt.Errorf("failed to move emails back to INBOX: %w", err)
+	}
+	log.Printf("Moved %d emails from %s back to INBOX", len(uids), imap.FolderAllow)
+	return nil
+}
+
+// processNotMarketingFolder records emails the user says were wrongly
+// treated as marketing and moves them back to INBOX
+func (p *Poller) processNotMarketingFolder() error {
+	emails, err := p.client.FetchFullEmailsFromFolder(imap.FolderNotMarketing)
+	if err != nil {
+		if strings.Contains(err.Error(), "failed to select folder") {
+			log.Println("Not Marketing folder not found or empty")
+			return nil
+		}
+		return fmt.Errorf("failed to fetch emails from Not Marketing folder: %w", err)
+	}
+
+	if len(emails) == 0 {
+		return nil
+	}
+
+	log.Printf("Found %d emails in %s folder", len(emails), imap.FolderNotMarketing)
+
+	var uids []uint32
+	for _, email := range emails {
+		uids = append(uids, email.UID)
+
+		emailDetailID, err := p.saveEmailDetail(&email)
+		if err != nil {
+			log.Printf("Error saving email detail: %v", err)
+		}
+		correction := &db.ClassifierCorrection{
+			Sender:          strings.ToLower(email.From),
+			Subject:         email.Subject,
+			MessageID:       email.MessageID,
+			IsTransactional: true,
+			Source:          db.CorrectionSourceNotMarketing,
+		}
+		if emailDetailID != 0 {
+			correction.EmailDetailID = &emailDetailID
 		}
-		log.Printf("Deleted %d emails from Transactional Only folder", len(uidsToDelete))
+		if err := p.db.AddClassifierCorrection(correction); err != nil {
+			log.Printf("Error recording classifier correction: %v", err)
+			continue
+		}
+
+		p.logActionWithEmailDetail(
+			db.ActionMarkedTransactional,
+			correction.Sender,
+			email.Subject,
+			email.MessageID,
+			fmt.Sprintf("Marked as transactional via %s folder", imap.FolderNotMarketing),
+			emailDetailID,
+		)
 	}
 
+	if _, err := p.client.MoveEmailsToFolder(map[string][]uint32{imap.FolderNotMarketing: uids}, "INBOX"); err != nil {
+		return fmt.Errorf("failed to move emails back to INBOX: %w", err)
+	}
+	log.Printf("Moved %d emails from %s back to INBOX", len(uids), imap.FolderNotMarketing)
 	return nil
 }
 
+// learn trains the learned model on anything it hasn't seen yet
+func (p *Poller) learn() {
+	if p.model == nil {
+		return
+	}
+	trained, err := p.model.Learn()
+	if err != nil {
+		log.Printf("Error training classifier model: %v", err)
+	}
+	if trained > 0 {
+		log.Printf("Trained classifier model on %d emails", trained)
+	}
+}
+
 func (p *Poller) deleteBlockedSenderEmails() error {
-	blockedSenders, err := p.db.GetBlockedSenders()
+	blockedSenders, err := p.db.GetBlockedSenders(p.account)
 	if err != nil {
 		return fmt.Errorf("failed to get blocked senders: %w", err)
 	}
@@ -250,99 +625,112 @@ func (p *Poller) deleteBlockedSenderEmails() error {
 		return nil
 	}
 
-	senderAddresses := make([]string, len(blockedSenders))
+	senderRules := make([]scopedRule, len(blockedSenders))
 	for i, s := range blockedSenders {
-		senderAddresses[i] = s.Email
+		senderRules[i] = scopedRule{
+			rule:     s.Rule(),
+			simulate: p.dryRun || s.Simulate,
+			scope:    s.FolderScope,
+			except:   s.ExceptFolders,
+		}
 	}
-	log.Printf("Checking %d blocked senders", len(senderAddresses))
+	log.Printf("Checking %d blocked senders", len(senderRules))
 
-	// Get all folders and filter excluded ones
-	allFolders, err := p.client.ListFolders()
+	allowlist, err := p.db.GetAllowlist(p.account)
 	if err != nil {
-		return fmt.Errorf("failed to list folders: %w", err)
+		return fmt.Errorf("failed to get allowlist: %w", err)
 	}
 
-	var folders []string
-	for _, folder := range allFolders {
-		if !excludedFolders[folder] {
-			folders = append(folders, folder)
-		}
+	scoped, err := p.scopeRules(senderRules)
+	if err != nil {
+		return err
 	}
-	log.Printf("Scanning %d folders (excluded %d)", len(folders), len(allFolders)-len(folders))
 
-	// Scan all folders with a single connection
-	results, err := p.client.ScanFoldersForSenders(folders, senderAddresses)
+	// Scan all folders with a single connection, only looking at new emails
+	since, generation := p.loadScanState(db.ScanScopeBlocked)
+	results, states, err := p.client.ScanFoldersForSenders(scoped.folders, scoped.all, since)
 	if err != nil {
 		return fmt.Errorf("failed to scan folders: %w", err)
 	}
 
 	if len(results) == 0 {
 		log.Println("No emails found from blocked senders")
+		p.saveScanState(db.ScanScopeBlocked, generation, states)
 		return nil
 	}
 
-	// Collect UIDs per folder, fetch full content, save, then delete
+	// Collect UIDs per folder, fetch full content, delete, then save
+	var pending []pendingEmails
 	toDelete := make(map[string][]uint32)
-	var totalDeleted int
+	var totalDeleted, totalSimulated int
 
 	for _, result := range results {
-		log.Printf("Found %d emails from blocked senders in %s", len(result.Emails), result.Folder)
-
-		// Collect UIDs for this folder
-		var uids []uint32
-		for _, email := range result.Emails {
-			uids = append(uids, email.UID)
+		matcher, simulated, found := scoped.match(result)
+		if len(found) == 0 {
+			continue
 		}
-
-		// Fetch full content for these emails
-		fullEmails, err := p.client.FetchFullEmailsByUIDs(result.Folder, uids)
-		if err != nil {
-			log.Printf("Error fetching full emails from %s: %v", result.Folder, err)
-			// Fall back to logging without email content
-			for _, email := range result.Emails {
-				p.db.LogAction(
-					db.ActionDeletedEmail,
-					email.From,
-					email.Subject,
-					email.MessageID,
-					fmt.Sprintf("Auto-deleted email from blocked sender (folder: %s)", result.Folder),
-				)
-			}
-		} else {
-			// Save full content and log with reference
-			for _, fullEmail := range fullEmails {
-				emailDetailID, saveErr := p.saveEmailDetail(&fullEmail)
-				if saveErr != nil {
-					log.Printf("Error saving email detail: %v", saveErr)
-				}
-				p.logActionWithEmailDetail(
-					db.ActionDeletedEmail,
-					fullEmail.From,
-					fullEmail.Subject,
-					fullEmail.MessageID,
-					fmt.Sprintf("Auto-deleted email from blocked sender (folder: %s)", result.Folder),
-					emailDetailID,
-				)
-			}
+		log.Printf("Found %d emails from blocked senders in %s", len(found), result.Folder)
+
+		emails := p.skipRestored(result.Folder, found)
+		emails = p.skipAllowlisted(result.Folder, emails, allowlist, func(email imap.Email) string {
+			return "blocked rule " + matcher.Rule(matcher.Match(email.From)).String()
+		})
+		act, simulate := p.partitionSimulated(emails, matcher, simulated)
+
+		if len(act) > 0 {
+			pending = append(pending, pendingEmails{
+				folder:  result.Folder,
+				emails:  act,
+				fetched: p.fetchFullEmails(result.Folder, act),
+				entry: func(email imap.Email) *db.ActionLog {
+					return &db.ActionLog{
+						Action:    db.ActionDeletedEmail,
+						Sender:    email.From,
+						Subject:   email.Subject,
+						MessageID: email.MessageID,
+						Details:   fmt.Sprintf("Auto-deleted email from blocked sender (folder: %s)", result.Folder),
+						Folder:    result.Folder,
+					}
+				},
+			})
+			toDelete[result.Folder] = emailUIDs(act)
 		}
-
-		toDelete[result.Folder] = uids
-		totalDeleted += len(uids)
+		p.recordEmails(result.Folder, simulate, func(email imap.Email) *db.ActionLog {
+			return &db.ActionLog{
+				Action:    db.ActionWouldDelete,
+				Sender:    email.From,
+				Subject:   email.Subject,
+				MessageID: email.MessageID,
+				Details:   fmt.Sprintf("Would delete email from blocked sender (folder: %s)", result.Folder),
+				Folder:    result.Folder,
+			}
+		})
+		totalSimulated += len(simulate)
 	}
 
 	// Delete all with a single connection
-	if err := p.client.DeleteEmailsFromFolders(toDelete); err != nil {
-		return fmt.Errorf("failed to delete emails: %w", err)
+	var deleteErr error
+	if len(toDelete) > 0 {
+		var deleted []string
+		deleted, deleteErr = p.client.DeleteEmailsFromFolders(toDelete)
+		totalDeleted = p.logRemoved(pending, deleted, states)
+	}
+	p.saveScanState(db.ScanScopeBlocked, generation, states)
+	if deleteErr != nil {
+		return fmt.Errorf("failed to delete emails: %w", deleteErr)
 	}
 
 	if totalDeleted > 0 {
 		log.Printf("Deleted %d total emails from blocked senders across all folders", totalDeleted)
 	}
+	if totalSimulated > 0 {
+		log.Printf("Simulated deleting %d emails from blocked senders", totalSimulated)
+	}
 	return nil
 }
 
 func (p *Poller) filterMarketingEmails() error {
-	transactionalOnlySenders, err := p.db.GetTransactionalOnlySenders()
+	transactionalOnlySenders, err := p.db.GetTransactionalOnlySenders(p.account)
 	if err != nil {
 		return fmt.Errorf("failed to get transactional-only senders: %w", err)
 	}
@@ -352,122 +740,404 @@ func (p *Poller) filterMarketingEmails() error {
 		return nil
 	}
 
-	senderAddresses := make([]string, len(transactionalOnlySenders))
+	senderRules := make([]scopedRule, len(transactionalOnlySenders))
 	for i, s := range transactionalOnlySenders {
-		senderAddresses[i] = s.Email
+		senderRules[i] = scopedRule{
+			rule:     s.Rule(),
+			simulate: p.dryRun || s.Simulate,
+			scope:    s.FolderScope,
+			except:   s.ExceptFolders,
+		}
 	}
-	log.Printf("Checking %d transactional-only senders", len(senderAddresses))
+	log.Printf("Checking %d transactional-only senders", len(senderRules))
 
-	// Get all folders and filter excluded ones
-	allFolders, err := p.client.ListFolders()
+	allowlist, err := p.db.GetAllowlist(p.account)
 	if err != nil {
-		return fmt.Errorf("failed to list folders: %w", err)
+		return fmt.Errorf("failed to get allowlist: %w", err)
 	}
 
-	var folders []string
-	for _, folder := range allFolders {
-		if !excludedFolders[folder] {
-			folders = append(folders, folder)
-		}
+	scoped, err := p.scopeRules(senderRules)
+	if err != nil {
+		return err
 	}
 
-	// Scan all folders with a single connection
-	results, err := p.client.ScanFoldersForSenders(folders, senderAddresses)
+	// Scan all folders with a single connection, only looking at new emails
+	since, generation := p.loadScanState(db.ScanScopeTransactionalOnly)
+	results, states, err := p.client.ScanFoldersForSenders(scoped.folders, scoped.all, since)
 	if err != nil {
 		return fmt.Errorf("failed to scan folders: %w", err)
 	}
 
 	if len(results) == 0 {
+		p.saveScanState(db.ScanScopeTransactionalOnly, generation, states)
 		return nil
 	}
 
 	// Process results: classify, fetch full content for deletions, save, delete
+	// (or move to the quarantine folder when a grace period is configured)
+	quarantine := p.quarantineDays > 0
+	action, verb, wouldVerb := db.ActionDeletedMarketing, "Deleted", "delete"
+	if quarantine {
+		action, verb, wouldVerb = db.ActionQuarantined, "Quarantined", "quarantine"
+	}
+
+	var pendingQuarantine, pendingDelete []pendingEmails
+	toQuarantine := make(map[string][]uint32)
 	toDelete := make(map[string][]uint32)
-	var totalDeleted, totalKept int
+	var totalDeleted, totalKept, totalSimulated int
 
 	for _, result := range results {
-		// First pass: classify and collect UIDs to delete
-		var uidsToDelete []uint32
+		matcher, simulated, found := scoped.match(result)
+		if len(found) == 0 {
+			continue
+		}
+
+		// First pass: classify and collect emails to delete
+		var marketing []imap.Email
 		classificationReasons := make(map[uint32]string) // UID -> reason
+		modelScores := make(map[uint32]*float64)         // UID -> learned model score
+
+		// Released emails come back under a new UID; the user's verdict
+		// stands over the classifier's
+		var unmarked []imap.Email
+		for _, email := range p.skipRestored(result.Folder, found) {
+			marked, err := p.db.IsMarkedTransactional(email.MessageID)
+			if err != nil {
+				log.Printf("Error checking corrections for %s: %v", email.MessageID, err)
+			}
+			if marked {
+				totalKept++
+				log.Printf("Keeping email from %s in %s marked as transactional by the user: %s",
+					email.From, result.Folder, email.Subject)
+				continue
+			}
+			unmarked = append(unmarked, email)
+		}
 
-		for _, email := range result.Emails {
-			classification := classifier.Classify(email.Subject)
+		contents := p.fetchForClassification(result.Folder, unmarked)
+		for _, email := range unmarked {
+			classification := p.classifier.Classify(contents[email.UID])
+			reason := fmt.Sprintf("%s; %s", classification.Reason, classification.Explanation())
 
 			if classification.IsTransactional {
 				totalKept++
 				log.Printf("Keeping transactional email from %s in %s: %s (%s)",
-					email.From, result.Folder, email.Subject, classification.Reason)
+					email.From, result.Folder, email.Subject, reason)
 			} else {
-				uidsToDelete = append(uidsToDelete, email.UID)
-				classificationReasons[email.UID] = classification.Reason
+				marketing = append(marketing, email)
+				classificationReasons[email.UID] = reason
+				modelScores[email.UID] = classification.ModelScore
 				log.Printf("Deleting marketing email from %s in %s: %s (%s)",
-					email.From, result.Folder, email.Subject, classification.Reason)
+					email.From, result.Folder, email.Subject, reason)
 			}
 		}
 
-		if len(uidsToDelete) == 0 {
+		marketing = p.skipAllowlisted(result.Folder, marketing, allowlist, func(email imap.Email) string {
+			return fmt.Sprintf("transactional-only rule %s (reason: %s)",
+				matcher.Rule(matcher.Match(email.From)), classificationReasons[email.UID])
+		})
+		if len(marketing) == 0 {
 			continue
 		}
 
-		// Fetch full content for emails being deleted
-		fullEmails, err := p.client.FetchFullEmailsByUIDs(result.Folder, uidsToDelete)
-		if err != nil {
-			log.Printf("Error fetching full emails from %s: %v", result.Folder, err)
-			// Fall back to logging without email content
-			for _, email := range result.Emails {
-				if reason, ok := classificationReasons[email.UID]; ok {
-					p.db.LogAction(
-						db.ActionDeletedMarketing,
-						email.From,
-						email.Subject,
-						email.MessageID,
-						fmt.Sprintf("Deleted marketing email from folder %s (reason: %s)", result.Folder, reason),
-					)
-				}
+		act, simulate := p.partitionSimulated(marketing, matcher, simulated)
+
+		logEntry := func(email imap.Email) *db.ActionLog {
+			entry := &db.ActionLog{
+				Action:     action,
+				Sender:     email.From,
+				Subject:    email.Subject,
+				MessageID:  email.MessageID,
+				Details:    fmt.Sprintf("%s marketing email from folder %s (reason: %s)", verb, result.Folder, classificationReasons[email.UID]),
+				Folder:     result.Folder,
+				ModelScore: modelScores[email.UID],
 			}
-		} else {
-			// Save full content and log with reference
-			for _, fullEmail := range fullEmails {
-				reason := classificationReasons[fullEmail.UID]
-				emailDetailID, saveErr := p.saveEmailDetail(&fullEmail)
-				if saveErr != nil {
-					log.Printf("Error saving email detail: %v", saveErr)
-				}
-				p.logActionWithEmailDetail(
-					db.ActionDeletedMarketing,
-					fullEmail.From,
-					fullEmail.Subject,
-					fullEmail.MessageID,
-					fmt.Sprintf("Deleted marketing email from folder %s (reason: %s)", result.Folder, reason),
-					emailDetailID,
-				)
+			// Quarantined emails are found again by Message-ID, so one
+			// without is deleted right away
+			if quarantine && email.MessageID == "" {
+				entry.Action = db.ActionDeletedMarketing
+				entry.Details = fmt.Sprintf("Deleted marketing email without a Message-ID from folder %s instead of quarantining it (reason: %s)",
+					result.Folder, classificationReasons[email.UID])
 			}
+			return entry
 		}
+		p.recordEmails(result.Folder, simulate, func(email imap.Email) *db.ActionLog {
+			return &db.ActionLog{
+				Action:     db.ActionWouldDeleteMarketing,
+				Sender:     email.From,
+				Subject:    email.Subject,
+				MessageID:  email.MessageID,
+				Details:    fmt.Sprintf("Would %s marketing email from folder %s (reason: %s)", wouldVerb, result.Folder, classificationReasons[email.UID]),
+				Folder:     result.Folder,
+				ModelScore: modelScores[email.UID],
+			}
+		})
 
-		toDelete[result.Folder] = uidsToDelete
-		totalDeleted += len(uidsToDelete)
+		var moving, deleting []imap.Email
+		for _, email := range act {
+			if quarantine && email.MessageID != "" {
+				moving = append(moving, email)
+				toQuarantine[result.Folder] = append(toQuarantine[result.Folder], email.UID)
+			} else {
+				if quarantine {
+					log.Printf("Deleting marketing email from %s in %s instead of quarantining it: no Message-ID", email.From, result.Folder)
+				}
+				deleting = append(deleting, email)
+				toDelete[result.Folder] = append(toDelete[result.Folder], email.UID)
+			}
+		}
+		// Fetch full content for emails being removed while it's still there
+		fetched := p.fetchFullEmails(result.Folder, act)
+		if len(moving) > 0 {
+			pendingQuarantine = append(pendingQuarantine, pendingEmails{result.Folder, moving, fetched, logEntry})
+		}
+		if len(deleting) > 0 {
+			pendingDelete = append(pendingDelete, pendingEmails{result.Folder, deleting, fetched, logEntry})
+		}
+		totalSimulated += len(simulate)
 	}
 
-	// Delete all with a single connection
+	// Quarantine and delete all with a single connection each. Emails that
+	// were removed are logged even if others failed, or they would never be
+	// purged; folders that failed are scanned again next time.
+	var quarantineErr, deleteErr error
+	if len(toQuarantine) > 0 {
+		var moved []string
+		moved, quarantineErr = p.client.MoveEmailsToFolder(toQuarantine, imap.FolderQuarantine)
+		totalDeleted += p.logRemoved(pendingQuarantine, moved, states)
+	}
 	if len(toDelete) > 0 {
-		if err := p.client.DeleteEmailsFromFolders(toDelete); err != nil {
-			return fmt.Errorf("failed to delete marketing emails: %w", err)
-		}
+		var deleted []string
+		deleted, deleteErr = p.client.DeleteEmailsFromFolders(toDelete)
+		totalDeleted += p.logRemoved(pendingDelete, deleted, states)
+	}
+	p.saveScanState(db.ScanScopeTransactionalOnly, generation, states)
+	if deleteErr != nil {
+		return fmt.Errorf("failed to delete marketing emails: %w", deleteErr)
+	}
+	if quarantineErr != nil {
+		return fmt.Errorf("failed to quarantine marketing emails: %w", quarantineErr)
 	}
 
 	if totalDeleted > 0 || totalKept > 0 {
-		log.Printf("Deleted %d marketing emails, kept %d transactional emails across all folders",
-			totalDeleted, totalKept)
+		log.Printf("%s %d marketing emails, kept %d transactional emails across all folders",
+			verb, totalDeleted, totalKept)
+	}
+	if totalSimulated > 0 {
+		log.Printf("Simulated filtering %d marketing emails", totalSimulated)
 	}
 
 	return nil
 }
 
+// fetchForClassification downloads the headers and start of the body of each
+// email for the classifier. Emails that can't be fetched are classified from
+// their envelope alone.
+func (p *Poller) fetchForClassification(folder string, emails []imap.Email) map[uint32]*imap.FetchedEmail {
+	contents := make(map[uint32]*imap.FetchedEmail, len(emails))
+
+	fetched, err := p.client.FetchEmailsForClassification(folder, emailUIDs(emails))
+	if err != nil {
+		log.Printf("Error fetching emails for classification in %s, using subjects only: %v", folder, err)
+	}
+	for i := range fetched {
+		contents[fetched[i].UID] = &fetched[i]
+	}
+
+	for _, email := range emails {
+		if contents[email.UID] == nil {
+			contents[email.UID] = &imap.FetchedEmail{
+				UID:       email.UID,
+				MessageID: email.MessageID,
+				From:      email.From,
+				Subject:   email.Subject,
+			}
+		}
+	}
+	return contents
+}
+
+// LoadFolderPolicy returns the folder policy of account with the folders the
+// user included or excluded on the dashboard. With scanJunk set, spam folders
+// are scanned like any other.
+func LoadFolderPolicy(database *db.DB, account string, scanJunk bool) (imap.FolderPolicy, error) {
+	overrides, err := database.GetFolderOverrides(account)
+	if err != nil {
+		return imap.FolderPolicy{}, err
+	}
+
+	// An account's own override replaces one for every account, which
+	// comes first
+	modes := make(map[string]string)
+	for _, o := range overrides {
+		modes[o.Folder] = o.Mode
+	}
+	policy := imap.FolderPolicy{ScanJunk: scanJunk}
+	for folder, mode := range modes {
+		if mode == db.FolderInclude {
+			policy.Include = append(policy.Include, folder)
+		} else {
+			policy.Exclude = append(policy.Exclude, folder)
+		}
+	}
+	return policy, nil
+}
+
+// scopedRule is a sender rule and the folders it acts in
+type scopedRule struct {
+	rule     rules.Rule
+	simulate bool
+	scope    rules.FolderScope
+	except   []string
+}
+
+// folders returns the folders of a mailbox the rule acts in under policy
+func (r scopedRule) folders(policy imap.FolderPolicy, all []imap.Folder) []string {
+	switch r.scope {
+	case rules.ScopeInbox:
+		for _, folder := range policy.Select(all) {
+			if strings.EqualFold(folder, "INBOX") {
+				return []string{folder}
+			}
+		}
+		return nil
+	case rules.ScopeExcept:
+		policy.Exclude = append(slices.Clip(policy.Exclude), r.except...)
+	case rules.ScopeJunk:
+		policy.ScanJunk = true
+	}
+	return policy.Select(all)
+}
+
+// scopedRules holds a set of sender rules sorted by the folders they act in
+type scopedRules struct {
+	folders  []string       // Every folder at least one rule acts in
+	all      *rules.Matcher // All the rules, to find candidates in one scan
+	byFolder map[string]folderRules
+}
+
+// folderRules are the rules that act in one folder, and whether each only
+// simulates
+type folderRules struct {
+	matcher   *rules.Matcher
+	simulated []bool
+}
+
+// scopeRules works out which rules act in which folders of the mailbox
+func (p *Poller) scopeRules(scoped []scopedRule) (*scopedRules, error) {
+	all, err := p.client.ListFolders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folders: %w", err)
+	}
+	policy, err := LoadFolderPolicy(p.db, p.account, p.scanJunk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load folder policy: %w", err)
+	}
+
+	result := groupRules(scoped, policy, all)
+	log.Printf("Scanning %d folders (skipped %d)", len(result.folders), len(all)-len(result.folders))
+	return result, nil
+}
+
+// groupRules sorts rules by the folders of a mailbox they act in under policy
+func groupRules(scoped []scopedRule, policy imap.FolderPolicy, all []imap.Folder) *scopedRules {
+	perFolder := make(map[string][]scopedRule)
+	senderRules := make([]rules.Rule, len(scoped))
+	for i, r := range scoped {
+		senderRules[i] = r.rule
+		for _, folder := range r.folders(policy, all) {
+			perFolder[folder] = append(perFolder[folder], r)
+		}
+	}
+
+	result := &scopedRules{
+		all:      rules.NewMatcher(senderRules),
+		byFolder: make(map[string]folderRules),
+	}
+	for _, f := range all {
+		folderScoped := perFolder[f.Name]
+		if len(folderScoped) == 0 {
+			continue
+		}
+		folderRuleList := make([]rules.Rule, len(folderScoped))
+		simulated := make([]bool, len(folderScoped))
+		for i, r := range folderScoped {
+			folderRuleList[i] = r.rule
+			simulated[i] = r.simulate
+		}
+		result.folders = append(result.folders, f.Name)
+		result.byFolder[f.Name] = folderRules{matcher: rules.NewMatcher(folderRuleList), simulated: simulated}
+	}
+	return result
+}
+
+// match returns the emails of a scan result that a rule acting in its folder
+// matches, with the matcher and simulate flags of those rules
+func (s *scopedRules) match(result imap.FolderEmails) (*rules.Matcher, []bool, []imap.Email) {
+	folder, ok := s.byFolder[result.Folder]
+	if !ok {
+		return nil, nil, nil
+	}
+	var matched []imap.Email
+	for _, email := range result.Emails {
+		if folder.matcher.Match(email.From) >= 0 {
+			matched = append(matched, email)
+		}
+	}
+	return folder.matcher, folder.simulated, matched
+}
+
+// loadScanState returns the stored incremental scan position of each folder
+// for a scope and the generation to save the positions reached under
+func (p *Poller) loadScanState(scope string) (map[string]imap.FolderState, int64) {
+	stored, generation, err := p.db.GetFolderStates(p.account, scope)
+	if err != nil {
+		log.Printf("Error loading folder state, doing a full scan: %v", err)
+		return nil, -1
+	}
+
+	states := make(map[string]imap.FolderState, len(stored))
+	for folder, s := range stored {
+		states[folder] = imap.FolderState{
+			UIDValidity:   s.UIDValidity,
+			LastUID:       s.LastUID,
+			HighestModSeq: s.HighestModSeq,
+		}
+	}
+	return states, generation
+}
+
+// saveScanState records how far each folder has been scanned for a scope,
+// unless a rule change reset the state after it was loaded at generation
+func (p *Poller) saveScanState(scope string, generation int64, states map[string]imap.FolderState) {
+	if generation < 0 {
+		// The stored state couldn't be loaded, so keep doing full scans
+		return
+	}
+
+	stored := make([]db.FolderState, 0, len(states))
+	for folder, s := range states {
+		stored = append(stored, db.FolderState{
+			Folder:        folder,
+			UIDValidity:   s.UIDValidity,
+			LastUID:       s.LastUID,
+			HighestModSeq: s.HighestModSeq,
+		})
+	}
+	saved, err := p.db.SaveFolderStates(p.account, scope, generation, stored)
+	if err != nil {
+		log.Printf("Error saving folder state: %v", err)
+	} else if !saved {
+		log.Printf("Rules changed during the %s scan of %s, rescanning next time", scope, p.account)
+	}
+}
+
 // saveEmailDetail saves email details to the database and returns the ID
 func (p *Poller) saveEmailDetail(email *imap.FetchedEmail) (int64, error) {
 	detail := &db.EmailDetail{
 		MessageID:      email.MessageID,
 		Sender:         email.From,
+		SenderName:     email.FromName,
 		Recipients:     email.To,
 		Subject:        email.Subject,
 		Date:           email.Date,
@@ -475,24 +1145,374 @@ func (p *Poller) saveEmailDetail(email *imap.FetchedEmail) (int64, error) {
 		BodyText:       email.BodyText,
 		BodyHTML:       email.BodyHTML,
 		HasAttachments: email.HasAttachments,
+		RawSource:      email.Raw,
+	}
+	id, err := p.db.SaveEmailDetail(detail)
+	if err != nil {
+		return 0, err
+	}
+	p.saveAttachments(id, email.Attachments)
+	return id, nil
+}
+
+// saveAttachments records the attachments of a stored email, keeping their
+// content in the blob store while it has room
+func (p *Poller) saveAttachments(emailDetailID int64, attachments []imap.Attachment) {
+	for _, a := range attachments {
+		entry := &db.Attachment{
+			EmailDetailID: emailDetailID,
+			Filename:      a.Filename,
+			ContentType:   a.ContentType,
+			Size:          int64(len(a.Data)),
+			SHA256:        blobstore.Hash(a.Data),
+		}
+		if p.blobs != nil {
+			_, stored, err := p.blobs.Put(a.Data)
+			if err != nil {
+				log.Printf("Error storing attachment %q: %v", a.Filename, err)
+			} else if !stored {
+				log.Printf("Attachment store is full, keeping only metadata for %q", a.Filename)
+			}
+			entry.Stored = stored
+		}
+		if _, err := p.db.AddAttachment(entry); err != nil {
+			log.Printf("Error saving attachment %q: %v", a.Filename, err)
+		}
+	}
+}
+
+// archiveEmail keeps the original source of a fetched email that is being
+// deleted, linked to the action that deletes it
+func (p *Poller) archiveEmail(email *imap.FetchedEmail, folder string, actionLogID int64) {
+	p.archiveRaw(email.Raw, db.ArchivedMessage{
+		ActionLogID: actionLogID,
+		MessageID:   email.MessageID,
+		Sender:      strings.ToLower(email.From),
+		Subject:     email.Subject,
+		Date:        email.Date,
+		Folder:      folder,
+	})
+}
+
+// archiveEmailDetail archives the source stored with an email detail, for
+// emails deleted some time after they were fetched
+func (p *Poller) archiveEmailDetail(emailDetailID *int64, folder string, actionLogID int64) {
+	if p.archive == nil || emailDetailID == nil {
+		return
+	}
+	detail, err := p.db.GetEmailDetail(*emailDetailID)
+	if err != nil {
+		log.Printf("Error loading email detail %d to archive: %v", *emailDetailID, err)
+		return
 	}
-	return p.db.SaveEmailDetail(detail)
+	if detail == nil {
+		log.Printf("Email detail %d has expired, nothing to archive", *emailDetailID)
+		return
+	}
+	p.archiveRaw(detail.RawSource, db.ArchivedMessage{
+		ActionLogID: actionLogID,
+		MessageID:   detail.MessageID,
+		Sender:      strings.ToLower(detail.Sender),
+		Subject:     detail.Subject,
+		Date:        detail.Date,
+		Folder:      folder,
+	})
+}
+
+func (p *Poller) archiveRaw(raw []byte, entry db.ArchivedMessage) {
+	if p.archive == nil {
+		return
+	}
+	if len(raw) == 0 {
+		log.Printf("No source to archive for email %s from %s", entry.MessageID, entry.Sender)
+		return
+	}
+	hash, _, err := p.archive.Put(raw)
+	if err != nil {
+		log.Printf("Error archiving email %s: %v", entry.MessageID, err)
+		return
+	}
+	entry.SHA256 = hash
+	entry.Size = int64(len(raw))
+	if _, err := p.db.AddArchivedMessage(&entry); err != nil {
+		log.Printf("Error recording archived email %s: %v", entry.MessageID, err)
+	}
+}
+
+// deletesEmail reports whether an action removes the email from the mailbox
+// for good, as opposed to moving or only simulating
+func deletesEmail(action string) bool {
+	return action == db.ActionDeletedEmail || action == db.ActionDeletedMarketing
+}
+
+// recordEmails fetches and saves the full content of emails in folder and logs
+// the action built by entry for each, returning the action log IDs by UID
+func (p *Poller) recordEmails(folder string, emails []imap.Email, entry func(email imap.Email) *db.ActionLog) map[uint32]int64 {
+	if len(emails) == 0 {
+		return nil
+	}
+	return p.logEmails(pendingEmails{folder, emails, p.fetchFullEmails(folder, emails), entry})
+}
+
+// fetchFullEmails fetches the full content of emails in folder by UID
+func (p *Poller) fetchFullEmails(folder string, emails []imap.Email) map[uint32]*imap.FetchedEmail {
+	fetched := make(map[uint32]*imap.FetchedEmail)
+	fullEmails, err := p.client.FetchFullEmailsByUIDs(folder, emailUIDs(emails))
+	if err != nil {
+		// Fall back to logging without email content
+		log.Printf("Error fetching full emails from %s: %v", folder, err)
+	}
+	for i := range fullEmails {
+		fetched[fullEmails[i].UID] = &fullEmails[i]
+	}
+	return fetched
+}
+
+// logEmails saves the fetched content of pending emails and logs the action
+// built by its entry for each, returning the action log IDs by UID
+func (p *Poller) logEmails(pending pendingEmails) map[uint32]int64 {
+	logged := make(map[uint32]int64)
+	for _, email := range pending.emails {
+		fullEmail := pending.fetched[email.UID]
+		var emailDetailID int64
+		if fullEmail != nil {
+			var err error
+			if emailDetailID, err = p.saveEmailDetail(fullEmail); err != nil {
+				log.Printf("Error saving email detail: %v", err)
+			}
+		}
+
+		action := pending.entry(email)
+		logged[email.UID] = p.recordAction(action, emailDetailID)
+		if deletesEmail(action.Action) && fullEmail != nil {
+			p.archiveEmail(fullEmail, pending.folder, logged[email.UID])
+		}
+	}
+	return logged
+}
+
+// logRemoved logs the pending emails whose folder is in removed, recording
+// quarantined ones so they are purged later. Folders that failed are dropped
+// from states so their emails are found again on the next scan. It returns
+// the number of emails logged.
+func (p *Poller) logRemoved(pending []pendingEmails, removed []string, states map[string]imap.FolderState) int {
+	total := 0
+	for _, pe := range pending {
+		if !slices.Contains(removed, pe.folder) {
+			delete(states, pe.folder)
+			continue
+		}
+
+		logged := p.logEmails(pe)
+		for _, email := range pe.emails {
+			if pe.entry(email).Action != db.ActionQuarantined || logged[email.UID] == 0 {
+				continue
+			}
+			if err := p.db.AddQuarantineEntry(logged[email.UID], email.MessageID); err != nil {
+				log.Printf("Error recording quarantined email: %v", err)
+			}
+		}
+		total += len(pe.emails)
+	}
+	return total
+}
+
+// partitionSimulated splits emails into those to act on and those whose rule
+// only simulates. Simulated emails that are already waiting to be applied
+// are dropped so a rescan doesn't log them twice.
+func (p *Poller) partitionSimulated(emails []imap.Email, matcher *rules.Matcher, simulated []bool) (act, simulate []imap.Email) {
+	for _, email := range emails {
+		if i := matcher.Match(email.From); i < 0 || !simulated[i] {
+			act = append(act, email)
+			continue
+		}
+		if email.MessageID != "" {
+			pending, err := p.db.HasPendingSimulation(p.account, email.MessageID)
+			if err != nil {
+				log.Printf("Error checking simulated actions: %v", err)
+			}
+			if pending {
+				continue
+			}
+		}
+		simulate = append(simulate, email)
+	}
+	return act, simulate
+}
+
+// skipRestored drops emails the user restored from the dashboard, which the
+// rule that removed them would otherwise remove again
+func (p *Poller) skipRestored(folder string, emails []imap.Email) []imap.Email {
+	var kept []imap.Email
+	for _, email := range emails {
+		restored, err := p.db.IsRestored(p.account, email.MessageID)
+		if err != nil {
+			log.Printf("Error checking restores for %s: %v", email.MessageID, err)
+		}
+		if restored {
+			log.Printf("Leaving restored email from %s in %s: %s", email.From, folder, email.Subject)
+			continue
+		}
+		kept = append(kept, email)
+	}
+	return kept
+}
+
+// skipAllowlisted drops emails from allowlisted senders and logs each one as
+// skipped together with the rule, described by wouldFire, that would have acted
+func (p *Poller) skipAllowlisted(folder string, emails []imap.Email, allowlist *rules.Matcher, wouldFire func(email imap.Email) string) []imap.Email {
+	var remaining []imap.Email
+	for _, email := range emails {
+		i := allowlist.Match(email.From)
+		if i < 0 {
+			remaining = append(remaining, email)
+			continue
+		}
+		p.logSkipped(email.From, email.Subject, email.MessageID, folder, allowlist.Rule(i), wouldFire(email))
+	}
+	return remaining
+}
+
+// logSkipped records that an allowlisted sender's email was left alone
+func (p *Poller) logSkipped(sender, subject, messageID, folder string, allowed rules.Rule, wouldFire string) {
+	log.Printf("Skipping email from allowlisted sender %s in %s (allowlist rule %s, would have fired %s)",
+		sender, folder, allowed, wouldFire)
+	p.recordAction(&db.ActionLog{
+		Action:    db.ActionSkippedAllowlisted,
+		Sender:    sender,
+		Subject:   subject,
+		MessageID: messageID,
+		Details:   fmt.Sprintf("Left in %s: sender is on the allowlist (%s); would have fired %s", folder, allowed, wouldFire),
+		Folder:    folder,
+	}, 0)
+}
+
+func emailUIDs(emails []imap.Email) []uint32 {
+	uids := make([]uint32, len(emails))
+	for i, email := range emails {
+		uids[i] = email.UID
+	}
+	return uids
+}
+
+// ApplySimulated carries out a simulated action from the log: the email is
+// deleted, or quarantined if it was filtered as marketing and quarantine is on
+func (p *Poller) ApplySimulated(id int64) error {
+	entry, err := p.db.GetActionLogByID(id)
+	if err != nil {
+		return fmt.Errorf("failed to load action log: %w", err)
+	}
+	if entry == nil || !db.IsSimulatedAction(entry.Action) || entry.AppliedAt != nil {
+		return ErrNothingToApply
+	}
+	if entry.MessageID == "" || entry.Folder == "" {
+		return fmt.Errorf("action %d has no message to apply to", id)
+	}
+
+	allowlist, err := p.db.GetAllowlist(p.account)
+	if err != nil {
+		return fmt.Errorf("failed to get allowlist: %w", err)
+	}
+	if i := allowlist.Match(entry.Sender); i >= 0 {
+		p.logSkipped(entry.Sender, entry.Subject, entry.MessageID, entry.Folder, allowlist.Rule(i), actionLabel(entry.Action))
+		return fmt.Errorf("%s is on the allowlist (%s)", entry.Sender, allowlist.Rule(i))
+	}
+
+	applied := &db.ActionLog{
+		Action:        db.ActionDeletedEmail,
+		Sender:        entry.Sender,
+		Subject:       entry.Subject,
+		MessageID:     entry.MessageID,
+		Details:       fmt.Sprintf("Deleted email from blocked sender (folder: %s), applied from dry run", entry.Folder),
+		EmailDetailID: entry.EmailDetailID,
+		Folder:        entry.Folder,
+		Account:       p.account,
+	}
+
+	var found bool
+	switch {
+	case entry.Action == db.ActionWouldDeleteMarketing && p.quarantineDays > 0:
+		found, err = p.client.MoveByMessageID(entry.Folder, entry.MessageID, imap.FolderQuarantine)
+		applied.Action = db.ActionQuarantined
+		applied.Details = fmt.Sprintf("Quarantined marketing email from folder %s, applied from dry run", entry.Folder)
+	case entry.Action == db.ActionWouldDeleteMarketing:
+		found, err = p.client.DeleteByMessageID(entry.Folder, entry.MessageID)
+		applied.Action = db.ActionDeletedMarketing
+		applied.Details = fmt.Sprintf("Deleted marketing email from folder %s, applied from dry run", entry.Folder)
+	default:
+		found, err = p.client.DeleteByMessageID(entry.Folder, entry.MessageID)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("email is no longer in %s", entry.Folder)
+	}
+
+	if err := p.db.MarkActionApplied(id); err != nil {
+		log.Printf("Error marking action applied: %v", err)
+	}
+	appliedID, err := p.db.AddActionLog(applied)
+	if err != nil {
+		log.Printf("Error logging applied action: %v", err)
+	} else if applied.Action == db.ActionQuarantined {
+		if err := p.db.AddQuarantineEntry(appliedID, entry.MessageID); err != nil {
+			log.Printf("Error recording quarantined email: %v", err)
+		}
+	}
+	if deletesEmail(applied.Action) {
+		p.archiveEmailDetail(entry.EmailDetailID, entry.Folder, appliedID)
+	}
+
+	log.Printf("Applied simulated action %d for %s", id, entry.Sender)
+	return nil
+}
+
+// actionLabel names the rule behind a simulated action for the skipped log
+func actionLabel(action string) string {
+	if action == db.ActionWouldDeleteMarketing {
+		return "simulated transactional-only rule"
+	}
+	return "simulated blocked rule"
 }
 
 // logActionWithEmailDetail logs an action with optional email detail reference
-func (p *Poller) logActionWithEmailDetail(action, sender, subject, messageID, details string, emailDetailID int64) {
+// and returns the new entry's ID, or 0 if it could not be logged
+func (p *Poller) logActionWithEmailDetail(action, sender, subject, messageID, details string, emailDetailID int64) int64 {
+	return p.recordAction(&db.ActionLog{
+		Action:    action,
+		Sender:    sender,
+		Subject:   subject,
+		MessageID: messageID,
+		Details:   details,
+	}, emailDetailID)
+}
+
+// recordAction logs an action with optional email detail reference and returns
+// the new entry's ID, or 0 if it could not be logged
+func (p *Poller) recordAction(entry *db.ActionLog, emailDetailID int64) int64 {
+	entry.Account = p.account
 	if emailDetailID > 0 {
-		if err := p.db.LogActionWithEmail(action, sender, subject, messageID, details, emailDetailID); err != nil {
-			log.Printf("Error logging action with email: %v", err)
-			// Fall back to regular logging
-			p.db.LogAction(action, sender, subject, messageID, details)
+		entry.EmailDetailID = &emailDetailID
+		id, err := p.db.AddActionLog(entry)
+		if err == nil {
+			return id
 		}
-	} else {
-		p.db.LogAction(action, sender, subject, messageID, details)
+		log.Printf("Error logging action with email: %v", err)
+		// Fall back to regular logging
+		entry.EmailDetailID = nil
 	}
+
+	id, err := p.db.AddActionLog(entry)
+	if err != nil {
+		log.Printf("Error logging action: %v", err)
+		return 0
+	}
+	return id
 }
 
-// startDailyCleanup runs a daily task to purge old email details
+// startDailyCleanup runs a daily task to purge expired quarantine and, on the
+// primary poller, old email details
 func (p *Poller) startDailyCleanup(ctx context.Context) {
 	const retentionDays = 30
 
@@ -527,6 +1547,12 @@ func (p *Poller) startDailyCleanup(ctx context.Context) {
 }
 
 func (p *Poller) runCleanup(retentionDays int) {
+	p.purgeQuarantine()
+	if !p.primary {
+		return
+	}
+	p.purgeArchive()
+
 	deleted, err := p.db.PurgeOldEmailDetails(retentionDays)
 	if err != nil {
 		log.Printf("Error purging old email details: %v", err)
@@ -535,4 +1561,141 @@ func (p *Poller) runCleanup(retentionDays int) {
 	if deleted > 0 {
 		log.Printf("Purged %d email details older than %d days", deleted, retentionDays)
 	}
+
+	if p.blobs != nil {
+		keep, err := p.db.GetStoredAttachmentHashes()
+		if err != nil {
+			log.Printf("Error listing stored attachments: %v", err)
+			return
+		}
+		removed, freed, err := p.blobs.Prune(keep)
+		if err != nil {
+			log.Printf("Error pruning attachment store: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Removed %d attachment files (%d bytes) no longer referenced", removed, freed)
+		}
+	}
+}
+
+// purgeArchive forgets archived emails past the archive's retention and
+// removes their files
+func (p *Poller) purgeArchive() {
+	if p.archive == nil {
+		return
+	}
+
+	deleted, err := p.db.PurgeOldArchivedMessages(p.archiveDays)
+	if err != nil {
+		log.Printf("Error purging old archived emails: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Purged %d archived emails older than %d days", deleted, p.archiveDays)
+	}
+
+	keep, err := p.db.GetArchivedHashes()
+	if err != nil {
+		log.Printf("Error listing archived emails: %v", err)
+		return
+	}
+	removed, freed, err := p.archive.Prune(keep)
+	if err != nil {
+		log.Printf("Error pruning archive: %v", err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d archive files (%d bytes) no longer referenced", removed, freed)
+	}
+}
+
+// releaseAllowlisted moves a quarantined email from a sender that was
+// allowlisted in the meantime back to where it came from instead of purging it
+func (p *Poller) releaseAllowlisted(entry db.QuarantineEntry, allowed rules.Rule) {
+	dest := entry.OriginalFolder
+	if dest == "" {
+		dest = "INBOX"
+	}
+	if _, err := p.client.MoveByMessageID(imap.FolderQuarantine, entry.MessageID, dest); err != nil {
+		log.Printf("Error releasing quarantined email %s: %v", entry.MessageID, err)
+		return
+	}
+	if err := p.db.ResolveQuarantineEntry(entry.ID, db.QuarantineStatusReleased); err != nil {
+		log.Printf("Error updating quarantine entry: %v", err)
+	}
+	p.logSkipped(entry.Sender, entry.Subject, entry.MessageID, dest, allowed, "quarantine purge")
+}
+
+// purgeQuarantine deletes quarantined emails whose grace period has run out
+func (p *Poller) purgeQuarantine() {
+	if p.quarantineDays <= 0 {
+		return
+	}
+
+	// The primary poller also purges what was quarantined before accounts
+	// were recorded
+	accounts := []string{p.account}
+	if p.primary {
+		accounts = append(accounts, "")
+	}
+	expired, err := p.db.GetExpiredQuarantine(p.quarantineDays, accounts...)
+	if err != nil {
+		log.Printf("Error loading expired quarantine: %v", err)
+		return
+	}
+
+	allowlist, err := p.db.GetAllowlist(p.account)
+	if err != nil {
+		log.Printf("Error loading allowlist: %v", err)
+		return
+	}
+
+	var purged int
+	for _, entry := range expired {
+		// Entries from before emails without a Message-ID were deleted
+		// instead can't be found in the folder; stop looking for them
+		if entry.MessageID == "" {
+			log.Printf("Quarantined email from %s (%s) has no Message-ID; delete it from %s in your mail client",
+				entry.Sender, entry.Subject, imap.FolderQuarantine)
+			if err := p.db.ResolveQuarantineEntry(entry.ID, db.QuarantineStatusPurged); err != nil {
+				log.Printf("Error updating quarantine entry: %v", err)
+			}
+			continue
+		}
+
+		if i := allowlist.Match(entry.Sender); i >= 0 {
+			p.releaseAllowlisted(entry, allowlist.Rule(i))
+			continue
+		}
+
+		found, err := p.client.DeleteByMessageID(imap.FolderQuarantine, entry.MessageID)
+		if err != nil {
+			log.Printf("Error purging quarantined email %s: %v", entry.MessageID, err)
+			continue
+		}
+		if !found {
+			// Already gone, e.g. released or deleted by hand in a mail client
+			log.Printf("Quarantined email %s no longer in %s", entry.MessageID, imap.FolderQuarantine)
+		}
+
+		if err := p.db.ResolveQuarantineEntry(entry.ID, db.QuarantineStatusPurged); err != nil {
+			log.Printf("Error updating quarantine entry: %v", err)
+			continue
+		}
+		actionLogID := p.recordAction(&db.ActionLog{
+			Action:    db.ActionPurgedQuarantine,
+			Sender:    entry.Sender,
+			Subject:   entry.Subject,
+			MessageID: entry.MessageID,
+			Details:   fmt.Sprintf("Purged from quarantine after %d days", p.quarantineDays),
+			Folder:    imap.FolderQuarantine,
+		}, 0)
+		if found {
+			p.archiveEmailDetail(entry.EmailDetailID, entry.OriginalFolder, actionLogID)
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		log.Printf("Purged %d emails from quarantine", purged)
+	}
 }
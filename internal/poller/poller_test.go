@@ -0,0 +1,113 @@
+package poller
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	goimap "github.com/emersion/go-imap/v2"
+
+	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/rules"
+)
+
+// mailbox has a junk folder, a sent folder and the USPIS folders
+var mailbox = []imap.Folder{
+	{Name: "INBOX", Delim: '/'},
+	{Name: "Orders", Delim: '/'},
+	{Name: "Newsletters", Delim: '/'},
+	{Name: "Junk", Delim: '/', Attrs: []goimap.MailboxAttr{goimap.MailboxAttrJunk}},
+	{Name: "Sent", Delim: '/', Attrs: []goimap.MailboxAttr{goimap.MailboxAttrSent}},
+	{Name: "USPIS", Delim: '/'},
+	{Name: imap.FolderBlock, Delim: '/'},
+	{Name: imap.FolderQuarantine, Delim: '/'},
+}
+
+func TestScopedRuleFolders(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   scopedRule
+		policy imap.FolderPolicy
+		want   []string
+	}{
+		{"all", scopedRule{scope: rules.ScopeAll}, imap.FolderPolicy{}, []string{"INBOX", "Orders", "Newsletters"}},
+		{"inbox", scopedRule{scope: rules.ScopeInbox}, imap.FolderPolicy{}, []string{"INBOX"}},
+		{"inbox excluded", scopedRule{scope: rules.ScopeInbox}, imap.FolderPolicy{Exclude: []string{"INBOX"}}, nil},
+		{"except", scopedRule{scope: rules.ScopeExcept, except: []string{"Orders", "Junk"}}, imap.FolderPolicy{}, []string{"INBOX", "Newsletters"}},
+		{"junk", scopedRule{scope: rules.ScopeJunk}, imap.FolderPolicy{}, []string{"INBOX", "Orders", "Newsletters", "Junk"}},
+		{"all with junk scanned", scopedRule{scope: rules.ScopeAll}, imap.FolderPolicy{ScanJunk: true}, []string{"INBOX", "Orders", "Newsletters", "Junk"}},
+		{"except with junk scanned", scopedRule{scope: rules.ScopeExcept, except: []string{"Junk"}}, imap.FolderPolicy{ScanJunk: true}, []string{"INBOX", "Orders", "Newsletters"}},
+		{"except on top of the policy", scopedRule{scope: rules.ScopeExcept, except: []string{"Orders"}}, imap.FolderPolicy{Exclude: []string{"Newsletters"}}, []string{"INBOX"}},
+		{"included uspis folder", scopedRule{scope: rules.ScopeAll}, imap.FolderPolicy{Include: []string{imap.FolderBlock, "Sent"}}, []string{"INBOX", "Orders", "Newsletters", "Sent"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.folders(tt.policy, mailbox)
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("folders = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// An except rule must not change the policy other rules see, even when
+	// its exclusions fit in the policy's slice
+	policy := imap.FolderPolicy{Exclude: make([]string, 0, 4)}
+	except := scopedRule{scope: rules.ScopeExcept, except: []string{"Orders"}}
+	all := scopedRule{scope: rules.ScopeAll}
+	except.folders(policy, mailbox)
+	if got := all.folders(policy, mailbox); len(got) != 3 {
+		t.Errorf("folders after an except rule = %q, want all 3 scanned folders", got)
+	}
+}
+
+func TestGroupRules(t *testing.T) {
+	scoped := []scopedRule{
+		{rule: rules.Rule{Pattern: "all@example.com", Type: rules.MatchAddress}, scope: rules.ScopeAll},
+		{rule: rules.Rule{Pattern: "inbox@example.com", Type: rules.MatchAddress}, scope: rules.ScopeInbox, simulate: true},
+		{rule: rules.Rule{Pattern: "junk@example.com", Type: rules.MatchAddress}, scope: rules.ScopeJunk},
+		{rule: rules.Rule{Pattern: "except@example.com", Type: rules.MatchAddress}, scope: rules.ScopeExcept, except: []string{"INBOX", "Orders"}},
+	}
+	grouped := groupRules(scoped, imap.FolderPolicy{}, mailbox)
+
+	if got, want := strings.Join(grouped.folders, ", "), "INBOX, Orders, Newsletters, Junk"; got != want {
+		t.Errorf("folders = %q, want %q", got, want)
+	}
+	if grouped.all.Len() != len(scoped) {
+		t.Errorf("all has %d rules, want %d", grouped.all.Len(), len(scoped))
+	}
+
+	tests := []struct {
+		folder    string
+		senders   []string
+		simulated []bool
+	}{
+		{"INBOX", []string{"all@example.com", "inbox@example.com", "junk@example.com"}, []bool{false, true, false}},
+		{"Orders", []string{"all@example.com", "junk@example.com"}, []bool{false, false}},
+		{"Newsletters", []string{"all@example.com", "junk@example.com", "except@example.com"}, []bool{false, false, false}},
+		{"Junk", []string{"junk@example.com"}, []bool{false}},
+		{"Sent", nil, nil},
+		{imap.FolderBlock, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.folder, func(t *testing.T) {
+			emails := make([]imap.Email, len(scoped))
+			for i, r := range scoped {
+				emails[i] = imap.Email{UID: uint32(i + 1), From: r.rule.Pattern}
+			}
+
+			_, simulated, matched := grouped.match(imap.FolderEmails{Folder: tt.folder, Emails: emails})
+			var senders []string
+			for _, email := range matched {
+				senders = append(senders, email.From)
+			}
+			if strings.Join(senders, ", ") != strings.Join(tt.senders, ", ") {
+				t.Errorf("matched = %q, want %q", senders, tt.senders)
+			}
+			if len(tt.senders) > 0 && !slices.Equal(simulated, tt.simulated) {
+				t.Errorf("simulated = %v, want %v", simulated, tt.simulated)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MatchType selects how a rule's pattern is compared with a sender address
+type MatchType string
+
+const (
+	// MatchAddress matches one exact address
+	MatchAddress MatchType = "address"
+	// MatchDomain matches every address at exactly this domain
+	MatchDomain MatchType = "domain"
+	// MatchSubdomains matches the domain and all of its subdomains
+	MatchSubdomains MatchType = "subdomains"
+	// MatchGlob matches the address against a shell pattern like "deals*@*.example.com"
+	MatchGlob MatchType = "glob"
+	// MatchRegex matches the whole address against a regular expression
+	MatchRegex MatchType = "regex"
+)
+
+// ParseMatchType validates a match type name; an empty name means MatchAddress
+func ParseMatchType(s string) (MatchType, error) {
+	switch t := MatchType(s); t {
+	case "":
+		return MatchAddress, nil
+	case MatchAddress, MatchDomain, MatchSubdomains, MatchGlob, MatchRegex:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown match type %q", s)
+	}
+}
+
+// FolderScope limits the folders a blocked or transactional-only rule acts in
+type FolderScope string
+
+const (
+	// ScopeAll acts in every folder that is scanned
+	ScopeAll FolderScope = "all"
+	// ScopeInbox acts in INBOX only
+	ScopeInbox FolderScope = "inbox"
+	// ScopeExcept acts in every scanned folder except those the rule lists
+	ScopeExcept FolderScope = "except"
+	// ScopeJunk acts in every scanned folder and in the Junk or Spam folder,
+	// even when those aren't scanned otherwise
+	ScopeJunk FolderScope = "junk"
+)
+
+// ParseFolderScope validates a folder scope name; an empty name means ScopeAll
+func ParseFolderScope(s string) (FolderScope, error) {
+	switch scope := FolderScope(s); scope {
+	case "":
+		return ScopeAll, nil
+	case ScopeAll, ScopeInbox, ScopeExcept, ScopeJunk:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("unknown folder scope %q", s)
+	}
+}
+
+// Rule is a sender pattern
+type Rule struct {
+	Pattern string
+	Type    MatchType
+}
+
+// String describes the rule for logs and the action log
+func (r Rule) String() string {
+	switch r.Type {
+	case MatchDomain:
+		return "@" + r.Pattern
+	case MatchSubdomains:
+		return "*." + r.Pattern
+	case MatchGlob:
+		return "glob " + r.Pattern
+	case MatchRegex:
+		return "regex " + r.Pattern
+	default:
+		return r.Pattern
+	}
+}
+
+// Normalize cleans up a user-entered pattern and checks that it is valid for
+// the match type. Addresses, domains and globs are lowercased; a leading "@"
+// or "*." on a domain is dropped.
+func Normalize(t MatchType, pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if t != MatchRegex {
+		pattern = strings.ToLower(pattern)
+	}
+
+	switch t {
+	case MatchDomain, MatchSubdomains:
+		pattern = strings.TrimPrefix(pattern, "*.")
+		pattern = strings.TrimPrefix(pattern, "@")
+		if strings.Contains(pattern, "@") {
+			return "", fmt.Errorf("%q is not a domain", pattern)
+		}
+	case MatchGlob:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	case MatchRegex:
+		if _, err := compileRegex(pattern); err != nil {
+			return "", fmt.Errorf("invalid regex %q: %w", pattern, err)
+		}
+	}
+
+	if pattern == "" {
+		return "", fmt.Errorf("pattern is required")
+	}
+	return pattern, nil
+}
+
+// Domain returns the part of an address after the last "@"
+func Domain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return address
+}
+
+// BaseDomain guesses the registrable domain of a host, so that
+// news.brand.com and email.brand.com both map to brand.com. Two-letter
+// country TLDs with a short second level (co.uk, com.au) keep three labels.
+func BaseDomain(host string) string {
+	labels := strings.Split(strings.ToLower(host), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)^(?:" + pattern + ")$")
+}
+
+// Matcher finds the first rule matching a sender address
+type Matcher struct {
+	rules     []Rule
+	addresses map[string]int
+	regexps   map[int]*regexp.Regexp
+}
+
+// NewMatcher compiles rules into a matcher. Rules that fail to compile are
+// logged and never match.
+func NewMatcher(rules []Rule) *Matcher {
+	m := &Matcher{
+		rules:     rules,
+		addresses: make(map[string]int),
+		regexps:   make(map[int]*regexp.Regexp),
+	}
+	for i, r := range rules {
+		switch r.Type {
+		case MatchRegex:
+			re, err := compileRegex(r.Pattern)
+			if err != nil {
+				log.Printf("Ignoring invalid rule %s: %v", r, err)
+				continue
+			}
+			m.regexps[i] = re
+		case MatchDomain, MatchSubdomains, MatchGlob:
+		default:
+			address := strings.ToLower(r.Pattern)
+			if _, ok := m.addresses[address]; !ok {
+				m.addresses[address] = i
+			}
+		}
+	}
+	return m
+}
+
+// Len returns the number of rules
+func (m *Matcher) Len() int {
+	return len(m.rules)
+}
+
+// Match returns the index of the first rule matching address, or -1.
+// Exact address rules take precedence over patterns.
+func (m *Matcher) Match(address string) int {
+	address = strings.ToLower(address)
+	if address == "" {
+		return -1
+	}
+	if i, ok := m.addresses[address]; ok {
+		return i
+	}
+
+	domain := Domain(address)
+	for i, r := range m.rules {
+		switch r.Type {
+		case MatchDomain:
+			if domain == r.Pattern {
+				return i
+			}
+		case MatchSubdomains:
+			if domain == r.Pattern || strings.HasSuffix(domain, "."+r.Pattern) {
+				return i
+			}
+		case MatchGlob:
+			if ok, _ := path.Match(r.Pattern, address); ok {
+				return i
+			}
+		case MatchRegex:
+			if re := m.regexps[i]; re != nil && re.MatchString(address) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Rule returns the rule at index i
+func (m *Matcher) Rule(i int) Rule {
+	return m.rules[i]
+}
+
+// SearchTerms returns substrings for a server-side FROM search that together
+// find every address the rules can match. ok is false when a glob or regex
+// rule makes that impossible and all messages have to be checked locally.
+func (m *Matcher) SearchTerms() (terms []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, r := range m.rules {
+		var term string
+		switch r.Type {
+		case MatchDomain:
+			term = "@" + r.Pattern
+		case MatchSubdomains:
+			term = r.Pattern
+		case MatchGlob, MatchRegex:
+			return nil, false
+		default:
+			term = r.Pattern
+		}
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms, true
+}
@@ -0,0 +1,156 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		address string
+		want    bool
+	}{
+		{"address", Rule{"deals@shop.com", MatchAddress}, "deals@shop.com", true},
+		{"address ignores case", Rule{"Deals@Shop.com", MatchAddress}, "DEALS@shop.COM", true},
+		{"address is exact", Rule{"deals@shop.com", MatchAddress}, "deals@shop.com.evil.net", false},
+		{"address not a prefix", Rule{"deals@shop.com", MatchAddress}, "mydeals@shop.com", false},
+
+		{"domain", Rule{"shop.com", MatchDomain}, "news@shop.com", true},
+		{"domain ignores case", Rule{"shop.com", MatchDomain}, "News@SHOP.com", true},
+		{"domain leaves out subdomains", Rule{"shop.com", MatchDomain}, "news@mail.shop.com", false},
+		{"domain leaves out lookalikes", Rule{"shop.com", MatchDomain}, "news@myshop.com", false},
+
+		{"subdomains include the base domain", Rule{"shop.com", MatchSubdomains}, "news@shop.com", true},
+		{"subdomains", Rule{"shop.com", MatchSubdomains}, "news@mail.shop.com", true},
+		{"nested subdomains", Rule{"shop.com", MatchSubdomains}, "news@eu.mail.shop.com", true},
+		{"subdomains leave out lookalikes", Rule{"shop.com", MatchSubdomains}, "news@myshop.com", false},
+		{"subdomains leave out other domains", Rule{"shop.com", MatchSubdomains}, "news@shop.com.evil.net", false},
+		{"subdomain rule leaves out its parent", Rule{"mail.shop.com", MatchSubdomains}, "news@shop.com", false},
+
+		{"glob", Rule{"deals*@*.shop.com", MatchGlob}, "deals-eu@mail.shop.com", true},
+		{"glob ignores case", Rule{"deals*@*.shop.com", MatchGlob}, "DEALS@Mail.Shop.com", true},
+		{"glob is anchored at the start", Rule{"deals*@*.shop.com", MatchGlob}, "hotdeals@mail.shop.com", false},
+		{"glob is anchored at the end", Rule{"deals*@*.shop.com", MatchGlob}, "deals@mail.shop.com.evil.net", false},
+		{"glob dot is literal", Rule{"deals*@*.shop.com", MatchGlob}, "deals@shop.com", false},
+		{"glob single character", Rule{"news?@shop.com", MatchGlob}, "news1@shop.com", true},
+
+		{"regex", Rule{`(news|deals)@shop\.com`, MatchRegex}, "deals@shop.com", true},
+		{"regex ignores case", Rule{`deals@shop\.com`, MatchRegex}, "Deals@SHOP.com", true},
+		{"regex is anchored at the start", Rule{`deals@shop\.com`, MatchRegex}, "hotdeals@shop.com", false},
+		{"regex is anchored at the end", Rule{`deals@shop\.com`, MatchRegex}, "deals@shop.com.evil.net", false},
+		{"regex must match the whole address", Rule{`shop`, MatchRegex}, "deals@shop.com", false},
+		{"regex alternatives are anchored too", Rule{`a@x\.com|b@y\.com`, MatchRegex}, "b@y.com.evil.net", false},
+		{"invalid regex never matches", Rule{`deals@(shop`, MatchRegex}, "deals@(shop", false},
+
+		{"empty address", Rule{".*", MatchRegex}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewMatcher([]Rule{tt.rule}).Match(tt.address) == 0
+			if got != tt.want {
+				t.Errorf("rule %s matching %q = %v, want %v", tt.rule, tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchOrder(t *testing.T) {
+	m := NewMatcher([]Rule{
+		{"shop.com", MatchSubdomains},
+		{"shop.com", MatchDomain},
+		{"news@shop.com", MatchAddress},
+		{"news@shop.com", MatchAddress},
+	})
+
+	tests := []struct {
+		address string
+		want    int
+	}{
+		// Exact addresses beat patterns listed before them, and the first
+		// copy of an address wins
+		{"news@shop.com", 2},
+		// Otherwise the first matching pattern wins
+		{"deals@shop.com", 0},
+		{"deals@mail.shop.com", 0},
+		{"deals@other.com", -1},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.address); got != tt.want {
+			t.Errorf("Match(%q) = %d, want %d", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		matchType MatchType
+		pattern   string
+		want      string
+		wantErr   bool
+	}{
+		{MatchAddress, "  Deals@Shop.com ", "deals@shop.com", false},
+		{MatchDomain, "@Shop.com", "shop.com", false},
+		{MatchSubdomains, "*.shop.com", "shop.com", false},
+		{MatchDomain, "deals@shop.com", "", true},
+		{MatchGlob, "Deals*@*.Shop.com", "deals*@*.shop.com", false},
+		{MatchGlob, "deals[@shop.com", "", true},
+		{MatchRegex, `Deals@Shop\.com`, `Deals@Shop\.com`, false},
+		{MatchRegex, `deals@(shop`, "", true},
+		{MatchAddress, "   ", "", true},
+		{MatchDomain, "@", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.matchType, tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Normalize(%s, %q) error = %v, want error: %v", tt.matchType, tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Normalize(%s, %q) = %q, want %q", tt.matchType, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestBaseDomain(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"shop.com", "shop.com"},
+		{"news.shop.com", "shop.com"},
+		{"eu.mail.Shop.com", "shop.com"},
+		{"shop.co.uk", "shop.co.uk"},
+		{"news.shop.co.uk", "shop.co.uk"},
+		{"news.shop.com.au", "shop.com.au"},
+		{"news.shop.de", "shop.de"},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		if got := BaseDomain(tt.host); got != tt.want {
+			t.Errorf("BaseDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	terms, ok := NewMatcher([]Rule{
+		{"news@shop.com", MatchAddress},
+		{"shop.com", MatchDomain},
+		{"shop.com", MatchSubdomains},
+		{"shop.com", MatchDomain},
+	}).SearchTerms()
+	if !ok || strings.Join(terms, " ") != "news@shop.com @shop.com shop.com" {
+		t.Errorf("SearchTerms = %q, %v; want [news@shop.com @shop.com shop.com], true", terms, ok)
+	}
+
+	for _, r := range []Rule{{"deals*@shop.com", MatchGlob}, {`deals@shop\.com`, MatchRegex}} {
+		if _, ok := NewMatcher([]Rule{{"shop.com", MatchDomain}, r}).SearchTerms(); ok {
+			t.Errorf("SearchTerms with %s is ok, want not ok", r)
+		}
+	}
+}
@@ -2,33 +2,126 @@ package web
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"postal-inspection-service/internal/archive"
+	"postal-inspection-service/internal/blobstore"
+	"postal-inspection-service/internal/classifier"
 	"postal-inspection-service/internal/db"
+	"postal-inspection-service/internal/imap"
+	"postal-inspection-service/internal/mbox"
+	"postal-inspection-service/internal/oauth"
+	"postal-inspection-service/internal/poller"
+	"postal-inspection-service/internal/rules"
 )
 
 //go:embed templates/*.html
 var templateFS embed.FS
 
+// Mailbox is the subset of the IMAP client the web UI needs to act on messages
+type Mailbox interface {
+	ListFolders() ([]imap.Folder, error)
+	MoveByMessageID(folder, messageID, dest string) (bool, error)
+	AppendEmail(folder string, email *imap.FetchedEmail) error
+}
+
+// Applier carries out simulated actions recorded during a dry run
+type Applier interface {
+	ApplySimulated(id int64) error
+}
+
+// Account is a mailbox the dashboard manages
+type Account struct {
+	ID      string // Address the account is recorded under in the database
+	Mailbox Mailbox
+	Applier Applier
+	Tokens  *oauth.Source // nil unless the account signs in with OAuth2
+	// ScanJunk is set when every rule acts in spam folders (SCAN_JUNK)
+	ScanJunk bool
+}
+
+// accountCookie remembers the account picked in the dashboard's switcher
+const accountCookie = "account"
+
 type Server struct {
 	db        *db.DB
+	accounts  []Account
+	blobs     *blobstore.Store
+	archive   *archive.Store
 	port      int
 	tmpl      *template.Template
 	commitSHA string
 	repoURL   string
 }
 
-func NewServer(database *db.DB, port int, commitSHA, repoURL string) (*Server, error) {
+// NewServer creates the dashboard for accounts, of which there must be at least one
+func NewServer(database *db.DB, accounts []Account, blobs *blobstore.Store, archived *archive.Store, port int, commitSHA, repoURL string) (*Server, error) {
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no accounts")
+	}
+
 	funcMap := template.FuncMap{
+		"scopeLabel": func(scope rules.FolderScope, except []string) string {
+			switch scope {
+			case rules.ScopeInbox:
+				return "INBOX only"
+			case rules.ScopeExcept:
+				return "All except " + strings.Join(except, ", ")
+			case rules.ScopeJunk:
+				return "All, including Junk"
+			default:
+				return "All"
+			}
+		},
+		"matchLabel": func(t rules.MatchType) string {
+			switch t {
+			case rules.MatchDomain:
+				return "Domain"
+			case rules.MatchSubdomains:
+				return "Domain + subdomains"
+			case rules.MatchGlob:
+				return "Glob"
+			case rules.MatchRegex:
+				return "Regex"
+			default:
+				return "Address"
+			}
+		},
 		"formatTime": func(t time.Time) string {
 			return t.Format("2006-01-02 15:04:05")
 		},
+		"isSimulated": db.IsSimulatedAction,
+		"fileSize": func(n int64) string {
+			switch {
+			case n >= 1<<20:
+				return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+			case n >= 1<<10:
+				return fmt.Sprintf("%.0f KB", float64(n)/(1<<10))
+			default:
+				return fmt.Sprintf("%d bytes", n)
+			}
+		},
+		"isMarketing": isMarketingAction,
+		"modelScore": func(p *float64) string {
+			if p == nil {
+				return ""
+			}
+			if *p >= 0.5 {
+				return fmt.Sprintf("%.0f%% transactional", *p*100)
+			}
+			return fmt.Sprintf("%.0f%% marketing", (1-*p)*100)
+		},
 		"actionLabel": func(action string) string {
 			switch action {
 			case db.ActionBlockedSender:
@@ -43,6 +136,26 @@ func NewServer(database *db.DB, port int, commitSHA, repoURL string) (*Server, e
 				return "Removed Trans. Only"
 			case db.ActionDeletedMarketing:
 				return "Deleted Marketing"
+			case db.ActionQuarantined:
+				return "Quarantined"
+			case db.ActionReleasedQuarantine:
+				return "Released"
+			case db.ActionPurgedQuarantine:
+				return "Purged"
+			case db.ActionRestoredEmail:
+				return "Restored Email"
+			case db.ActionWouldDelete:
+				return "Would Delete"
+			case db.ActionWouldDeleteMarketing:
+				return "Would Delete Marketing"
+			case db.ActionAllowedSender:
+				return "Allowlisted Sender"
+			case db.ActionRemovedAllowed:
+				return "Removed from Allowlist"
+			case db.ActionSkippedAllowlisted:
+				return "Skipped (Allowlist)"
+			case db.ActionMarkedTransactional:
+				return "Marked Transactional"
 			default:
 				return action
 			}
@@ -61,6 +174,22 @@ func NewServer(database *db.DB, port int, commitSHA, repoURL string) (*Server, e
 				return "action-unblocked"
 			case db.ActionDeletedMarketing:
 				return "action-marketing"
+			case db.ActionQuarantined:
+				return "action-quarantined"
+			case db.ActionReleasedQuarantine:
+				return "action-unblocked"
+			case db.ActionPurgedQuarantine:
+				return "action-deleted"
+			case db.ActionRestoredEmail:
+				return "action-unblocked"
+			case db.ActionWouldDelete, db.ActionWouldDeleteMarketing:
+				return "action-simulated"
+			case db.ActionAllowedSender, db.ActionSkippedAllowlisted:
+				return "action-allowed"
+			case db.ActionRemovedAllowed:
+				return "action-deleted"
+			case db.ActionMarkedTransactional:
+				return "action-transactional"
 			default:
 				return ""
 			}
@@ -74,6 +203,9 @@ func NewServer(database *db.DB, port int, commitSHA, repoURL string) (*Server, e
 
 	return &Server{
 		db:        database,
+		accounts:  accounts,
+		blobs:     blobs,
+		archive:   archived,
 		port:      port,
 		tmpl:      tmpl,
 		commitSHA: commitSHA,
@@ -85,26 +217,122 @@ func (s *Server) Start() error {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/account", s.handleSelectAccount)
 	mux.HandleFunc("/", s.handleLog)
 	mux.HandleFunc("/blocked", s.handleBlocked)
 	mux.HandleFunc("/blocked/add", s.handleAddBlocked)
 	mux.HandleFunc("/blocked/delete", s.handleDeleteBlocked)
+	mux.HandleFunc("/blocked/simulate", s.handleSimulateBlocked)
 	mux.HandleFunc("/transactional", s.handleTransactional)
 	mux.HandleFunc("/transactional/add", s.handleAddTransactional)
 	mux.HandleFunc("/transactional/delete", s.handleDeleteTransactional)
+	mux.HandleFunc("/transactional/simulate", s.handleSimulateTransactional)
+	mux.HandleFunc("/allowed", s.handleAllowed)
+	mux.HandleFunc("/allowed/add", s.handleAddAllowed)
+	mux.HandleFunc("/allowed/delete", s.handleDeleteAllowed)
+	mux.HandleFunc("/folders", s.handleFolders)
+	mux.HandleFunc("/folders/set", s.handleSetFolder)
+	mux.HandleFunc("/quarantine", s.handleQuarantine)
+	mux.HandleFunc("/quarantine/release", s.handleReleaseQuarantine)
 	mux.HandleFunc("/log/detail", s.handleLogDetail)
+	mux.HandleFunc("/log/restore", s.handleRestoreEmail)
+	mux.HandleFunc("/log/apply", s.handleApplySimulated)
+	mux.HandleFunc("/log/transactional", s.handleMarkTransactional)
+	mux.HandleFunc("/attachment", s.handleAttachment)
+	mux.HandleFunc("/archive", s.handleArchive)
+	mux.HandleFunc("/archive/eml", s.handleArchivedEmail)
+	mux.HandleFunc("/archive/export", s.handleExportArchive)
+	mux.HandleFunc("/oauth", s.handleOAuth)
+	mux.HandleFunc("/oauth/start", s.handleOAuthStart)
+	mux.HandleFunc("/oauth/callback", s.handleOAuthCallback)
+	mux.HandleFunc("/oauth/forget", s.handleOAuthForget)
 
 	addr := fmt.Sprintf(":%d", s.port)
 	log.Printf("Starting web server on %s", addr)
 	return http.ListenAndServe(addr, mux)
 }
 
-func (s *Server) templateData(title string) map[string]any {
+func (s *Server) templateData(r *http.Request, title string) map[string]any {
+	ids := make([]string, len(s.accounts))
+	for i, a := range s.accounts {
+		ids[i] = a.ID
+	}
 	return map[string]any{
-		"Title":     title,
-		"CommitSHA": s.commitSHA,
-		"RepoURL":   s.repoURL,
+		"Title":           title,
+		"CommitSHA":       s.commitSHA,
+		"RepoURL":         s.repoURL,
+		"Accounts":        ids,
+		"MultiAccount":    len(s.accounts) > 1,
+		"SelectedAccount": s.selectedAccount(r),
+	}
+}
+
+// selectedAccount returns the account picked in the switcher, or "" for all
+// accounts
+func (s *Server) selectedAccount(r *http.Request) string {
+	cookie, err := r.Cookie(accountCookie)
+	if err != nil {
+		return ""
 	}
+	for _, a := range s.accounts {
+		if a.ID == cookie.Value {
+			return a.ID
+		}
+	}
+	return ""
+}
+
+// account returns the account with id, or nil if none is configured with it.
+// Entries from before accounts were recorded have no id and belong to the
+// first account.
+func (s *Server) account(id string) *Account {
+	if id == "" {
+		return &s.accounts[0]
+	}
+	for i := range s.accounts {
+		if s.accounts[i].ID == id {
+			return &s.accounts[i]
+		}
+	}
+	return nil
+}
+
+// formAccount reads the account a rule form applies to: "" for every
+// account, or one of the configured accounts
+func (s *Server) formAccount(r *http.Request) (string, error) {
+	id := r.FormValue("account")
+	if id == "" {
+		return "", nil
+	}
+	for _, a := range s.accounts {
+		if a.ID == id {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("unknown account %q", id)
+}
+
+// handleSelectAccount switches the dashboard to one account, or back to all
+// of them, and returns to the page the switcher was used on
+func (s *Server) handleSelectAccount(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if id != "" && s.account(id) == nil {
+		http.Error(w, "Unknown account", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     accountCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && ref.Path != "" {
+		redirect = ref.RequestURI()
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -114,14 +342,14 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleBlocked(w http.ResponseWriter, r *http.Request) {
-	senders, err := s.db.GetBlockedSenders()
+	senders, err := s.db.GetBlockedSenders(s.selectedAccount(r))
 	if err != nil {
 		http.Error(w, "Failed to load blocked senders", http.StatusInternalServerError)
 		log.Printf("Error loading blocked senders: %v", err)
 		return
 	}
 
-	data := s.templateData("Blocked Senders")
+	data := s.templateData(r, "Blocked Senders")
 	data["Senders"] = senders
 
 	if err := s.tmpl.ExecuteTemplate(w, "blocked.html", data); err != nil {
@@ -129,39 +357,111 @@ func (s *Server) handleBlocked(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// parseSenderRule reads the pattern and match type of a sender rule form
+func parseSenderRule(r *http.Request) (rules.Rule, error) {
+	matchType, err := rules.ParseMatchType(r.FormValue("match"))
+	if err != nil {
+		return rules.Rule{}, err
+	}
+	pattern, err := rules.Normalize(matchType, r.FormValue("email"))
+	if err != nil {
+		return rules.Rule{}, err
+	}
+	return rules.Rule{Pattern: pattern, Type: matchType}, nil
+}
+
+// parseFolderScope reads the folders a rule acts in from an add form. The
+// folders left out by rules.ScopeExcept are separated by commas.
+func parseFolderScope(r *http.Request) (rules.FolderScope, []string, error) {
+	scope, err := rules.ParseFolderScope(r.FormValue("scope"))
+	if err != nil || scope != rules.ScopeExcept {
+		return scope, nil, err
+	}
+	var except []string
+	for _, folder := range strings.Split(r.FormValue("except"), ",") {
+		if folder = strings.TrimSpace(folder); folder != "" {
+			except = append(except, folder)
+		}
+	}
+	if len(except) == 0 {
+		return "", nil, fmt.Errorf("list the folders the rule leaves out")
+	}
+	return scope, except, nil
+}
+
 func (s *Server) handleAddBlocked(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
-	reason := strings.TrimSpace(r.FormValue("reason"))
-
-	if email == "" {
-		http.Error(w, "Email is required", http.StatusBadRequest)
+	rule, err := parseSenderRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	account, err := s.formAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	scope, except, err := parseFolderScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	simulate := r.FormValue("simulate") != ""
 
 	if reason == "" {
 		reason = "Manually added via web UI"
 	}
 
-	if err := s.db.AddBlockedSender(email, reason); err != nil {
+	added, err := s.db.AddBlockedSender(&db.BlockedSender{
+		Email:         rule.Pattern,
+		MatchType:     rule.Type,
+		Reason:        reason,
+		Simulate:      simulate,
+		Account:       account,
+		FolderScope:   scope,
+		ExceptFolders: except,
+	})
+	if errors.Is(err, db.ErrRuleExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to add sender", http.StatusInternalServerError)
 		log.Printf("Error adding blocked sender: %v", err)
 		return
 	}
 
+	// Adding a rule again changes the folders it applies to
+	if !added {
+		changed, err := s.db.SetBlockedSenderScope(rule.Pattern, account, scope, except)
+		if err != nil {
+			http.Error(w, "Failed to update sender", http.StatusInternalServerError)
+			log.Printf("Error updating folder scope of blocked sender: %v", err)
+			return
+		}
+		if changed {
+			log.Printf("Changed folders of blocked rule via web UI: %s", rule)
+		}
+		http.Redirect(w, r, "/blocked", http.StatusSeeOther)
+		return
+	}
+
 	s.db.LogAction(
+		account,
 		db.ActionBlockedSender,
-		email,
+		rule.String(),
 		"",
 		"",
 		"Manually added via web UI",
 	)
 
-	log.Printf("Added sender to blocked list via web UI: %s", email)
+	log.Printf("Added sender to blocked list via web UI: %s", rule)
 	http.Redirect(w, r, "/blocked", http.StatusSeeOther)
 }
 
@@ -195,8 +495,9 @@ func (s *Server) handleDeleteBlocked(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.db.LogAction(
+		sender.Account,
 		db.ActionUnblockedSender,
-		sender.Email,
+		sender.Rule().String(),
 		"",
 		"",
 		"Removed from blocked list via web UI",
@@ -206,15 +507,48 @@ func (s *Server) handleDeleteBlocked(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/blocked", http.StatusSeeOther)
 }
 
+func (s *Server) handleSimulateBlocked(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	sender, err := s.db.GetBlockedSenderByID(id)
+	if err != nil {
+		http.Error(w, "Failed to find sender", http.StatusInternalServerError)
+		return
+	}
+	if sender == nil {
+		http.Error(w, "Sender not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.db.SetBlockedSenderSimulate(id, !sender.Simulate); err != nil {
+		http.Error(w, "Failed to update sender", http.StatusInternalServerError)
+		log.Printf("Error updating blocked sender: %v", err)
+		return
+	}
+
+	log.Printf("Set simulate=%v for blocked sender %s", !sender.Simulate, sender.Email)
+	http.Redirect(w, r, "/blocked", http.StatusSeeOther)
+}
+
 func (s *Server) handleTransactional(w http.ResponseWriter, r *http.Request) {
-	senders, err := s.db.GetTransactionalOnlySenders()
+	senders, err := s.db.GetTransactionalOnlySenders(s.selectedAccount(r))
 	if err != nil {
 		http.Error(w, "Failed to load transactional-only senders", http.StatusInternalServerError)
 		log.Printf("Error loading transactional-only senders: %v", err)
 		return
 	}
 
-	data := s.templateData("Transactional Only Senders")
+	data := s.templateData(r, "Transactional Only Senders")
 	data["Senders"] = senders
 
 	if err := s.tmpl.ExecuteTemplate(w, "transactional.html", data); err != nil {
@@ -228,33 +562,73 @@ func (s *Server) handleAddTransactional(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
-	reason := strings.TrimSpace(r.FormValue("reason"))
-
-	if email == "" {
-		http.Error(w, "Email is required", http.StatusBadRequest)
+	rule, err := parseSenderRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	account, err := s.formAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	scope, except, err := parseFolderScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	simulate := r.FormValue("simulate") != ""
 
 	if reason == "" {
 		reason = "Manually added via web UI"
 	}
 
-	if err := s.db.AddTransactionalOnlySender(email, reason); err != nil {
+	added, err := s.db.AddTransactionalOnlySender(&db.TransactionalOnlySender{
+		Email:         rule.Pattern,
+		MatchType:     rule.Type,
+		Reason:        reason,
+		Simulate:      simulate,
+		Account:       account,
+		FolderScope:   scope,
+		ExceptFolders: except,
+	})
+	if errors.Is(err, db.ErrRuleExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to add sender", http.StatusInternalServerError)
 		log.Printf("Error adding transactional-only sender: %v", err)
 		return
 	}
 
+	// Adding a rule again changes the folders it applies to
+	if !added {
+		changed, err := s.db.SetTransactionalOnlySenderScope(rule.Pattern, account, scope, except)
+		if err != nil {
+			http.Error(w, "Failed to update sender", http.StatusInternalServerError)
+			log.Printf("Error updating folder scope of transactional-only sender: %v", err)
+			return
+		}
+		if changed {
+			log.Printf("Changed folders of transactional-only rule via web UI: %s", rule)
+		}
+		http.Redirect(w, r, "/transactional", http.StatusSeeOther)
+		return
+	}
+
 	s.db.LogAction(
+		account,
 		db.ActionTransactionalOnlySender,
-		email,
+		rule.String(),
 		"",
 		"",
 		"Manually added via web UI - marketing emails will be deleted",
 	)
 
-	log.Printf("Added sender to transactional-only list via web UI: %s", email)
+	log.Printf("Added sender to transactional-only list via web UI: %s", rule)
 	http.Redirect(w, r, "/transactional", http.StatusSeeOther)
 }
 
@@ -288,8 +662,9 @@ func (s *Server) handleDeleteTransactional(w http.ResponseWriter, r *http.Reques
 	}
 
 	s.db.LogAction(
+		sender.Account,
 		db.ActionRemovedTransactionalOnly,
-		sender.Email,
+		sender.Rule().String(),
 		"",
 		"",
 		"Removed from transactional-only list via web UI",
@@ -299,63 +674,110 @@ func (s *Server) handleDeleteTransactional(w http.ResponseWriter, r *http.Reques
 	http.Redirect(w, r, "/transactional", http.StatusSeeOther)
 }
 
-func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+func (s *Server) handleSimulateTransactional(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	page := 1
-	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
 	}
 
-	limit := 50
-	offset := (page - 1) * limit
-
-	logs, err := s.db.GetActionLogs(limit, offset)
+	sender, err := s.db.GetTransactionalOnlySenderByID(id)
 	if err != nil {
-		http.Error(w, "Failed to load action logs", http.StatusInternalServerError)
-		log.Printf("Error loading action logs: %v", err)
+		http.Error(w, "Failed to find sender", http.StatusInternalServerError)
+		return
+	}
+	if sender == nil {
+		http.Error(w, "Sender not found", http.StatusNotFound)
 		return
 	}
 
-	totalCount, err := s.db.GetActionLogCount()
-	if err != nil {
-		http.Error(w, "Failed to load action log count", http.StatusInternalServerError)
+	if err := s.db.SetTransactionalOnlySenderSimulate(id, !sender.Simulate); err != nil {
+		http.Error(w, "Failed to update sender", http.StatusInternalServerError)
+		log.Printf("Error updating transactional-only sender: %v", err)
 		return
 	}
 
-	stats, err := s.db.GetStats()
+	log.Printf("Set simulate=%v for transactional-only sender %s", !sender.Simulate, sender.Email)
+	http.Redirect(w, r, "/transactional", http.StatusSeeOther)
+}
+
+func (s *Server) handleAllowed(w http.ResponseWriter, r *http.Request) {
+	senders, err := s.db.GetAllowedSenders(s.selectedAccount(r))
 	if err != nil {
-		http.Error(w, "Failed to load stats", http.StatusInternalServerError)
-		log.Printf("Error loading stats: %v", err)
+		http.Error(w, "Failed to load allowed senders", http.StatusInternalServerError)
+		log.Printf("Error loading allowed senders: %v", err)
 		return
 	}
 
-	totalPages := (totalCount + limit - 1) / limit
-	if totalPages == 0 {
-		totalPages = 1
+	data := s.templateData(r, "Allowlist")
+	data["Senders"] = senders
+
+	if err := s.tmpl.ExecuteTemplate(w, "allowed.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
 	}
+}
 
-	data := s.templateData("Action Log")
-	data["Logs"] = logs
-	data["Stats"] = stats
-	data["CurrentPage"] = page
-	data["TotalPages"] = totalPages
-	data["HasPrev"] = page > 1
-	data["HasNext"] = page < totalPages
-	data["PrevPage"] = page - 1
-	data["NextPage"] = page + 1
+func (s *Server) handleAddAllowed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	if err := s.tmpl.ExecuteTemplate(w, "log.html", data); err != nil {
-		log.Printf("Error rendering template: %v", err)
+	rule, err := parseSenderRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	account, err := s.formAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		reason = "Manually added via web UI"
+	}
+
+	if _, err := s.db.AddAllowedSender(&db.AllowedSender{
+		Email:     rule.Pattern,
+		MatchType: rule.Type,
+		Reason:    reason,
+		Account:   account,
+	}); errors.Is(err, db.ErrRuleExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to add sender", http.StatusInternalServerError)
+		log.Printf("Error adding allowed sender: %v", err)
+		return
 	}
+
+	s.db.LogAction(
+		account,
+		db.ActionAllowedSender,
+		rule.String(),
+		"",
+		"",
+		"Manually added via web UI - no rule will touch this sender",
+	)
+
+	log.Printf("Added sender to allowlist via web UI: %s", rule)
+	http.Redirect(w, r, "/allowed", http.StatusSeeOther)
 }
 
-func (s *Server) handleLogDetail(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleDeleteAllowed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	idStr := r.URL.Query().Get("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
@@ -363,30 +785,876 @@ func (s *Server) handleLogDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	actionLog, err := s.db.GetActionLogByID(id)
+	sender, err := s.db.GetAllowedSenderByID(id)
 	if err != nil {
-		http.Error(w, "Failed to load action log", http.StatusInternalServerError)
-		log.Printf("Error loading action log: %v", err)
+		http.Error(w, "Failed to find sender", http.StatusInternalServerError)
 		return
 	}
-	if actionLog == nil {
-		http.Error(w, "Action log not found", http.StatusNotFound)
+	if sender == nil {
+		http.Error(w, "Sender not found", http.StatusNotFound)
 		return
 	}
 
-	var emailDetail *db.EmailDetail
-	if actionLog.EmailDetailID != nil {
-		emailDetail, err = s.db.GetEmailDetail(*actionLog.EmailDetailID)
-		if err != nil {
-			log.Printf("Error loading email detail: %v", err)
-		}
+	if err := s.db.RemoveAllowedSender(id); err != nil {
+		http.Error(w, "Failed to remove sender", http.StatusInternalServerError)
+		log.Printf("Error removing allowed sender: %v", err)
+		return
 	}
 
-	data := s.templateData("Action Detail")
-	data["Log"] = actionLog
-	data["EmailDetail"] = emailDetail
+	s.db.LogAction(
+		sender.Account,
+		db.ActionRemovedAllowed,
+		sender.Rule().String(),
+		"",
+		"",
+		"Removed from allowlist via web UI",
+	)
 
-	if err := s.tmpl.ExecuteTemplate(w, "log_detail.html", data); err != nil {
+	log.Printf("Removed sender from allowlist: %s", sender.Email)
+	http.Redirect(w, r, "/allowed", http.StatusSeeOther)
+}
+
+// folderRow is a folder on the folders page with the override that applies to it
+type folderRow struct {
+	imap.FolderDecision
+	Override *db.FolderOverride
+}
+
+// handleFolders shows which folders of the selected account are scanned for
+// senders and why, and the folders the user included or excluded
+func (s *Server) handleFolders(w http.ResponseWriter, r *http.Request) {
+	account := s.account(s.selectedAccount(r))
+
+	overrides, err := s.db.GetFolderOverrides(account.ID)
+	if err != nil {
+		http.Error(w, "Failed to load folder settings", http.StatusInternalServerError)
+		log.Printf("Error loading folder overrides: %v", err)
+		return
+	}
+	policy, err := poller.LoadFolderPolicy(s.db, account.ID, account.ScanJunk)
+	if err != nil {
+		http.Error(w, "Failed to load folder settings", http.StatusInternalServerError)
+		log.Printf("Error loading folder policy: %v", err)
+		return
+	}
+
+	data := s.templateData(r, "Folders")
+	data["Account"] = account.ID
+	data["Overrides"] = overrides
+	data["ScanJunk"] = account.ScanJunk
+
+	folders, err := account.Mailbox.ListFolders()
+	if err != nil {
+		log.Printf("Error listing folders of %s: %v", account.ID, err)
+		data["Error"] = "Couldn't list the folders: " + err.Error()
+	} else {
+		// The account's own override comes last and wins
+		byFolder := make(map[string]*db.FolderOverride)
+		for i := range overrides {
+			byFolder[overrides[i].Folder] = &overrides[i]
+		}
+		var rows []folderRow
+		for _, d := range policy.Decide(folders) {
+			rows = append(rows, folderRow{FolderDecision: d, Override: byFolder[d.Folder.Name]})
+		}
+		data["Folders"] = rows
+	}
+
+	if err := s.tmpl.ExecuteTemplate(w, "folders.html", data); err != nil {
 		log.Printf("Error rendering template: %v", err)
 	}
 }
+
+// handleSetFolder includes a folder in scanning or excludes it, or with no
+// mode returns it to the default policy
+func (s *Server) handleSetFolder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	account, err := s.formAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	folder := strings.TrimSpace(r.FormValue("folder"))
+	if folder == "" {
+		http.Error(w, "Folder is required", http.StatusBadRequest)
+		return
+	}
+
+	switch mode := r.FormValue("mode"); mode {
+	case "":
+		err = s.db.RemoveFolderOverride(account, folder)
+	case db.FolderInclude, db.FolderExclude:
+		err = s.db.SetFolderOverride(&db.FolderOverride{Account: account, Folder: folder, Mode: mode})
+	default:
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save folder setting", http.StatusInternalServerError)
+		log.Printf("Error saving folder override: %v", err)
+		return
+	}
+
+	log.Printf("Set scanning of folder %s to %q for %q via web UI", folder, r.FormValue("mode"), account)
+	http.Redirect(w, r, "/folders", http.StatusSeeOther)
+}
+
+func (s *Server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.db.GetQuarantinedEmails(s.selectedAccount(r))
+	if err != nil {
+		http.Error(w, "Failed to load quarantined emails", http.StatusInternalServerError)
+		log.Printf("Error loading quarantined emails: %v", err)
+		return
+	}
+
+	data := s.templateData(r, "Quarantine")
+	data["Entries"] = entries
+
+	if err := s.tmpl.ExecuteTemplate(w, "quarantine.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+func (s *Server) handleReleaseQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := s.db.GetQuarantineEntryByID(id)
+	if err != nil {
+		http.Error(w, "Failed to find quarantined email", http.StatusInternalServerError)
+		return
+	}
+	if entry == nil || entry.Status != db.QuarantineStatusQuarantined {
+		http.Error(w, "Quarantined email not found", http.StatusNotFound)
+		return
+	}
+
+	if entry.MessageID == "" {
+		http.Error(w, "This email has no Message-ID to find it by; move it out of the quarantine folder in your mail client", http.StatusConflict)
+		return
+	}
+
+	dest := entry.OriginalFolder
+	if dest == "" {
+		dest = "INBOX"
+	}
+
+	account := s.account(entry.Account)
+	if account == nil {
+		http.Error(w, "Account of the email is no longer configured", http.StatusNotFound)
+		return
+	}
+
+	found, err := account.Mailbox.MoveByMessageID(imap.FolderQuarantine, entry.MessageID, dest)
+	if err != nil {
+		http.Error(w, "Failed to release email", http.StatusInternalServerError)
+		log.Printf("Error releasing quarantined email %s: %v", entry.MessageID, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Email is no longer in the quarantine folder", http.StatusGone)
+		return
+	}
+
+	if err := s.db.ResolveQuarantineEntry(entry.ID, db.QuarantineStatusReleased); err != nil {
+		log.Printf("Error updating quarantine entry: %v", err)
+	}
+
+	// A release means the classifier was wrong; keep it for later tuning
+	if err := s.db.AddClassifierCorrection(&db.ClassifierCorrection{
+		Sender:          entry.Sender,
+		Subject:         entry.Subject,
+		MessageID:       entry.MessageID,
+		EmailDetailID:   entry.EmailDetailID,
+		IsTransactional: true,
+		Source:          db.CorrectionSourceQuarantineRelease,
+	}); err != nil {
+		log.Printf("Error recording classifier correction: %v", err)
+	}
+
+	s.db.LogAction(
+		entry.Account,
+		db.ActionReleasedQuarantine,
+		entry.Sender,
+		entry.Subject,
+		entry.MessageID,
+		fmt.Sprintf("Released from quarantine to %s via web UI", dest),
+	)
+
+	log.Printf("Released quarantined email from %s to %s", entry.Sender, dest)
+	http.Redirect(w, r, "/quarantine", http.StatusSeeOther)
+}
+
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := 1
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	limit := 50
+	offset := (page - 1) * limit
+
+	account := s.selectedAccount(r)
+	logs, err := s.db.GetActionLogs(account, limit, offset)
+	if err != nil {
+		http.Error(w, "Failed to load action logs", http.StatusInternalServerError)
+		log.Printf("Error loading action logs: %v", err)
+		return
+	}
+
+	totalCount, err := s.db.GetActionLogCount(account)
+	if err != nil {
+		http.Error(w, "Failed to load action log count", http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := s.db.GetStats()
+	if err != nil {
+		http.Error(w, "Failed to load stats", http.StatusInternalServerError)
+		log.Printf("Error loading stats: %v", err)
+		return
+	}
+
+	totalPages := (totalCount + limit - 1) / limit
+	if totalPages == 0 {
+		totalPages = 1
+	}
+
+	data := s.templateData(r, "Action Log")
+	data["Logs"] = logs
+	data["Stats"] = stats
+	data["CurrentPage"] = page
+	data["TotalPages"] = totalPages
+	data["HasPrev"] = page > 1
+	data["HasNext"] = page < totalPages
+	data["PrevPage"] = page - 1
+	data["NextPage"] = page + 1
+
+	if err := s.tmpl.ExecuteTemplate(w, "log.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+func (s *Server) handleLogDetail(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	actionLog, err := s.db.GetActionLogByID(id)
+	if err != nil {
+		http.Error(w, "Failed to load action log", http.StatusInternalServerError)
+		log.Printf("Error loading action log: %v", err)
+		return
+	}
+	if actionLog == nil {
+		http.Error(w, "Action log not found", http.StatusNotFound)
+		return
+	}
+
+	var emailDetail *db.EmailDetail
+	if actionLog.EmailDetailID != nil {
+		emailDetail, err = s.db.GetEmailDetail(*actionLog.EmailDetailID)
+		if err != nil {
+			log.Printf("Error loading email detail: %v", err)
+		}
+	}
+
+	data := s.templateData(r, "Action Detail")
+	data["Log"] = actionLog
+	data["EmailDetail"] = emailDetail
+	if account := s.account(actionLog.Account); emailDetail != nil && account != nil {
+		data["Folders"] = s.restoreFolders(account.Mailbox)
+	}
+	if emailDetail != nil {
+		attachments, err := s.db.GetAttachments(emailDetail.ID)
+		if err != nil {
+			log.Printf("Error loading attachments: %v", err)
+		}
+		data["Attachments"] = attachments
+		data["AttachmentStore"] = s.blobs != nil
+	}
+	if s.archive != nil {
+		archived, err := s.db.FindArchivedMessage(actionLog.ID, actionLog.MessageID)
+		if err != nil {
+			log.Printf("Error loading archived email: %v", err)
+		}
+		data["Archived"] = archived
+	}
+	if isMarketingAction(actionLog.Action) && actionLog.MessageID != "" {
+		correction, err := s.db.GetClassifierCorrection(actionLog.MessageID)
+		if err != nil {
+			log.Printf("Error loading classifier correction: %v", err)
+		}
+		data["Corrected"] = correction != nil && correction.IsTransactional
+	}
+	if isMarketingAction(actionLog.Action) {
+		totals, err := s.db.GetModelTotals()
+		if err != nil {
+			log.Printf("Error loading learned model totals: %v", err)
+		}
+		data["ModelExamples"] = totals.Transactional
+		data["ModelMinimum"] = classifier.MinTrainedPerLabel
+	}
+
+	if err := s.tmpl.ExecuteTemplate(w, "log_detail.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+// handleAttachment downloads the kept content of an attachment. It is always
+// sent as a download so HTML or SVG attachments can't run in the dashboard.
+func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := s.db.GetAttachment(id)
+	if err != nil {
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		log.Printf("Error loading attachment: %v", err)
+		return
+	}
+	if attachment == nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if s.blobs == nil || !attachment.Stored {
+		http.Error(w, "Attachment content was not kept", http.StatusNotFound)
+		return
+	}
+
+	f, err := s.blobs.Open(attachment.SHA256)
+	if err != nil {
+		http.Error(w, "Attachment content is no longer available", http.StatusNotFound)
+		log.Printf("Error opening attachment %d: %v", id, err)
+		return
+	}
+	defer f.Close()
+
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	} else if strings.HasPrefix(contentType, "text/") {
+		// Text attachments were converted to UTF-8 when the email was parsed
+		contentType += "; charset=utf-8"
+	}
+	filename := attachment.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("attachment-%d", attachment.ID)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error sending attachment %d: %v", id, err)
+	}
+}
+
+// archiveListLimit caps how many archived emails the archive page lists; the
+// mbox export includes every match
+const archiveListLimit = 500
+
+// handleArchive lists archived emails matching a date range and sender
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	data := s.templateData(r, "Archive")
+	data["Enabled"] = s.archive != nil
+	data["From"] = r.URL.Query().Get("from")
+	data["To"] = r.URL.Query().Get("to")
+	data["Sender"] = r.URL.Query().Get("sender")
+	data["ExportURL"] = "/archive/export?" + r.URL.Query().Encode()
+	data["Limit"] = archiveListLimit
+
+	var messages []db.ArchivedMessage
+	filter, err := parseArchiveFilter(r)
+	if err != nil {
+		data["Error"] = err.Error()
+	} else {
+		messages, err = s.db.SearchArchivedMessages(filter, archiveListLimit)
+		if err != nil {
+			http.Error(w, "Failed to load archived emails", http.StatusInternalServerError)
+			log.Printf("Error loading archived emails: %v", err)
+			return
+		}
+	}
+	data["Messages"] = messages
+
+	if err := s.tmpl.ExecuteTemplate(w, "archive.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+// handleArchivedEmail downloads the original source of an archived email
+func (s *Server) handleArchivedEmail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if s.archive == nil {
+		http.Error(w, "The archive is turned off", http.StatusNotFound)
+		return
+	}
+
+	message, err := s.db.GetArchivedMessage(id)
+	if err != nil {
+		http.Error(w, "Failed to load archived email", http.StatusInternalServerError)
+		log.Printf("Error loading archived email: %v", err)
+		return
+	}
+	if message == nil {
+		http.Error(w, "Archived email not found", http.StatusNotFound)
+		return
+	}
+
+	raw, err := s.archive.Open(message.SHA256)
+	if err != nil {
+		http.Error(w, "Archived email is no longer available", http.StatusNotFound)
+		log.Printf("Error opening archived email %d: %v", id, err)
+		return
+	}
+	defer raw.Close()
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("email-%d.eml", message.ID),
+	}))
+	w.Header().Set("Content-Length", strconv.FormatInt(message.Size, 10))
+	if _, err := io.Copy(w, raw); err != nil {
+		log.Printf("Error sending archived email %d: %v", id, err)
+	}
+}
+
+// handleExportArchive downloads every archived email matching a date range
+// and sender as one mbox file
+func (s *Server) handleExportArchive(w http.ResponseWriter, r *http.Request) {
+	if s.archive == nil {
+		http.Error(w, "The archive is turned off", http.StatusNotFound)
+		return
+	}
+	filter, err := parseArchiveFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, err := s.db.SearchArchivedMessages(filter, 0)
+	if err != nil {
+		http.Error(w, "Failed to load archived emails", http.StatusInternalServerError)
+		log.Printf("Error loading archived emails: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("uspis-archive-%s.mbox", time.Now().Format("20060102")),
+	}))
+
+	// Oldest first, the order mail clients expect
+	out := mbox.NewWriter(w)
+	var exported int
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		raw, err := s.readArchived(m.SHA256)
+		if err != nil {
+			// Headers are already sent; skip what can't be read
+			log.Printf("Error reading archived email %d for export: %v", m.ID, err)
+			continue
+		}
+		if err := out.WriteMessage(m.Sender, m.ArchivedAt, raw); err != nil {
+			log.Printf("Error exporting archive: %v", err)
+			return
+		}
+		exported++
+	}
+	log.Printf("Exported %d archived emails as mbox", exported)
+}
+
+func (s *Server) readArchived(hash string) ([]byte, error) {
+	f, err := s.archive.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// parseArchiveFilter reads the from and to dates (inclusive, YYYY-MM-DD) and
+// the sender address or domain of an archive search
+func parseArchiveFilter(r *http.Request) (db.ArchiveFilter, error) {
+	var filter db.ArchiveFilter
+	query := r.URL.Query()
+	if from := query.Get("from"); from != "" {
+		since, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", from)
+		}
+		filter.Since = since
+	}
+	if to := query.Get("to"); to != "" {
+		until, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", to)
+		}
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+	filter.Sender = strings.TrimSpace(query.Get("sender"))
+	return filter, nil
+}
+
+// isMarketingAction reports whether an action was taken because the
+// classifier judged the email to be marketing
+func isMarketingAction(action string) bool {
+	return action == db.ActionDeletedMarketing || action == db.ActionQuarantined || action == db.ActionWouldDeleteMarketing
+}
+
+// handleMarkTransactional records that an email filtered as marketing was
+// actually transactional; the learned model picks it up on the next poll
+func (s *Server) handleMarkTransactional(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	actionLog, err := s.db.GetActionLogByID(id)
+	if err != nil {
+		http.Error(w, "Failed to load action log", http.StatusInternalServerError)
+		log.Printf("Error loading action log: %v", err)
+		return
+	}
+	if actionLog == nil || !isMarketingAction(actionLog.Action) || actionLog.MessageID == "" {
+		http.Error(w, "Not a classified marketing email", http.StatusNotFound)
+		return
+	}
+
+	err = s.db.AddClassifierCorrection(&db.ClassifierCorrection{
+		Sender:          actionLog.Sender,
+		Subject:         actionLog.Subject,
+		MessageID:       actionLog.MessageID,
+		EmailDetailID:   actionLog.EmailDetailID,
+		IsTransactional: true,
+		Source:          db.CorrectionSourceLogFeedback,
+	})
+	if err != nil {
+		http.Error(w, "Failed to record feedback", http.StatusInternalServerError)
+		log.Printf("Error recording classifier correction: %v", err)
+		return
+	}
+
+	s.db.LogAction(
+		actionLog.Account,
+		db.ActionMarkedTransactional,
+		actionLog.Sender,
+		actionLog.Subject,
+		actionLog.MessageID,
+		"Marked as transactional via web UI - the classifier will learn from it",
+	)
+
+	log.Printf("Marked email %s as transactional via web UI", actionLog.MessageID)
+	http.Redirect(w, r, fmt.Sprintf("/log/detail?id=%d", id), http.StatusSeeOther)
+}
+
+// restoreFolders lists the folders of mailbox an email can be restored to,
+// falling back to just INBOX if the mailbox can't be reached
+func (s *Server) restoreFolders(mailbox Mailbox) []string {
+	folders, err := mailbox.ListFolders()
+	if err != nil {
+		log.Printf("Error listing folders: %v", err)
+		return []string{"INBOX"}
+	}
+
+	var result []string
+	for _, folder := range folders {
+		if folder.Name == "USPIS" || strings.HasPrefix(folder.Name, "USPIS/") || !folder.Selectable() {
+			continue
+		}
+		result = append(result, folder.Name)
+	}
+	return result
+}
+
+func (s *Server) handleRestoreEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	folder := strings.TrimSpace(r.FormValue("folder"))
+	if folder == "" {
+		folder = "INBOX"
+	}
+
+	actionLog, err := s.db.GetActionLogByID(id)
+	if err != nil {
+		http.Error(w, "Failed to load action log", http.StatusInternalServerError)
+		log.Printf("Error loading action log: %v", err)
+		return
+	}
+	if actionLog == nil || actionLog.EmailDetailID == nil {
+		http.Error(w, "No stored email for this action", http.StatusNotFound)
+		return
+	}
+
+	detail, err := s.db.GetEmailDetail(*actionLog.EmailDetailID)
+	if err != nil {
+		http.Error(w, "Failed to load email", http.StatusInternalServerError)
+		log.Printf("Error loading email detail: %v", err)
+		return
+	}
+	if detail == nil {
+		http.Error(w, "Stored email not found", http.StatusNotFound)
+		return
+	}
+
+	// Only folders offered on the detail page; the USPIS folders would act
+	// on the email again
+	account := s.account(actionLog.Account)
+	if account == nil {
+		http.Error(w, "Account of the email is no longer configured", http.StatusNotFound)
+		return
+	}
+	mailbox := account.Mailbox
+	if !slices.Contains(s.restoreFolders(mailbox), folder) {
+		http.Error(w, "Can't restore to folder "+folder, http.StatusBadRequest)
+		return
+	}
+
+	err = mailbox.AppendEmail(folder, &imap.FetchedEmail{
+		MessageID: detail.MessageID,
+		From:      detail.Sender,
+		FromName:  detail.SenderName,
+		To:        detail.Recipients,
+		Subject:   detail.Subject,
+		Date:      detail.Date,
+		BodyText:  detail.BodyText,
+		BodyHTML:  detail.BodyHTML,
+		Raw:       detail.RawSource,
+	})
+	if err != nil {
+		http.Error(w, "Failed to restore email", http.StatusInternalServerError)
+		log.Printf("Error restoring email %s: %v", detail.MessageID, err)
+		return
+	}
+
+	source := "original source"
+	if len(detail.RawSource) == 0 {
+		source = "rebuilt from stored content"
+	}
+	if _, err := s.db.AddActionLog(&db.ActionLog{
+		Action:        db.ActionRestoredEmail,
+		Sender:        detail.Sender,
+		Subject:       detail.Subject,
+		MessageID:     detail.MessageID,
+		Details:       fmt.Sprintf("Restored to %s via web UI (%s)", folder, source),
+		EmailDetailID: &detail.ID,
+		Folder:        folder,
+		Account:       account.ID,
+	}); err != nil {
+		log.Printf("Error logging restore: %v", err)
+	}
+
+	log.Printf("Restored email from %s to %s", detail.Sender, folder)
+	http.Redirect(w, r, fmt.Sprintf("/log/detail?id=%d", id), http.StatusSeeOther)
+}
+
+func (s *Server) handleApplySimulated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := s.db.GetActionLogByID(id)
+	if err != nil {
+		http.Error(w, "Failed to load action log", http.StatusInternalServerError)
+		log.Printf("Error loading action log: %v", err)
+		return
+	}
+	if entry == nil {
+		http.Error(w, "No pending simulated action", http.StatusNotFound)
+		return
+	}
+
+	account := s.account(entry.Account)
+	if account == nil {
+		http.Error(w, "Account of the action is no longer configured", http.StatusNotFound)
+		return
+	}
+
+	if err := account.Applier.ApplySimulated(id); err != nil {
+		if errors.Is(err, poller.ErrNothingToApply) {
+			http.Error(w, "No pending simulated action", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to apply action: "+err.Error(), http.StatusInternalServerError)
+		log.Printf("Error applying simulated action %d: %v", id, err)
+		return
+	}
+
+	redirect := "/"
+	if r.FormValue("from") == "detail" {
+		redirect = fmt.Sprintf("/log/detail?id=%d", id)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// handleOAuth shows whether the accounts that sign in with OAuth2 are authorized
+func (s *Server) handleOAuth(w http.ResponseWriter, r *http.Request) {
+	s.renderOAuth(w, r, "")
+}
+
+// oauthAccount is an OAuth2 account as shown on the sign-in page
+type oauthAccount struct {
+	ID    string
+	Token *db.OAuthToken // nil if not authorized
+}
+
+// renderOAuth renders the sign-in page, with errMsg if authorizing failed
+func (s *Server) renderOAuth(w http.ResponseWriter, r *http.Request, errMsg string) {
+	data := s.templateData(r, "Sign-in")
+	data["Error"] = errMsg
+
+	var accounts []oauthAccount
+	for _, a := range s.accounts {
+		if a.Tokens == nil {
+			continue
+		}
+		token, err := a.Tokens.Status()
+		if err != nil {
+			http.Error(w, "Failed to load token", http.StatusInternalServerError)
+			log.Printf("Error loading OAuth token for %s: %v", a.ID, err)
+			return
+		}
+		accounts = append(accounts, oauthAccount{ID: a.ID, Token: token})
+		data["RedirectURL"] = a.Tokens.RedirectURL()
+	}
+	data["Enabled"] = len(accounts) > 0
+	data["OAuthAccounts"] = accounts
+
+	if err := s.tmpl.ExecuteTemplate(w, "oauth.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+// oauthSource returns the token source of the account named in the request
+func (s *Server) oauthSource(r *http.Request) *oauth.Source {
+	id := r.FormValue("account")
+	for _, a := range s.accounts {
+		if a.Tokens != nil && (a.ID == id || id == "") {
+			return a.Tokens
+		}
+	}
+	return nil
+}
+
+// handleOAuthStart sends the browser to the provider to grant access
+func (s *Server) handleOAuthStart(w http.ResponseWriter, r *http.Request) {
+	tokens := s.oauthSource(r)
+	if tokens == nil {
+		http.Error(w, "OAuth2 sign-in is not enabled for this account", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, tokens.AuthCodeURL(), http.StatusFound)
+}
+
+// handleOAuthCallback finishes the authorization when the provider sends the
+// browser back
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		msg := "Authorization was refused: " + errCode
+		if desc := query.Get("error_description"); desc != "" {
+			msg += " (" + desc + ")"
+		}
+		s.renderOAuth(w, r, msg)
+		return
+	}
+
+	// Every account shares the callback; the state tells which one started it
+	var tokens *oauth.Source
+	for _, a := range s.accounts {
+		if a.Tokens != nil && a.Tokens.Started(query.Get("state")) {
+			tokens = a.Tokens
+			break
+		}
+	}
+	if tokens == nil {
+		s.renderOAuth(w, r, "Authorization failed: unknown or expired authorization; start again")
+		return
+	}
+
+	if err := tokens.Authorize(r.Context(), query.Get("state"), query.Get("code")); err != nil {
+		log.Printf("Error authorizing %s: %v", tokens.Account(), err)
+		s.renderOAuth(w, r, "Authorization failed: "+err.Error())
+		return
+	}
+
+	log.Printf("Authorized %s to sign in with OAuth2", tokens.Account())
+	http.Redirect(w, r, "/oauth", http.StatusSeeOther)
+}
+
+// handleOAuthForget deletes the stored token of an account
+func (s *Server) handleOAuthForget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tokens := s.oauthSource(r)
+	if tokens == nil {
+		http.Error(w, "OAuth2 sign-in is not enabled for this account", http.StatusNotFound)
+		return
+	}
+
+	if err := tokens.Forget(); err != nil {
+		http.Error(w, "Failed to forget token", http.StatusInternalServerError)
+		log.Printf("Error forgetting OAuth token: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/oauth", http.StatusSeeOther)
+}